@@ -0,0 +1,270 @@
+//Package apiclient is a client of the pipeline /v1 API used by the command line.
+package apiclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/model"
+)
+
+//Client calls the pipeline API with an API token
+type Client struct {
+	URL string
+	//bearer token, or `accesskey:secretkey` of a rancher API key
+	Token      string
+	httpClient *http.Client
+}
+
+type collection struct {
+	Data json.RawMessage `json:"data"`
+}
+
+func NewClient(apiURL string, token string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(apiURL, "/"),
+		Token:      token,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (c *Client) ListPipelines() ([]*model.Pipeline, error) {
+	pipelines := []*model.Pipeline{}
+	err := c.list("/v1/pipelines", &pipelines)
+	return pipelines, err
+}
+
+func (c *Client) GetPipeline(id string) (*model.Pipeline, error) {
+	p := &model.Pipeline{}
+	err := c.do(http.MethodGet, "/v1/pipelines/"+url.PathEscape(id), nil, p)
+	return p, err
+}
+
+//FindPipeline gets a pipeline by id or name
+func (c *Client) FindPipeline(idOrName string) (*model.Pipeline, error) {
+	pipelines, err := c.ListPipelines()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pipelines {
+		if p.Id == idOrName || p.Name == idOrName {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find pipeline '%s'", idOrName)
+}
+
+//ImportPipeline creates a pipeline from the content of a pipeline file
+func (c *Client) ImportPipeline(fileName string, content []byte) (*model.Pipeline, error) {
+	body := map[string]interface{}{
+		"templates": map[string]string{fileName: string(content)},
+	}
+	p := &model.Pipeline{}
+	err := c.do(http.MethodPost, "/v1/pipelines", body, p)
+	return p, err
+}
+
+func (c *Client) UpdatePipeline(p *model.Pipeline) (*model.Pipeline, error) {
+	updated := &model.Pipeline{}
+	err := c.do(http.MethodPost, c.actionPath("/v1/pipelines/", p.Id, "update"), p, updated)
+	return updated, err
+}
+
+//ExportPipeline gets the pipeline file of a pipeline
+func (c *Client) ExportPipeline(id string) ([]byte, error) {
+	resp, err := c.request(http.MethodGet, "/v1/pipelines/"+url.PathEscape(id)+"/exportconfig", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+//RunPipeline starts an activity of the pipeline with parameter overrides of the input
+func (c *Client) RunPipeline(id string, input *model.RunInput) (*model.Activity, error) {
+	a := &model.Activity{}
+	err := c.do(http.MethodPost, c.actionPath("/v1/pipelines/", id, "run"), input, a)
+	return a, err
+}
+
+//ListActivities lists activities of all pipelines, or of a pipeline if pipelineId is not empty
+func (c *Client) ListActivities(pipelineId string) ([]*model.Activity, error) {
+	path := "/v1/activities"
+	if pipelineId != "" {
+		path = "/v1/pipelines/" + url.PathEscape(pipelineId) + "/activities"
+	}
+	activities := []*model.Activity{}
+	err := c.list(path, &activities)
+	return activities, err
+}
+
+func (c *Client) GetActivity(id string) (*model.Activity, error) {
+	a := &model.Activity{}
+	err := c.do(http.MethodGet, "/v1/activities/"+url.PathEscape(id), nil, a)
+	return a, err
+}
+
+//ActivityAction runs an action like approve, deny, stop or rerun on an activity
+func (c *Client) ActivityAction(id string, action string) (*model.Activity, error) {
+	a := &model.Activity{}
+	err := c.do(http.MethodPost, c.actionPath("/v1/activities/", id, action), nil, a)
+	return a, err
+}
+
+func (c *Client) ListAccounts() ([]*model.GitAccount, error) {
+	accounts := []*model.GitAccount{}
+	err := c.list("/v1/gitaccounts", &accounts)
+	return accounts, err
+}
+
+//RefreshRepos refreshes the cached repositories of a git account
+func (c *Client) RefreshRepos(id string) ([]*model.GitRepository, error) {
+	repos := []*model.GitRepository{}
+	resp, err := c.request(http.MethodPost, c.actionPath("/v1/gitaccounts/", id, "refreshrepos"), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	col := &collection{}
+	if err := json.NewDecoder(resp.Body).Decode(col); err != nil {
+		return nil, err
+	}
+	return repos, json.Unmarshal(col.Data, &repos)
+}
+
+//StepLog writes the log of a step to w, it keeps writing until the step finishes if follow is true
+func (c *Client) StepLog(activityId string, stageOrdinal int, stepOrdinal int, follow bool, w io.Writer) error {
+	wsURL, err := url.Parse(c.URL + "/v1/ws/log")
+	if err != nil {
+		return err
+	}
+	if wsURL.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	} else {
+		wsURL.Scheme = "ws"
+	}
+	query := url.Values{}
+	query.Set("activityId", activityId)
+	query.Set("stageOrdinal", strconv.Itoa(stageOrdinal))
+	query.Set("stepOrdinal", strconv.Itoa(stepOrdinal))
+	wsURL.RawQuery = query.Encode()
+	header := http.Header{}
+	c.authorize(header)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL.String(), header)
+	if err != nil {
+		return errors.Wrap(err, "connect to step log")
+	}
+	defer conn.Close()
+	//the whole log is sent on every change, only new lines are written
+	printed := 0
+	for {
+		msg := &struct {
+			ResourceType string `json:"resourceType"`
+			Data         string `json:"data"`
+		}{}
+		if err := conn.ReadJSON(msg); err != nil {
+			//the server closes the connection when the step finishes
+			return nil
+		}
+		if msg.ResourceType != "log" {
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(msg.Data, "\n"), "\n")
+		for _, line := range lines[printed:] {
+			//lines are prefixed with timestamps
+			if splits := strings.SplitN(line, "  ", 2); len(splits) == 2 {
+				line = splits[1]
+			}
+			fmt.Fprintln(w, line)
+		}
+		if len(lines) > printed {
+			printed = len(lines)
+		}
+		if !follow {
+			return nil
+		}
+	}
+}
+
+func (c *Client) actionPath(prefix string, id string, action string) string {
+	return prefix + url.PathEscape(id) + "?action=" + action
+}
+
+func (c *Client) list(path string, out interface{}) error {
+	col := &collection{}
+	if err := c.do(http.MethodGet, path, nil, col); err != nil {
+		return err
+	}
+	if len(col.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(col.Data, out)
+}
+
+func (c *Client) do(method string, path string, body interface{}, out interface{}) error {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+//request sends a request and checks the response status, errors of the API are returned with their messages
+func (c *Client) request(method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.URL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.authorize(req.Header)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	apiErr := &model.Error{}
+	if err := json.Unmarshal(data, apiErr); err == nil && apiErr.Msg != "" {
+		return nil, fmt.Errorf("%s %s: %s", method, path, apiErr.Msg)
+	}
+	return nil, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+}
+
+func (c *Client) authorize(header http.Header) {
+	if c.Token == "" {
+		return
+	}
+	if splits := strings.SplitN(c.Token, ":", 2); len(splits) == 2 {
+		req := &http.Request{Header: header}
+		req.SetBasicAuth(splits[0], splits[1])
+		return
+	}
+	header.Set("Authorization", "Bearer "+c.Token)
+}
@@ -0,0 +1,538 @@
+package apiclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/pipelinefile"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//logPollPeriod is the period to check whether a waiting step starts when following logs
+const logPollPeriod = 2 * time.Second
+
+//Commands gets the client commands of the command line
+func Commands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:  "pipelines",
+			Usage: "Manage pipelines",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List pipelines",
+					Action: listPipelines,
+					Flags:  outputFlags(),
+				},
+				{
+					Name:      "get",
+					Usage:     "Get a pipeline",
+					ArgsUsage: "<id or name>",
+					Action:    getPipeline,
+					Flags:     outputFlags(),
+				},
+				{
+					Name:   "apply",
+					Usage:  "Create a pipeline from a pipeline file, or update the pipeline of the same name",
+					Action: applyPipeline,
+					Flags: append(outputFlags(), cli.StringFlag{
+						Name:  "file, f",
+						Usage: "pipeline file to apply",
+					}),
+				},
+				{
+					Name:      "export",
+					Usage:     "Print the pipeline file of a pipeline",
+					ArgsUsage: "<id or name>",
+					Action:    exportPipeline,
+					Flags:     connectionFlags(),
+				},
+				{
+					Name:      "run",
+					Usage:     "Run a pipeline",
+					ArgsUsage: "<id or name>",
+					Action:    runPipeline,
+					Flags: append(outputFlags(),
+						cli.StringSliceFlag{
+							Name:  "param, p",
+							Usage: "override a parameter in 'key=val' format",
+						},
+						cli.StringFlag{
+							Name:  "branch",
+							Usage: "build the branch instead of the branch of the pipeline",
+						},
+						cli.StringFlag{
+							Name:  "commit",
+							Usage: "build the commit SHA",
+						},
+						cli.StringFlag{
+							Name:  "tag",
+							Usage: "build the tag",
+						},
+						cli.StringFlag{
+							Name:  "ref",
+							Usage: "build a full git ref, like refs/pull/1/head",
+						},
+					),
+				},
+			},
+		},
+		{
+			Name:  "activities",
+			Usage: "Manage pipeline histories",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List activities",
+					Action: listActivities,
+					Flags: append(outputFlags(), cli.StringFlag{
+						Name:  "pipeline",
+						Usage: "only list activities of the pipeline, by id or name",
+					}),
+				},
+				{
+					Name:      "get",
+					Usage:     "Get an activity",
+					ArgsUsage: "<id>",
+					Action:    getActivity,
+					Flags:     outputFlags(),
+				},
+				{
+					Name:      "logs",
+					Usage:     "Print logs of steps in an activity",
+					ArgsUsage: "<id>",
+					Action:    activityLogs,
+					Flags: append(connectionFlags(),
+						cli.BoolFlag{
+							Name:  "follow, f",
+							Usage: "keep printing logs until the activity finishes",
+						},
+						cli.IntFlag{
+							Name:  "stage",
+							Usage: "only print logs of the stage, starting from 1",
+						},
+						cli.IntFlag{
+							Name:  "step",
+							Usage: "only print logs of the step in the stage, starting from 1",
+						},
+					),
+				},
+				activityActionCommand("approve", "Approve a pending activity"),
+				activityActionCommand("deny", "Deny a pending activity"),
+				activityActionCommand("stop", "Stop a running activity"),
+				activityActionCommand("rerun", "Rerun an activity"),
+			},
+		},
+		{
+			Name:  "accounts",
+			Usage: "Manage git accounts",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List git accounts",
+					Action: listAccounts,
+					Flags:  outputFlags(),
+				},
+				{
+					Name:      "refresh",
+					Usage:     "Refresh repositories of a git account",
+					ArgsUsage: "<id>",
+					Action:    refreshAccount,
+					Flags:     outputFlags(),
+				},
+			},
+		},
+	}
+}
+
+func connectionFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "url",
+			Usage:  "pipeline API address",
+			EnvVar: "PIPELINE_URL",
+			Value:  "http://localhost:60080",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Usage:  "API token, or 'accesskey:secretkey' of a rancher API key",
+			EnvVar: "PIPELINE_TOKEN",
+		},
+	}
+}
+
+func outputFlags() []cli.Flag {
+	return append(connectionFlags(), cli.StringFlag{
+		Name:  "output, o",
+		Usage: "output format, one of table, json and yaml",
+		Value: "table",
+	})
+}
+
+func activityActionCommand(action string, usage string) cli.Command {
+	return cli.Command{
+		Name:      action,
+		Usage:     usage,
+		ArgsUsage: "<id>",
+		Flags:     outputFlags(),
+		Action: func(c *cli.Context) error {
+			id, err := requireArg(c)
+			if err != nil {
+				return err
+			}
+			a, err := newClient(c).ActivityAction(id, action)
+			if err != nil {
+				return exitError(err)
+			}
+			return printActivities(c, a, []*model.Activity{a})
+		},
+	}
+}
+
+func listPipelines(c *cli.Context) error {
+	pipelines, err := newClient(c).ListPipelines()
+	if err != nil {
+		return exitError(err)
+	}
+	return printPipelines(c, pipelines, pipelines)
+}
+
+func getPipeline(c *cli.Context) error {
+	idOrName, err := requireArg(c)
+	if err != nil {
+		return err
+	}
+	p, err := newClient(c).FindPipeline(idOrName)
+	if err != nil {
+		return exitError(err)
+	}
+	return printPipelines(c, p, []*model.Pipeline{p})
+}
+
+//applyPipeline creates or updates the pipeline of the file by name, run history and webhook of an existing pipeline are kept
+func applyPipeline(c *cli.Context) error {
+	file := c.String("file")
+	if file == "" {
+		return cli.NewExitError("pipeline file is required", 1)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return exitError(err)
+	}
+	content := model.PipelineContent{}
+	if err := pipelinefile.Decode(data, &content); err != nil {
+		return exitError(err)
+	}
+	if content.Name == "" {
+		return cli.NewExitError("name of the pipeline is required in the pipeline file", 1)
+	}
+	client := newClient(c)
+	pipelines, err := client.ListPipelines()
+	if err != nil {
+		return exitError(err)
+	}
+	var existing *model.Pipeline
+	for _, p := range pipelines {
+		if p.Name == content.Name {
+			existing = p
+		}
+	}
+	var applied *model.Pipeline
+	if existing == nil {
+		applied, err = client.ImportPipeline(filepath.Base(file), data)
+	} else {
+		p := &model.Pipeline{PipelineContent: content}
+		p.Id = existing.Id
+		p.RunCount = existing.RunCount
+		p.LastRunId = existing.LastRunId
+		p.LastRunStatus = existing.LastRunStatus
+		p.LastRunTime = existing.LastRunTime
+		p.NextRunTime = existing.NextRunTime
+		p.LastCoverage = existing.LastCoverage
+		p.CommitInfo = existing.CommitInfo
+		p.WebHookId = existing.WebHookId
+		p.WebHookToken = existing.WebHookToken
+		p.GenericWebhookToken = existing.GenericWebhookToken
+		p.WebHookUUID = existing.WebHookUUID
+		applied, err = client.UpdatePipeline(p)
+	}
+	if err != nil {
+		return exitError(err)
+	}
+	return printPipelines(c, applied, []*model.Pipeline{applied})
+}
+
+func exportPipeline(c *cli.Context) error {
+	idOrName, err := requireArg(c)
+	if err != nil {
+		return err
+	}
+	client := newClient(c)
+	p, err := client.FindPipeline(idOrName)
+	if err != nil {
+		return exitError(err)
+	}
+	content, err := client.ExportPipeline(p.Id)
+	if err != nil {
+		return exitError(err)
+	}
+	_, err = os.Stdout.Write(content)
+	return err
+}
+
+func runPipeline(c *cli.Context) error {
+	idOrName, err := requireArg(c)
+	if err != nil {
+		return err
+	}
+	parameters := map[string]string{}
+	for _, param := range c.StringSlice("param") {
+		splits := strings.SplitN(param, "=", 2)
+		if len(splits) != 2 {
+			return cli.NewExitError(fmt.Sprintf("parameter '%s' is not in 'key=val' format", param), 1)
+		}
+		parameters[splits[0]] = splits[1]
+	}
+	client := newClient(c)
+	p, err := client.FindPipeline(idOrName)
+	if err != nil {
+		return exitError(err)
+	}
+	a, err := client.RunPipeline(p.Id, &model.RunInput{
+		Parameters: parameters,
+		Branch:     c.String("branch"),
+		Commit:     c.String("commit"),
+		Tag:        c.String("tag"),
+		Ref:        c.String("ref"),
+	})
+	if err != nil {
+		return exitError(err)
+	}
+	return printActivities(c, a, []*model.Activity{a})
+}
+
+func listActivities(c *cli.Context) error {
+	client := newClient(c)
+	pipelineId := ""
+	if idOrName := c.String("pipeline"); idOrName != "" {
+		p, err := client.FindPipeline(idOrName)
+		if err != nil {
+			return exitError(err)
+		}
+		pipelineId = p.Id
+	}
+	activities, err := client.ListActivities(pipelineId)
+	if err != nil {
+		return exitError(err)
+	}
+	return printActivities(c, activities, activities)
+}
+
+func getActivity(c *cli.Context) error {
+	id, err := requireArg(c)
+	if err != nil {
+		return err
+	}
+	a, err := newClient(c).GetActivity(id)
+	if err != nil {
+		return exitError(err)
+	}
+	if c.String("output") != "table" {
+		return printData(c.String("output"), a)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "PIPELINE:\t%s #%d\n", a.PipelineName, a.RunSequence)
+	fmt.Fprintf(w, "STATUS:\t%s\n", a.Status)
+	fmt.Fprintf(w, "TRIGGER:\t%s\n", a.TriggerType)
+	fmt.Fprintf(w, "COMMIT:\t%s\n", a.CommitInfo)
+	for k, v := range a.Overrides {
+		fmt.Fprintf(w, "PARAMETER:\t%s=%s\n", k, v)
+	}
+	fmt.Fprintf(w, "STARTED:\t%s\n", formatTS(a.StartTS))
+	if a.FailMessage != "" {
+		fmt.Fprintf(w, "MESSAGE:\t%s\n", a.FailMessage)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "STAGE\tSTEP\tSTATUS\tDURATION")
+	for _, stage := range a.ActivityStages {
+		for _, step := range stage.ActivitySteps {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", stage.Name, step.Name, step.Status, time.Duration(step.Duration)*time.Millisecond)
+		}
+	}
+	return w.Flush()
+}
+
+//activityLogs prints logs of steps in order, steps which have not started are waited for when following
+func activityLogs(c *cli.Context) error {
+	id, err := requireArg(c)
+	if err != nil {
+		return err
+	}
+	client := newClient(c)
+	follow := c.Bool("follow")
+	onlyStage, onlyStep := c.Int("stage"), c.Int("step")
+	a, err := client.GetActivity(id)
+	if err != nil {
+		return exitError(err)
+	}
+	for stageOrdinal, stage := range a.ActivityStages {
+		if onlyStage > 0 && onlyStage != stageOrdinal+1 {
+			continue
+		}
+		for stepOrdinal := range stage.ActivitySteps {
+			if onlyStep > 0 && onlyStep != stepOrdinal+1 {
+				continue
+			}
+			for follow && isWaiting(a, stageOrdinal, stepOrdinal) && !isFinished(a) {
+				time.Sleep(logPollPeriod)
+				if a, err = client.GetActivity(id); err != nil {
+					return exitError(err)
+				}
+			}
+			step := a.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+			if step.Status == model.ActivityStepWaiting || step.Status == model.ActivityStepSkip {
+				continue
+			}
+			fmt.Printf("==> %s / %s (%s)\n", stage.Name, step.Name, step.Status)
+			if err := client.StepLog(id, stageOrdinal, stepOrdinal, follow, os.Stdout); err != nil {
+				return exitError(err)
+			}
+			if follow {
+				if a, err = client.GetActivity(id); err != nil {
+					return exitError(err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func listAccounts(c *cli.Context) error {
+	accounts, err := newClient(c).ListAccounts()
+	if err != nil {
+		return exitError(err)
+	}
+	if c.String("output") != "table" {
+		return printData(c.String("output"), accounts)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tLOGIN\tPRIVATE\tSTATUS")
+	for _, account := range accounts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", account.Id, account.AccountType, account.Login, account.Private, account.Status)
+	}
+	return w.Flush()
+}
+
+func refreshAccount(c *cli.Context) error {
+	id, err := requireArg(c)
+	if err != nil {
+		return err
+	}
+	repos, err := newClient(c).RefreshRepos(id)
+	if err != nil {
+		return exitError(err)
+	}
+	if c.String("output") != "table" {
+		return printData(c.String("output"), repos)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tTYPE")
+	for _, repo := range repos {
+		fmt.Fprintf(w, "%s\t%s\n", repo.CloneURL, repo.ScmType)
+	}
+	return w.Flush()
+}
+
+//printPipelines prints data in json or yaml, or the pipelines in a table
+func printPipelines(c *cli.Context, data interface{}, pipelines []*model.Pipeline) error {
+	if c.String("output") != "table" {
+		return printData(c.String("output"), data)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tACTIVE\tRUNS\tLAST STATUS\tLAST RUN")
+	for _, p := range pipelines {
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%s\t%s\n", p.Id, p.Name, p.IsActivate, p.RunCount, p.LastRunStatus, formatTS(p.LastRunTime))
+	}
+	return w.Flush()
+}
+
+//printActivities prints data in json or yaml, or the activities in a table
+func printActivities(c *cli.Context, data interface{}, activities []*model.Activity) error {
+	if c.String("output") != "table" {
+		return printData(c.String("output"), data)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPIPELINE\tRUN\tSTATUS\tTRIGGER\tSTARTED")
+	for _, a := range activities {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", a.Id, a.PipelineName, a.RunSequence, a.Status, a.TriggerType, formatTS(a.StartTS))
+	}
+	return w.Flush()
+}
+
+//printData prints data in json or yaml, yaml keys are the same as json keys of the API
+func printData(format string, data interface{}) error {
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		fmt.Println(string(b))
+	case "yaml":
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		out, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+	default:
+		return cli.NewExitError(fmt.Sprintf("unknown output format '%s'", format), 1)
+	}
+	return nil
+}
+
+func newClient(c *cli.Context) *Client {
+	return NewClient(c.String("url"), c.String("token"))
+}
+
+func requireArg(c *cli.Context) (string, error) {
+	if c.NArg() != 1 {
+		return "", cli.NewExitError(fmt.Sprintf("expected 1 argument: %s", c.Command.ArgsUsage), 1)
+	}
+	return c.Args().First(), nil
+}
+
+func exitError(err error) error {
+	return cli.NewExitError(err.Error(), 1)
+}
+
+func isWaiting(a *model.Activity, stageOrdinal int, stepOrdinal int) bool {
+	return a.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Status == model.ActivityStepWaiting
+}
+
+func isFinished(a *model.Activity) bool {
+	switch a.Status {
+	case model.ActivitySuccess, model.ActivityFail, model.ActivityDenied, model.ActivityAbort:
+		return true
+	}
+	return false
+}
+
+//formatTS formats a timestamp in milliseconds
+func formatTS(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.Unix(0, ts*int64(time.Millisecond)).Format(time.RFC3339)
+}
@@ -0,0 +1,452 @@
+//Package condition implements the expression language of stage and step conditions.
+//
+//An expression consists of variables, quoted strings, `true`/`false`, lists like `["a","b"]`,
+//operators `==`, `!=`, `=~`, `!~`, `in`, `&&`, `||`, `!`, parentheses and functions
+//`startsWith`, `endsWith`, `contains` and `changed`, e.g.
+//
+//	(CICD_GIT_BRANCH =~ "^release/" || CICD_GIT_TAG != "") && !startsWith(CICD_GIT_BRANCH, "release/hotfix")
+//
+//Legacy conditions in `KEY=VALUE` or `KEY!=VALUE` format are still supported.
+package condition
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//Context provides the values to evaluate an expression
+type Context struct {
+	Env map[string]string
+	//files changed by the commits to build, nil means unknown
+	ChangedFiles []string
+}
+
+//Expression is a parsed condition expression
+type Expression struct {
+	source string
+	root   node
+}
+
+//legacy format: KEY=VALUE or KEY!=VALUE, VALUE is the rest of the condition, it is not quoted and may refer to variables
+var regLegacy = regexp.MustCompile(`^\s*\$?\{?([A-Za-z_][A-Za-z0-9_]*)\}?\s*(!=|=)\s*([^\s=~].*?)\s*$`)
+
+//Parse parses and type checks a condition expression
+func Parse(expr string) (*Expression, error) {
+	//KEY=VALUE is always legacy, KEY!=VALUE is legacy unless VALUE looks like an expression that parses
+	m := regLegacy.FindStringSubmatch(expr)
+	if m != nil && (m[2] == "=" || !strings.ContainsAny(m[3], `"'&|()`)) {
+		return parseLegacy(expr, m), nil
+	}
+	tokens, err := tokenize(expr)
+	if err != nil {
+		if m != nil {
+			return parseLegacy(expr, m), nil
+		}
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err == nil {
+		if t := p.peek(); t.kind != tokenEOF {
+			err = &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected '%s'", t.text)}
+		}
+	}
+	if err != nil {
+		if m != nil {
+			return parseLegacy(expr, m), nil
+		}
+		return nil, err
+	}
+	if root.typ() != typeBool {
+		return nil, &SyntaxError{Pos: root.pos(), Msg: fmt.Sprintf("expression should be boolean but got %s", root.typ())}
+	}
+	return &Expression{source: expr, root: root}, nil
+}
+
+//parseLegacy gets the comparison of a condition matching regLegacy
+func parseLegacy(expr string, m []string) *Expression {
+	root := &compareNode{
+		op:    "==",
+		left:  &varNode{name: m[1], position: 1},
+		right: &templateNode{template: m[3], position: strings.Index(expr, m[3]) + 1},
+	}
+	if m[2] == "!=" {
+		root.op = "!="
+	}
+	return &Expression{source: expr, root: root}
+}
+
+//ToExpression converts a legacy condition to an expression which can be combined with others by operators,
+//other conditions are returned as they are. Legacy values referring to variables can not be converted.
+func ToExpression(expr string) (string, error) {
+	e, err := Parse(expr)
+	if err != nil {
+		return "", err
+	}
+	compare, ok := e.root.(*compareNode)
+	if !ok {
+		return expr, nil
+	}
+	template, ok := compare.right.(*templateNode)
+	if !ok {
+		return expr, nil
+	}
+	if regVarRef.MatchString(template.template) {
+		return "", fmt.Errorf("condition '%s' refers to variables in its value, use an expression like %s %s VAR instead", expr, compare.left.(*varNode).name, compare.op)
+	}
+	quoted := strings.Replace(template.template, `\`, `\\`, -1)
+	quoted = strings.Replace(quoted, `"`, `\"`, -1)
+	return fmt.Sprintf(`%s %s "%s"`, compare.left.(*varNode).name, compare.op, quoted), nil
+}
+
+//Evaluate evaluates the expression in the context
+func (e *Expression) Evaluate(ctx *Context) (bool, error) {
+	if ctx == nil {
+		ctx = &Context{}
+	}
+	v, err := e.root.eval(ctx)
+	if err != nil {
+		return false, err
+	}
+	return v.b, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+//Evaluate parses and evaluates a condition expression
+func Evaluate(expr string, ctx *Context) (bool, error) {
+	e, err := Parse(expr)
+	if err != nil {
+		return false, err
+	}
+	return e.Evaluate(ctx)
+}
+
+type valueType int
+
+const (
+	typeString valueType = iota
+	typeBool
+	typeList
+)
+
+func (t valueType) String() string {
+	switch t {
+	case typeString:
+		return "string"
+	case typeBool:
+		return "boolean"
+	case typeList:
+		return "list"
+	}
+	return "unknown"
+}
+
+type value struct {
+	s    string
+	b    bool
+	list []string
+}
+
+type node interface {
+	eval(ctx *Context) (value, error)
+	typ() valueType
+	pos() int
+}
+
+type stringNode struct {
+	value    string
+	position int
+}
+
+func (n *stringNode) eval(ctx *Context) (value, error) {
+	return value{s: n.value}, nil
+}
+
+func (n *stringNode) typ() valueType {
+	return typeString
+}
+
+func (n *stringNode) pos() int {
+	return n.position
+}
+
+//templateNode is an unquoted legacy value in which variables are substituted
+type templateNode struct {
+	template string
+	position int
+}
+
+var regVarRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+func (n *templateNode) eval(ctx *Context) (value, error) {
+	s := regVarRef.ReplaceAllStringFunc(n.template, func(ref string) string {
+		m := regVarRef.FindStringSubmatch(ref)
+		name := m[1]
+		if name == "" {
+			name = m[2]
+		}
+		if v, ok := ctx.Env[name]; ok {
+			return v
+		}
+		return ref
+	})
+	return value{s: s}, nil
+}
+
+func (n *templateNode) typ() valueType {
+	return typeString
+}
+
+func (n *templateNode) pos() int {
+	return n.position
+}
+
+type varNode struct {
+	name     string
+	position int
+}
+
+func (n *varNode) eval(ctx *Context) (value, error) {
+	return value{s: ctx.Env[n.name]}, nil
+}
+
+func (n *varNode) typ() valueType {
+	return typeString
+}
+
+func (n *varNode) pos() int {
+	return n.position
+}
+
+type boolNode struct {
+	value    bool
+	position int
+}
+
+func (n *boolNode) eval(ctx *Context) (value, error) {
+	return value{b: n.value}, nil
+}
+
+func (n *boolNode) typ() valueType {
+	return typeBool
+}
+
+func (n *boolNode) pos() int {
+	return n.position
+}
+
+type listNode struct {
+	items    []node
+	position int
+}
+
+func (n *listNode) eval(ctx *Context) (value, error) {
+	list := []string{}
+	for _, item := range n.items {
+		v, err := item.eval(ctx)
+		if err != nil {
+			return value{}, err
+		}
+		list = append(list, v.s)
+	}
+	return value{list: list}, nil
+}
+
+func (n *listNode) typ() valueType {
+	return typeList
+}
+
+func (n *listNode) pos() int {
+	return n.position
+}
+
+type notNode struct {
+	operand  node
+	position int
+}
+
+func (n *notNode) eval(ctx *Context) (value, error) {
+	v, err := n.operand.eval(ctx)
+	if err != nil {
+		return value{}, err
+	}
+	return value{b: !v.b}, nil
+}
+
+func (n *notNode) typ() valueType {
+	return typeBool
+}
+
+func (n *notNode) pos() int {
+	return n.position
+}
+
+type logicalNode struct {
+	op          string
+	left, right node
+	position    int
+}
+
+func (n *logicalNode) eval(ctx *Context) (value, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return value{}, err
+	}
+	//short circuit
+	if (n.op == "&&" && !l.b) || (n.op == "||" && l.b) {
+		return l, nil
+	}
+	return n.right.eval(ctx)
+}
+
+func (n *logicalNode) typ() valueType {
+	return typeBool
+}
+
+func (n *logicalNode) pos() int {
+	return n.position
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+	position    int
+}
+
+func (n *compareNode) eval(ctx *Context) (value, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return value{}, err
+	}
+	r, err := n.right.eval(ctx)
+	if err != nil {
+		return value{}, err
+	}
+	equal := l.s == r.s && l.b == r.b
+	if n.op == "!=" {
+		return value{b: !equal}, nil
+	}
+	return value{b: equal}, nil
+}
+
+func (n *compareNode) typ() valueType {
+	return typeBool
+}
+
+func (n *compareNode) pos() int {
+	return n.position
+}
+
+type matchNode struct {
+	negate      bool
+	left, right node
+	compiled    *regexp.Regexp
+	position    int
+}
+
+func (n *matchNode) eval(ctx *Context) (value, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return value{}, err
+	}
+	re := n.compiled
+	if re == nil {
+		r, err := n.right.eval(ctx)
+		if err != nil {
+			return value{}, err
+		}
+		if re, err = regexp.Compile(r.s); err != nil {
+			return value{}, &SyntaxError{Pos: n.right.pos(), Msg: fmt.Sprintf("invalid regular expression: %v", err)}
+		}
+	}
+	return value{b: re.MatchString(l.s) != n.negate}, nil
+}
+
+func (n *matchNode) typ() valueType {
+	return typeBool
+}
+
+func (n *matchNode) pos() int {
+	return n.position
+}
+
+type inNode struct {
+	left, right node
+	position    int
+}
+
+func (n *inNode) eval(ctx *Context) (value, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return value{}, err
+	}
+	r, err := n.right.eval(ctx)
+	if err != nil {
+		return value{}, err
+	}
+	for _, item := range r.list {
+		if item == l.s {
+			return value{b: true}, nil
+		}
+	}
+	return value{b: false}, nil
+}
+
+func (n *inNode) typ() valueType {
+	return typeBool
+}
+
+func (n *inNode) pos() int {
+	return n.position
+}
+
+type function struct {
+	//-1 for variadic
+	minArgs, maxArgs int
+	call             func(ctx *Context, args []string) bool
+}
+
+var functions = map[string]function{
+	"startsWith": {2, 2, func(ctx *Context, args []string) bool { return strings.HasPrefix(args[0], args[1]) }},
+	"endsWith":   {2, 2, func(ctx *Context, args []string) bool { return strings.HasSuffix(args[0], args[1]) }},
+	"contains":   {2, 2, func(ctx *Context, args []string) bool { return strings.Contains(args[0], args[1]) }},
+	//changed(patterns...) checks if any changed file matches any of the glob patterns,
+	//it is true when changed files are unknown
+	"changed": {1, -1, func(ctx *Context, args []string) bool {
+		if ctx.ChangedFiles == nil {
+			return true
+		}
+		return MatchAny(args, ctx.ChangedFiles)
+	}},
+}
+
+type callNode struct {
+	name     string
+	fn       function
+	args     []node
+	position int
+}
+
+func (n *callNode) eval(ctx *Context) (value, error) {
+	args := []string{}
+	for _, arg := range n.args {
+		v, err := arg.eval(ctx)
+		if err != nil {
+			return value{}, err
+		}
+		args = append(args, v.s)
+	}
+	return value{b: n.fn.call(ctx, args)}, nil
+}
+
+func (n *callNode) typ() valueType {
+	return typeBool
+}
+
+func (n *callNode) pos() int {
+	return n.position
+}
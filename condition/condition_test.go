@@ -0,0 +1,129 @@
+package condition
+
+import "testing"
+
+func TestEvaluate(t *testing.T) {
+	ctx := &Context{
+		Env: map[string]string{
+			"CICD_GIT_BRANCH": "release/1.0",
+			"CICD_GIT_TAG":    "",
+			"CICD_EVENT_TYPE": "push",
+			"NAME":            "café",
+			"OTHER":           "release/1.0",
+		},
+		ChangedFiles: []string{"docs/README.md", "src/main.go"},
+	}
+	tests := []struct {
+		expr   string
+		result bool
+	}{
+		{`CICD_GIT_BRANCH == "release/1.0"`, true},
+		{`$CICD_GIT_BRANCH != "master"`, true},
+		{`${CICD_GIT_BRANCH} == OTHER`, true},
+		{`CICD_GIT_BRANCH =~ "^release/"`, true},
+		{`CICD_GIT_BRANCH !~ "^release/"`, false},
+		{`CICD_EVENT_TYPE in ["push", "tag"]`, true},
+		{`CICD_EVENT_TYPE in ['release']`, false},
+		{`(CICD_GIT_BRANCH =~ "^release/" || CICD_GIT_TAG != "") && !startsWith(CICD_GIT_BRANCH, "release/hotfix")`, true},
+		{`startsWith(CICD_GIT_BRANCH, "release") && endsWith(CICD_GIT_BRANCH, ".0") && contains(CICD_GIT_BRANCH, "/")`, true},
+		{`changed("src/**/*.go")`, true},
+		{`changed("*.txt", "vendor/")`, false},
+		{`UNDEFINED == ""`, true},
+		{`NAME == "café"`, true},
+		{`NAME == 'caf\'e'`, false},
+		{`true && !false`, true},
+		{`false || CICD_EVENT_TYPE == "push" && false`, false},
+		//legacy conditions
+		{`CICD_GIT_BRANCH=release/1.0`, true},
+		{`CICD_GIT_BRANCH!=master`, true},
+		{`CICD_GIT_BRANCH=${OTHER}`, true},
+		{`NAME=café`, true},
+		{`CICD_EVENT_TYPE = push`, true},
+		{`CICD_EVENT_TYPE!=(push)`, true},
+	}
+	for _, test := range tests {
+		result, err := Evaluate(test.expr, ctx)
+		if err != nil {
+			t.Errorf("Evaluate(%q): %v", test.expr, err)
+			continue
+		}
+		if result != test.result {
+			t.Errorf("Evaluate(%q) = %v, expected %v", test.expr, result, test.result)
+		}
+	}
+}
+
+func TestChangedWithUnknownFiles(t *testing.T) {
+	result, err := Evaluate(`changed("docs/")`, &Context{})
+	if err != nil || !result {
+		t.Errorf("changed should be true when changed files are unknown, got %v, %v", result, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{`CICD_GIT_BRANCH`, 1},
+		{`"a" == "b" &&`, 14},
+		{`A == "b`, 6},
+		{`A === "b"`, 5},
+		{`(A == "b"`, 10},
+		{`A == "b")`, 9},
+		{`unknown(A)`, 1},
+		{`startsWith(A)`, 1},
+		{`A =~ "("`, 6},
+		{`A in "b"`, 6},
+		{`A && B`, 1},
+		{`["a"] == ["a"]`, 7},
+		{`A == "é" && B ==`, 17},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.expr)
+		if err == nil {
+			t.Errorf("Parse(%q) should fail", test.expr)
+			continue
+		}
+		syntaxErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("Parse(%q) got %T error: %v", test.expr, err, err)
+			continue
+		}
+		if syntaxErr.Pos != test.pos {
+			t.Errorf("Parse(%q) error at position %d, expected %d: %v", test.expr, syntaxErr.Pos, test.pos, err)
+		}
+	}
+}
+
+func TestToExpression(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`CICD_GIT_BRANCH=master`, `CICD_GIT_BRANCH == "master"`},
+		{`CICD_GIT_BRANCH!=master`, `CICD_GIT_BRANCH != "master"`},
+		{`A=say "hi" \o/`, `A == "say \"hi\" \\o/"`},
+		{`A == "b" || B != "c"`, `A == "b" || B != "c"`},
+	}
+	for _, test := range tests {
+		expr, err := ToExpression(test.expr)
+		if err != nil {
+			t.Errorf("ToExpression(%q): %v", test.expr, err)
+			continue
+		}
+		if expr != test.expected {
+			t.Errorf("ToExpression(%q) = %q, expected %q", test.expr, expr, test.expected)
+		}
+		//the converted expression evaluates the same way
+		ctx := &Context{Env: map[string]string{"A": `say "hi" \o/`, "CICD_GIT_BRANCH": "master"}}
+		before, _ := Evaluate(test.expr, ctx)
+		after, err := Evaluate(expr, ctx)
+		if err != nil || before != after {
+			t.Errorf("ToExpression(%q) = %q evaluates to %v, expected %v: %v", test.expr, expr, after, before, err)
+		}
+	}
+	if _, err := ToExpression(`A=${B}`); err == nil {
+		t.Error("legacy values referring to variables can not be converted")
+	}
+}
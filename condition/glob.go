@@ -0,0 +1,67 @@
+package condition
+
+import (
+	"regexp"
+	"strings"
+)
+
+//MatchGlob checks if a slash separated path matches the glob pattern.
+//`*` matches any characters except `/`, `?` matches one character except `/`,
+//`**` matches any characters including `/`. A pattern ending with `/` matches everything under the directory.
+func MatchGlob(pattern string, path string) bool {
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(strings.TrimPrefix(path, "/"))
+}
+
+//MatchAny checks if any of the paths matches any of the glob patterns
+func MatchAny(patterns []string, paths []string) bool {
+	for _, pattern := range patterns {
+		re, err := globRegexp(pattern)
+		if err != nil {
+			continue
+		}
+		for _, path := range paths {
+			if re.MatchString(strings.TrimPrefix(path, "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	//match characters rather than bytes so `?` matches one character of non-ASCII names
+	runes := []rune(pattern)
+	b := []byte{'^'}
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch c {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				i++
+				//`**/` also matches zero directories
+				if i+1 < len(runes) && runes[i+1] == '/' {
+					i++
+					b = append(b, "(.*/)?"...)
+				} else {
+					b = append(b, ".*"...)
+				}
+			} else {
+				b = append(b, "[^/]*"...)
+			}
+		case '?':
+			b = append(b, "[^/]"...)
+		default:
+			b = append(b, regexp.QuoteMeta(string(c))...)
+		}
+	}
+	b = append(b, '$')
+	return regexp.Compile(string(b))
+}
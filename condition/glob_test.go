@@ -0,0 +1,57 @@
+package condition
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "pkg/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "pkg/sub/main.go", true},
+		{"docs/", "docs/README.md", true},
+		{"docs/", "docs/api/v1.md", true},
+		{"docs/", "src/docs/a.md", false},
+		{"/src/*.js", "src/app.js", true},
+		{"src/**", "src/a/b/c.txt", true},
+		{"v?", "v1", true},
+		{"v?", "v12", false},
+		{"v?", "v/", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/hotfix", false},
+		{"a.b", "axb", false},
+		{"a+b(c)", "a+b(c)", true},
+		{"文档/*.md", "文档/说明.md", true},
+		{"Ünïcode-?", "Ünïcode-é", true},
+		{"?", "é", true},
+		{"??", "é", false},
+		{"café*", "cafe-latte", false},
+	}
+	for _, test := range tests {
+		if got := MatchGlob(test.pattern, test.path); got != test.match {
+			t.Errorf("MatchGlob(%q, %q) = %v, expected %v", test.pattern, test.path, got, test.match)
+		}
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		paths    []string
+		match    bool
+	}{
+		{[]string{"*.md", "docs/"}, []string{"src/main.go", "docs/a.txt"}, true},
+		{[]string{"*.md"}, []string{"src/README.md"}, false},
+		{nil, []string{"a"}, false},
+		{[]string{"**"}, nil, false},
+		{[]string{"分支/*"}, []string{"分支/功能"}, true},
+	}
+	for _, test := range tests {
+		if got := MatchAny(test.patterns, test.paths); got != test.match {
+			t.Errorf("MatchAny(%q, %q) = %v, expected %v", test.patterns, test.paths, got, test.match)
+		}
+	}
+}
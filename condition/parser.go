@@ -0,0 +1,367 @@
+package condition
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenVar
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  int
+	text  string
+	value string
+	pos   int
+}
+
+//SyntaxError is an error in a condition expression, Pos is the 1-based character position
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+//operators, longer ones first
+var operators = []string{"==", "!=", "=~", "!~", "&&", "||", "!", "(", ")", "[", "]", ","}
+
+func tokenize(expr string) ([]token, error) {
+	runes := []rune(expr)
+	tokens := []token{}
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		if unicode.IsSpace(r) {
+			i++
+			continue
+		}
+		start := i
+		switch {
+		case r == '"' || r == '\'':
+			quote := r
+			i++
+			value := []rune{}
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					value = append(value, runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == quote {
+					closed = true
+					i++
+					break
+				}
+				value = append(value, runes[i])
+				i++
+			}
+			if !closed {
+				return nil, &SyntaxError{Pos: start + 1, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: string(runes[start:i]), value: string(value), pos: start + 1})
+		case r == '$':
+			i++
+			braced := i < len(runes) && runes[i] == '{'
+			if braced {
+				i++
+			}
+			nameStart := i
+			for i < len(runes) && isIdentRune(runes[i], i == nameStart) {
+				i++
+			}
+			name := string(runes[nameStart:i])
+			if name == "" {
+				return nil, &SyntaxError{Pos: start + 1, Msg: "invalid variable reference"}
+			}
+			if braced {
+				if i >= len(runes) || runes[i] != '}' {
+					return nil, &SyntaxError{Pos: start + 1, Msg: "missing '}' in variable reference"}
+				}
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenVar, text: string(runes[start:i]), value: name, pos: start + 1})
+		case isIdentRune(r, true):
+			for i < len(runes) && isIdentRune(runes[i], false) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), value: string(runes[start:i]), pos: start + 1})
+		default:
+			matched := ""
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					matched = op
+					break
+				}
+			}
+			if matched == "" {
+				if r == '=' {
+					return nil, &SyntaxError{Pos: start + 1, Msg: "unexpected '=', use '==' to compare"}
+				}
+				return nil, &SyntaxError{Pos: start + 1, Msg: fmt.Sprintf("unexpected character '%c'", r)}
+			}
+			i += len([]rune(matched))
+			tokens = append(tokens, token{kind: tokenOperator, text: matched, value: matched, pos: start + 1})
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, text: "end of expression", pos: len(runes) + 1})
+	return tokens, nil
+}
+
+func isIdentRune(r rune, first bool) bool {
+	if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+		return true
+	}
+	return !first && r >= '0' && r <= '9'
+}
+
+type parser struct {
+	tokens []token
+	cur    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.cur]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.cur]
+	if t.kind != tokenEOF {
+		p.cur++
+	}
+	return t
+}
+
+func (p *parser) isOperator(op string) bool {
+	t := p.peek()
+	return t.kind == tokenOperator && t.value == op
+}
+
+func (p *parser) expect(op string) error {
+	t := p.next()
+	if t.kind != tokenOperator || t.value != op {
+		return &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("expected '%s' but got '%s'", op, t.text)}
+	}
+	return nil
+}
+
+//expr := or
+func (p *parser) parseExpr() (node, error) {
+	return p.parseOr()
+}
+
+//or := and ('||' and)*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("||") {
+		op := p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := expectType(left, typeBool, op); err != nil {
+			return nil, err
+		}
+		if err := expectType(right, typeBool, op); err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: op.value, left: left, right: right, position: op.pos}
+	}
+	return left, nil
+}
+
+//and := unary ('&&' unary)*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("&&") {
+		op := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := expectType(left, typeBool, op); err != nil {
+			return nil, err
+		}
+		if err := expectType(right, typeBool, op); err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: op.value, left: left, right: right, position: op.pos}
+	}
+	return left, nil
+}
+
+//unary := '!' unary | comparison
+func (p *parser) parseUnary() (node, error) {
+	if p.isOperator("!") {
+		op := p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := expectType(operand, typeBool, op); err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand, position: op.pos}, nil
+	}
+	return p.parseComparison()
+}
+
+//comparison := primary (('=='|'!='|'=~'|'!~'|'in') primary)?
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokenOperator && (t.value == "==" || t.value == "!="):
+		op := p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if left.typ() != right.typ() || left.typ() == typeList {
+			return nil, &SyntaxError{Pos: op.pos, Msg: fmt.Sprintf("cannot compare %s with %s using '%s'", left.typ(), right.typ(), op.value)}
+		}
+		return &compareNode{op: op.value, left: left, right: right, position: op.pos}, nil
+	case t.kind == tokenOperator && (t.value == "=~" || t.value == "!~"):
+		op := p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if err := expectType(left, typeString, op); err != nil {
+			return nil, err
+		}
+		if err := expectType(right, typeString, op); err != nil {
+			return nil, err
+		}
+		n := &matchNode{negate: op.value == "!~", left: left, right: right, position: op.pos}
+		//check literal patterns early
+		if lit, ok := right.(*stringNode); ok {
+			re, err := regexp.Compile(lit.value)
+			if err != nil {
+				return nil, &SyntaxError{Pos: lit.position, Msg: fmt.Sprintf("invalid regular expression: %v", err)}
+			}
+			n.compiled = re
+		}
+		return n, nil
+	case t.kind == tokenIdent && t.value == "in":
+		op := p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if err := expectType(left, typeString, op); err != nil {
+			return nil, err
+		}
+		if err := expectType(right, typeList, op); err != nil {
+			return nil, err
+		}
+		return &inNode{left: left, right: right, position: op.pos}, nil
+	}
+	return left, nil
+}
+
+//primary := STRING | VAR | IDENT | 'true' | 'false' | IDENT '(' args ')' | '(' expr ')' | '[' items ']'
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return &stringNode{value: t.value, position: t.pos}, nil
+	case tokenVar:
+		return &varNode{name: t.value, position: t.pos}, nil
+	case tokenIdent:
+		if t.value == "true" || t.value == "false" {
+			return &boolNode{value: t.value == "true", position: t.pos}, nil
+		}
+		if p.isOperator("(") {
+			return p.parseCall(t)
+		}
+		return &varNode{name: t.value, position: t.pos}, nil
+	case tokenOperator:
+		switch t.value {
+		case "(":
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			items := []node{}
+			for !p.isOperator("]") {
+				if len(items) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				item, err := p.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				if item.typ() != typeString {
+					return nil, &SyntaxError{Pos: item.pos(), Msg: "list items should be strings"}
+				}
+				items = append(items, item)
+			}
+			p.next()
+			return &listNode{items: items, position: t.pos}, nil
+		}
+	}
+	return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected '%s'", t.text)}
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.value]
+	if !ok {
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("unknown function '%s'", name.value)}
+	}
+	p.next()
+	args := []node{}
+	for !p.isOperator(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if arg.typ() != typeString {
+			return nil, &SyntaxError{Pos: arg.pos(), Msg: fmt.Sprintf("arguments of '%s' should be strings", name.value)}
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("wrong number of arguments for '%s'", name.value)}
+	}
+	return &callNode{name: name.value, fn: fn, args: args, position: name.pos}, nil
+}
+
+func expectType(n node, t valueType, op token) error {
+	if n.typ() != t {
+		return &SyntaxError{Pos: n.pos(), Msg: fmt.Sprintf("expected %s operand for '%s' but got %s", t, op.text, n.typ())}
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ type config struct {
 	JenkinsUser     string
 	JenkinsToken    string
 	JenkinsAddress  string
+	ActivityURL     string
 }
 
 var Config config
@@ -22,4 +23,5 @@ func Parse(context *cli.Context) {
 	Config.CattleUrl = context.String("cattle_url")
 	Config.CattleAccessKey = context.String("cattle_access_key")
 	Config.CattleSecretKey = context.String("cattle_secret_key")
+	Config.ActivityURL = context.String("activity_url")
 }
@@ -2,8 +2,11 @@ package git
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -19,8 +22,10 @@ func Clone(path, url, branch string) error {
 	return runcmd("git", "clone", "-b", branch, "--single-branch", url, path)
 }
 
-func BranchHeadCommit(url, branch string) (string, error) {
-	cmd := exec.Command("git", "ls-remote", url, branch)
+//BranchHeadCommit gets the head commit of the branch in the remote repository,
+//env is added to the environment of git, as returned by SSHCommandEnv
+func BranchHeadCommit(url, branch string, env ...string) (string, error) {
+	cmd := command(env, "git", "ls-remote", url, branch)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", errors.Wrap(err, string(output))
@@ -29,6 +34,74 @@ func BranchHeadCommit(url, branch string) (string, error) {
 	return strs[0], nil
 }
 
+//Branches gets the names of branches in the remote repository
+func Branches(url string, env ...string) ([]string, error) {
+	cmd := command(env, "git", "ls-remote", "--heads", url)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrap(err, string(output))
+	}
+	branches := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		strs := strings.Split(line, "\t")
+		if len(strs) == 2 && strings.HasPrefix(strs[1], "refs/heads/") {
+			branches = append(branches, strings.TrimPrefix(strs[1], "refs/heads/"))
+		}
+	}
+	return branches, nil
+}
+
+//FileContent reads the file at the ref of the remote repository without cloning it,
+//the ref is a branch, a tag or a commit sha
+func FileContent(url, ref, path string, env ...string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "git-file")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := runcmd("git", "init", "-q", dir); err != nil {
+		return nil, err
+	}
+	cmd := command(env, "git", "-C", dir, "fetch", "-q", "--depth", "1", url, ref)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, errors.Wrap(err, string(output))
+	}
+	output, err := exec.Command("git", "-C", dir, "show", "FETCH_HEAD:"+path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("file '%s' not found at '%s'", path, ref)
+	}
+	return output, nil
+}
+
+//SSHCommandEnv writes the private key and known hosts to temporary files and gets the environment
+//for git to connect using them, host keys not in known hosts are rejected.
+//cleanup removes the files.
+func SSHCommandEnv(privateKey, knownHosts string) (env []string, cleanup func(), err error) {
+	dir, err := ioutil.TempDir("", "git-ssh")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() {
+		os.RemoveAll(dir)
+	}
+	keyFile := filepath.Join(dir, "id")
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	if !strings.HasSuffix(privateKey, "\n") {
+		//ssh rejects keys without the trailing newline
+		privateKey += "\n"
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(privateKey), 0600); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(knownHostsFile, []byte(knownHosts), 0600); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	sshCommand := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", keyFile, knownHostsFile)
+	return []string{"GIT_SSH_COMMAND=" + sshCommand}, cleanup, nil
+}
+
 func Init(path string, url string) error {
 	return runcmd("git", "init", path)
 }
@@ -83,6 +156,19 @@ func GetAuthRepoUrl(url, user, token string) (string, error) {
 	return url, nil
 }
 
+//GetUserPasswordRepoUrl adds the username and password to the http or https url of the repository
+func GetUserPasswordRepoUrl(repoUrl, user, password string) (string, error) {
+	u, err := url.Parse(repoUrl)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("repository '%s' is not a http or https url", repoUrl)
+	}
+	u.User = url.UserPassword(user, password)
+	return u.String(), nil
+}
+
 func getUserName(gitUser string) (string, error) {
 	splits := strings.Split(gitUser, ":")
 	if len(splits) != 2 {
@@ -94,11 +180,23 @@ func getUserName(gitUser string) (string, error) {
 		return "oauth2", nil
 	} else if scmType == "github" {
 		return userName, nil
+	} else if scmType == "bitbucketcloud" {
+		return "x-token-auth", nil
+	} else if scmType == "bitbucketserver" || scmType == "gitea" {
+		return userName, nil
 	} else {
 		return "", fmt.Errorf("unsupported scmType '%s'", scmType)
 	}
 }
 
+//command creates a git command failing instead of prompting for credentials, env is added to its environment
+func command(env []string, name string, arg ...string) *exec.Cmd {
+	cmd := exec.Command(name, arg...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, env...)
+	return cmd
+}
+
 func runcmd(name string, arg ...string) error {
 	cmd := exec.Command(name, arg...)
 	if log.GetLevel() >= log.DebugLevel {
@@ -0,0 +1,159 @@
+//Package jsonpath implements a subset of JSONPath to get values from json documents.
+//
+//A path starts with `$` for the document, followed by child names like `.name` or `['name']`
+//and array indexes like `[0]`, negative indexes count from the end, e.g.
+//
+//	$.push_data.tag
+//	$['repository']['repo_name']
+//	$.events[-1].target.digest
+package jsonpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Path is a parsed JSONPath expression
+type Path struct {
+	source string
+	steps  []step
+}
+
+//step is a child name or an array index
+type step struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+//SyntaxError is an error in a path at the position, starting from 1
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+//Parse parses a path
+func Parse(path string) (*Path, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, &SyntaxError{Pos: 1, Msg: "path should start with '$'"}
+	}
+	p := &Path{source: path}
+	i := 1
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			start := i + 1
+			end := start
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			if end == start {
+				return nil, &SyntaxError{Pos: start + 1, Msg: "child name expected"}
+			}
+			p.steps = append(p.steps, step{name: path[start:end]})
+			i = end
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, &SyntaxError{Pos: i + 1, Msg: "unclosed '['"}
+			}
+			s, err := parseBracket(path[i+1:i+end], i+2)
+			if err != nil {
+				return nil, err
+			}
+			p.steps = append(p.steps, s)
+			i += end + 1
+		default:
+			return nil, &SyntaxError{Pos: i + 1, Msg: fmt.Sprintf("unexpected '%c'", path[i])}
+		}
+	}
+	return p, nil
+}
+
+//parseBracket parses the quoted child name or the index in brackets at the position
+func parseBracket(content string, pos int) (step, error) {
+	if len(content) >= 2 && (content[0] == '\'' || content[0] == '"') {
+		if content[len(content)-1] != content[0] {
+			return step{}, &SyntaxError{Pos: pos, Msg: "unclosed quote"}
+		}
+		return step{name: content[1 : len(content)-1]}, nil
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(content))
+	if err != nil {
+		return step{}, &SyntaxError{Pos: pos, Msg: fmt.Sprintf("invalid index '%s'", content)}
+	}
+	return step{index: index, isIndex: true}, nil
+}
+
+//Get gets the value at the path in a document decoded from json, false if it does not exist
+func (p *Path) Get(doc interface{}) (interface{}, bool) {
+	v := doc
+	for _, s := range p.steps {
+		if s.isIndex {
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			index := s.index
+			if index < 0 {
+				index += len(list)
+			}
+			if index < 0 || index >= len(list) {
+				return nil, false
+			}
+			v = list[index]
+			continue
+		}
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = object[s.name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (p *Path) String() string {
+	return p.source
+}
+
+//Decode decodes a json document for paths, numbers are kept as they are
+func Decode(data []byte) (interface{}, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+//Text formats a value as text, strings are not quoted, null is empty and objects and arrays are in json
+func Text(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,106 @@
+package jsonpath
+
+import "testing"
+
+const testDocument = `{
+	"push_data": {"tag": "v1.0", "pushed_at": 1510000000, "pusher": null},
+	"repository": {"repo_name": "alice/app", "is_private": false, "名前": "アプリ"},
+	"events": [
+		{"target": {"digest": "sha256:aaa"}},
+		{"target": {"digest": "sha256:bbb", "size": 1.5}}
+	],
+	"labels": {"a.b": ["x", "y"]}
+}`
+
+func TestGet(t *testing.T) {
+	doc, err := Decode([]byte(testDocument))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	tests := []struct {
+		path  string
+		text  string
+		found bool
+	}{
+		{"$.push_data.tag", "v1.0", true},
+		{"$['repository']['repo_name']", "alice/app", true},
+		{`$["repository"].is_private`, "false", true},
+		{"$.push_data.pushed_at", "1510000000", true},
+		{"$.push_data.pusher", "", true},
+		{"$.events[0].target.digest", "sha256:aaa", true},
+		{"$.events[-1].target.digest", "sha256:bbb", true},
+		{"$.events[1].target.size", "1.5", true},
+		{"$.events[ 1 ].target", `{"digest":"sha256:bbb","size":1.5}`, true},
+		{"$['labels']['a.b']", `["x","y"]`, true},
+		{"$.repository.名前", "アプリ", true},
+		{"$.events[2]", "", false},
+		{"$.events[-3]", "", false},
+		{"$.push_data.missing", "", false},
+		{"$.push_data.tag.length", "", false},
+		{"$.repository[0]", "", false},
+	}
+	for _, test := range tests {
+		path, err := Parse(test.path)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.path, err)
+			continue
+		}
+		v, found := path.Get(doc)
+		if found != test.found {
+			t.Errorf("Get(%q) found = %v, expected %v", test.path, found, test.found)
+			continue
+		}
+		if text := Text(v); found && text != test.text {
+			t.Errorf("Get(%q) = %q, expected %q", test.path, text, test.text)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		path string
+		pos  int
+	}{
+		{"push_data.tag", 1},
+		{"$.", 3},
+		{"$..tag", 3},
+		{"$.events[0", 9},
+		{"$.events[x]", 10},
+		{"$['tag]", 3},
+		{"$tag", 2},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.path)
+		if err == nil {
+			t.Errorf("Parse(%q) should fail", test.path)
+			continue
+		}
+		syntaxErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("Parse(%q) got %T error: %v", test.path, err, err)
+			continue
+		}
+		if syntaxErr.Pos != test.pos {
+			t.Errorf("Parse(%q) error at position %d, expected %d: %v", test.path, syntaxErr.Pos, test.pos, err)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		text  string
+	}{
+		{nil, ""},
+		{"a b", "a b"},
+		{true, "true"},
+		{float64(2.50), "2.5"},
+		{map[string]interface{}{"k": "v"}, `{"k":"v"}`},
+		{[]interface{}{"a", float64(1)}, `["a",1]`},
+	}
+	for _, test := range tests {
+		if text := Text(test.value); text != test.text {
+			t.Errorf("Text(%v) = %q, expected %q", test.value, text, test.text)
+		}
+	}
+}
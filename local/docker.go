@@ -0,0 +1,120 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/provider/jenkins"
+	"github.com/rancher/pipeline/stepscript"
+)
+
+//runTask runs a task step in a container sharing the work dir, service steps keep running until the run finishes
+func (r *runner) runTask(step *model.Step, stageOrdinal int, stepOrdinal int) error {
+	if err := r.writeEnvFile(); err != nil {
+		return err
+	}
+	containerName := fmt.Sprintf("%s_%d_%d", r.activity.Id, stageOrdinal, stepOrdinal)
+	if step.IsService {
+		containerName = r.activity.Id + step.Alias
+	}
+	script := stepscript.TaskScript(step, &stepscript.TaskOptions{
+		ActivityId:    r.activity.Id,
+		ContainerName: containerName,
+		Workspace:     fmt.Sprintf("-v %s:%s -w %s", r.opts.WorkDir, r.opts.WorkDir, r.opts.WorkDir),
+		Services:      r.services,
+	})
+	script = stepscript.OutputScript(stageOrdinal, stepOrdinal, script)
+	if err := r.runWithTimeout(r.script(script), step.Timeout, containerName); err != nil {
+		if step.IsService {
+			//the container is started, it is removed on cleanup
+			r.services = append(r.services, &model.CIService{ContainerName: containerName})
+		}
+		return err
+	}
+	if step.IsService {
+		r.services = append(r.services, &model.CIService{
+			ContainerName: containerName,
+			Name:          step.Alias,
+			Image:         step.Image,
+		})
+		return nil
+	}
+	return r.readOutputs(stepscript.OutputFile(stageOrdinal, stepOrdinal))
+}
+
+//runBuild builds the image of a build step and sets image variables for later steps
+func (r *runner) runBuild(step *model.Step, stageOrdinal int, stepOrdinal int) error {
+	if err := r.writeEnvFile(); err != nil {
+		return err
+	}
+	pushCommand := ""
+	if step.PushFlag {
+		if r.opts.Push {
+			pushCommand = "docker push"
+		} else {
+			logrus.Infof("skip pushing %s, use --push to push images", strings.Join(stepscript.ImageTags(step), ", "))
+		}
+	}
+	script := stepscript.BuildScript(step, pushCommand)
+	script += stepscript.CaptureImageScript(step, stageOrdinal, stepOrdinal, pushCommand != "")
+	script = stepscript.OutputScript(stageOrdinal, stepOrdinal, script)
+	if err := r.runWithTimeout(r.script(script), step.Timeout, ""); err != nil {
+		return err
+	}
+	if err := r.readOutputs(stepscript.ImageInfoFile(stageOrdinal, stepOrdinal)); err != nil {
+		return err
+	}
+	return r.readOutputs(stepscript.OutputFile(stageOrdinal, stepOrdinal))
+}
+
+//runDeploy runs the script of a deploy step generated by the jenkins provider,
+//the rancher server is given by CATTLE_URL, CATTLE_ACCESS_KEY and CATTLE_SECRET_KEY
+func (r *runner) runDeploy(step *model.Step) error {
+	if step.Endpoint != "" {
+		return fmt.Errorf("deploy step with endpoint '%s' needs credentials of the pipeline server, it can not run locally", step.Endpoint)
+	}
+	if err := r.writeEnvFile(); err != nil {
+		return err
+	}
+	script := jenkins.DeployScript(r.activity, step)
+	return r.runWithTimeout(r.script(script), step.Timeout, "")
+}
+
+//script runs a shell script in the work dir like jenkins jobs do in workspaces
+func (r *runner) script(script string) *exec.Cmd {
+	cmd := r.command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "PWD="+r.opts.WorkDir)
+	return cmd
+}
+
+func (r *runner) command(name string, args ...string) *exec.Cmd {
+	logrus.Debugf("%s %s", name, strings.Join(args, " "))
+	cmd := exec.Command(name, args...)
+	cmd.Dir = r.opts.WorkDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+//runWithTimeout runs the command, the process and the container are killed if it does not finish in the timeout minutes
+func (r *runner) runWithTimeout(cmd *exec.Cmd, timeout int, containerName string) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if timeout > 0 {
+		timer := time.AfterFunc(time.Duration(timeout)*time.Minute, func() {
+			logrus.Errorf("timeout after %d minutes", timeout)
+			if containerName != "" {
+				exec.Command("docker", "rm", "-f", containerName).Run()
+			}
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+	}
+	return cmd.Wait()
+}
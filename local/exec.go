@@ -0,0 +1,307 @@
+//Package local runs pipeline files on the local docker daemon.
+//
+//Task and build steps run in the current directory, which is shared with the containers.
+//Source code management steps are skipped, the working copy is used as is.
+package local
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/condition"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/pipelinefile"
+	"github.com/rancher/pipeline/server/service"
+	"github.com/rancher/pipeline/stepscript"
+	"github.com/rancher/pipeline/util"
+)
+
+//Options of a local run
+type Options struct {
+	//path of the pipeline file
+	File string
+	//directory to run in, the current directory if empty
+	WorkDir string
+	//override parameters of the pipeline, in `key=val` format
+	Parameters []string
+	//run deploy steps, they are skipped by default
+	Deploy bool
+	//push images of build steps, they are only built by default
+	Push bool
+}
+
+type runner struct {
+	opts     *Options
+	activity *model.Activity
+	//started service containers
+	services []*model.CIService
+}
+
+//Exec runs the pipeline file locally, it stops at the first failed step
+func Exec(opts *Options) error {
+	if opts.WorkDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		opts.WorkDir = wd
+	}
+	data, err := ioutil.ReadFile(opts.File)
+	if err != nil {
+		return err
+	}
+	p := &model.Pipeline{}
+	if err := pipelinefile.Decode(data, &p.PipelineContent); err != nil {
+		return err
+	}
+	if p.Name == "" {
+		p.Name = filepath.Base(opts.WorkDir)
+	}
+	overrides := map[string]string{}
+	for _, param := range opts.Parameters {
+		splits := strings.SplitN(param, "=", 2)
+		if len(splits) != 2 {
+			return fmt.Errorf("parameter '%s' is not in 'key=val' format", param)
+		}
+		overrides[splits[0]] = splits[1]
+	}
+	if p, err = service.ApplyRunInput(p, &model.RunInput{Parameters: overrides}); err != nil {
+		return err
+	}
+	for _, stage := range p.Stages {
+		for _, step := range stage.Steps {
+			if step.Type == model.StepTypeTemplate {
+				return fmt.Errorf("template step '%s' needs step templates of the pipeline server, it can not run locally", step.Name)
+			}
+		}
+	}
+	r := &runner{
+		opts: opts,
+		activity: &model.Activity{
+			Id:          "local-" + strings.ToLower(util.RandStringRunes(8)),
+			Pipeline:    *p,
+			RunSequence: 1,
+			TriggerType: model.TriggerTypeManual,
+			NodeName:    "local",
+			Overrides:   overrides,
+		},
+	}
+	r.initEnvVars()
+	defer r.cleanup()
+	return r.run()
+}
+
+func (r *runner) run() error {
+	p := r.activity.Pipeline
+	for stageOrdinal, stage := range p.Stages {
+		run, err := r.evaluate(stage.Conditions)
+		if err != nil {
+			return errors.Wrapf(err, "evaluate conditions of stage '%s'", stage.Name)
+		}
+		if !run {
+			logrus.Infof("skip stage '%s', conditions are not met", stage.Name)
+			continue
+		}
+		if stage.NeedApprove {
+			logrus.Infof("stage '%s' needs approval, it is approved in local runs", stage.Name)
+		}
+		for stepOrdinal, step := range stage.Steps {
+			name := stepName(step, stageOrdinal, stepOrdinal)
+			run, err := r.evaluate(step.Conditions)
+			if err != nil {
+				return errors.Wrapf(err, "evaluate conditions of step '%s'", name)
+			}
+			if !run {
+				logrus.Infof("skip step '%s', conditions are not met", name)
+				continue
+			}
+			if err := r.runStep(stageOrdinal, stepOrdinal); err != nil {
+				return errors.Wrapf(err, "step '%s' of stage '%s' failed", name, stage.Name)
+			}
+		}
+	}
+	logrus.Infof("pipeline '%s' succeeded", p.Name)
+	return nil
+}
+
+func (r *runner) runStep(stageOrdinal int, stepOrdinal int) error {
+	step := r.activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal]
+	name := stepName(step, stageOrdinal, stepOrdinal)
+	switch step.Type {
+	case model.StepTypeSCM:
+		logrus.Infof("skip source code management step '%s', using the working copy in %s", name, r.opts.WorkDir)
+		return nil
+	case model.StepTypeTask:
+		logrus.Infof("run task step '%s'", name)
+		return r.runTask(step, stageOrdinal, stepOrdinal)
+	case model.StepTypeBuild:
+		logrus.Infof("run build step '%s'", name)
+		return r.runBuild(step, stageOrdinal, stepOrdinal)
+	case model.StepTypeUpgradeService, model.StepTypeUpgradeStack, model.StepTypeUpgradeCatalog:
+		if !r.opts.Deploy {
+			logrus.Infof("skip deploy step '%s', use --deploy to run it", name)
+			return nil
+		}
+		logrus.Infof("run deploy step '%s'", name)
+		return r.runDeploy(step)
+	}
+	return fmt.Errorf("unsupported step type '%s'", step.Type)
+}
+
+//initEnvVars sets pre-defined env vars from the working copy and user defined ones
+func (r *runner) initEnvVars() {
+	a := r.activity
+	p := a.Pipeline
+	vars := map[string]string{}
+	vars["CICD_PIPELINE_NAME"] = p.Name
+	vars["CICD_PIPELINE_ID"] = p.Id
+	vars["CICD_NODE_NAME"] = a.NodeName
+	vars["CICD_ACTIVITY_ID"] = a.Id
+	vars["CICD_ACTIVITY_SEQUENCE"] = strconv.Itoa(a.RunSequence)
+	vars["CICD_TRIGGER_TYPE"] = a.TriggerType
+	vars["CICD_GIT_URL"] = r.git("config", "--get", "remote.origin.url")
+	vars["CICD_GIT_BRANCH"] = r.git("rev-parse", "--abbrev-ref", "HEAD")
+	vars["CICD_GIT_COMMIT"] = r.git("rev-parse", "HEAD")
+	vars["CICD_GIT_TAG"] = r.git("describe", "--exact-match", "--tags", "HEAD")
+	if vars["CICD_GIT_BRANCH"] == "HEAD" {
+		//detached working copy
+		vars["CICD_GIT_BRANCH"] = ""
+	}
+	for stageOrdinal, stage := range p.Stages {
+		for stepOrdinal, step := range stage.Steps {
+			if step.Type != model.StepTypeBuild {
+				continue
+			}
+			prefix := model.BuildImageVarPrefix(step, stageOrdinal, stepOrdinal)
+			vars[prefix+"_IMAGE_ID"] = ""
+		}
+	}
+	for _, envvar := range p.Parameters {
+		splits := strings.SplitN(envvar, "=", 2)
+		if len(splits) != 2 {
+			continue
+		}
+		vars[splits[0]] = splits[1]
+	}
+	a.EnvVars = vars
+	a.ChangedFiles = r.changedFiles()
+}
+
+//changedFiles gets files changed by the last commit and uncommitted changes
+func (r *runner) changedFiles() []string {
+	files := []string{}
+	seen := map[string]bool{}
+	out := r.git("diff-tree", "--root", "--no-commit-id", "--name-only", "-r", "HEAD") + "\n" + r.git("diff", "--name-only", "HEAD")
+	for _, file := range strings.Split(out, "\n") {
+		if file == "" || seen[file] {
+			continue
+		}
+		seen[file] = true
+		files = append(files, file)
+	}
+	return files
+}
+
+//git gets the output of a git command in the work dir, empty if it fails
+func (r *runner) git(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.opts.WorkDir
+	out, err := cmd.Output()
+	if err != nil {
+		logrus.Debugf("git %s got error: %v", strings.Join(args, " "), err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+//evaluate checks conditions like jenkins provider does, any conditions are ignored when all conditions exist
+func (r *runner) evaluate(conditions *model.PipelineConditions) (bool, error) {
+	if conditions == nil || (len(conditions.All) == 0 && len(conditions.Any) == 0) {
+		return true, nil
+	}
+	ctx := &condition.Context{
+		Env:          r.activity.EnvVars,
+		ChangedFiles: r.activity.ChangedFiles,
+	}
+	if len(conditions.All) > 0 {
+		for _, expr := range conditions.All {
+			res, err := condition.Evaluate(expr, ctx)
+			if err != nil || !res {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	for _, expr := range conditions.Any {
+		res, err := condition.Evaluate(expr, ctx)
+		if err != nil {
+			return false, err
+		}
+		if res {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//expand substitutes env vars in text like the shell of jenkins jobs does
+func (r *runner) expand(text string) string {
+	return os.Expand(text, func(key string) string {
+		return r.activity.EnvVars[key]
+	})
+}
+
+//readOutputs adds `KEY=VALUE` lines of a step output file in the work dir to env vars, keys starting with `CICD_` are reserved
+func (r *runner) readOutputs(name string) error {
+	data, err := ioutil.ReadFile(filepath.Join(r.opts.WorkDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for k, v := range stepscript.ParseOutputs(string(data)) {
+		if !strings.HasPrefix(k, "CICD_") {
+			r.activity.EnvVars[k] = v
+		}
+	}
+	return nil
+}
+
+//writeEnvFile writes env vars to the env file sourced by step scripts, like the SCM step does in jenkins workspaces
+func (r *runner) writeEnvFile() error {
+	keys := []string{}
+	for k := range r.activity.EnvVars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	content := stepscript.EnvFileContent(keys, r.activity.EnvVars)
+	return ioutil.WriteFile(filepath.Join(r.opts.WorkDir, stepscript.EnvFile), []byte(content), 0644)
+}
+
+func (r *runner) cleanup() {
+	for _, svc := range r.services {
+		if err := exec.Command("docker", "rm", "-f", svc.ContainerName).Run(); err != nil {
+			logrus.Errorf("remove service container '%s' got error: %v", svc.ContainerName, err)
+		}
+	}
+	//files generated by step scripts in the work dir
+	files, _ := filepath.Glob(filepath.Join(r.opts.WorkDir, ".r_cicd*"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func stepName(step *model.Step, stageOrdinal int, stepOrdinal int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return fmt.Sprintf("%d_%d", stageOrdinal+1, stepOrdinal+1)
+}
@@ -5,7 +5,9 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/rancher/pipeline/apiclient"
 	"github.com/rancher/pipeline/config"
+	"github.com/rancher/pipeline/local"
 	"github.com/rancher/pipeline/provider/jenkins"
 	"github.com/rancher/pipeline/server"
 	"github.com/urfave/cli"
@@ -54,15 +56,65 @@ func main() {
 			EnvVar: "CATTLE_SECRET_KEY",
 			Value:  "",
 		},
+		cli.StringFlag{
+			Name:   "activity_url",
+			Usage:  "url format of activity pages linked from commit statuses, %s is replaced by the activity id",
+			EnvVar: "PIPELINE_ACTIVITY_URL",
+			Value:  "",
+		},
 		cli.BoolFlag{
 			Name:   "debug",
 			Usage:  "enable debug mode",
 			EnvVar: "DEBUG",
 		},
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:      "exec",
+			Usage:     "Run task and build steps of a pipeline file on the local docker daemon",
+			ArgsUsage: " ",
+			Action:    execLocal,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "pipeline file to run",
+					Value: ".rancher-pipeline.yml",
+				},
+				cli.StringSliceFlag{
+					Name:  "param, p",
+					Usage: "set a parameter in 'key=val' format, overrides parameters of the pipeline file",
+				},
+				cli.BoolFlag{
+					Name:  "deploy",
+					Usage: "run deploy steps with rancher server of CATTLE_URL, CATTLE_ACCESS_KEY and CATTLE_SECRET_KEY",
+				},
+				cli.BoolFlag{
+					Name:  "push",
+					Usage: "push images of build steps",
+				},
+			},
+		},
+	}
+	app.Commands = append(app.Commands, apiclient.Commands()...)
 	app.Run(os.Args)
 }
 
+func execLocal(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	err := local.Exec(&local.Options{
+		File:       c.String("file"),
+		Parameters: c.StringSlice("param"),
+		Deploy:     c.Bool("deploy"),
+		Push:       c.Bool("push"),
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
 func checkAndRun(c *cli.Context) (rtnerr error) {
 	if c.GlobalBool("debug") {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -1,10 +1,14 @@
 package model
 
 import (
+	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/client"
+	"github.com/rancher/pipeline/condition"
 )
 
 const StepTypeTask = "task"
@@ -15,9 +19,23 @@ const StepTypeService = "service"
 const StepTypeUpgradeService = "upgradeService"
 const StepTypeUpgradeStack = "upgradeStack"
 const StepTypeUpgradeCatalog = "upgradeCatalog"
+const StepTypeTemplate = "template"
 const TriggerTypeCron = "cron"
 const TriggerTypeManual = "manual"
 const TriggerTypeWebhook = "webhook"
+const TriggerTypePipeline = "pipeline"
+const WebhookEventPush = "push"
+const WebhookEventTag = "tag"
+const WebhookEventRelease = "release"
+const WebhookEventPullRequest = "pull_request"
+const WebhookEventGeneric = "generic"
+const CommitStatePending = "pending"
+const CommitStateSuccess = "success"
+const CommitStateFailure = "failure"
+const CommitStateCanceled = "canceled"
+const ParameterTypeString = "string"
+const ParameterTypeChoice = "choice"
+const ParameterTypeBoolean = "boolean"
 
 const (
 	ActivityStepWaiting  = "Waiting"
@@ -26,6 +44,7 @@ const (
 	ActivityStepFail     = "Fail"
 	ActivityStepSkip     = "Skipped"
 	ActivityStepAbort    = "Abort"
+	ActivityStepUnstable = "Unstable"
 
 	ActivityStageWaiting  = "Waiting"
 	ActivityStagePending  = "Pending"
@@ -47,10 +66,14 @@ const (
 
 var ErrPipelineNotFound = errors.New("Pipeline Not found")
 
+var regNonWord = regexp.MustCompile(`[^A-Z0-9]+`)
+
 var PreservedEnvs = [...]string{"CICD_GIT_COMMIT", "CICD_GIT_BRANCH",
-	"CICD_GIT_URL", "CICD_PIPELINE_NAME", "CICD_PIPELINE_ID",
+	"CICD_GIT_TAG", "CICD_GIT_URL", "CICD_EVENT_TYPE", "CICD_PR_NUMBER",
+	"CICD_PR_SOURCE_BRANCH", "CICD_PR_TARGET_BRANCH", "CICD_PR_AUTHOR", "CICD_PIPELINE_NAME", "CICD_PIPELINE_ID",
 	"CICD_TRIGGER_TYPE", "CICD_NODE_NAME", "CICD_ACTIVITY_ID",
-	"CICD_ACTIVITY_SEQUENCE",
+	"CICD_ACTIVITY_SEQUENCE", "CICD_UPSTREAM_PIPELINE_NAME", "CICD_UPSTREAM_ACTIVITY_ID",
+	"CICD_UPSTREAM_STATUS", "CICD_UPSTREAM_COMMIT", "CICD_UPSTREAM_BRANCH",
 }
 
 type PipelineSetting struct {
@@ -77,6 +100,8 @@ type Pipeline struct {
 }
 
 type PipelineContent struct {
+	//version of the pipeline file format
+	Version         string `json:"-" yaml:"version,omitempty"`
 	Name            string `json:"name,omitempty" yaml:"name,omitempty"`
 	IsActivate      bool   `json:"isActivate" yaml:"isActivate"`
 	VersionSequence string `json:"-" yaml:"-"`
@@ -90,25 +115,201 @@ type PipelineContent struct {
 	Repository      string `json:"repository,omitempty" yaml:"repository,omitempty"`
 	Branch          string `json:"branch,omitempty" yaml:"branch,omitempty"`
 	TargetImage     string `json:"targetImage,omitempty" yaml:"target-image,omitempty"`
-	File            string `json:"file,omitempty" yaml:"file,omitempty"`
 	WebHookId       int    `json:"webhookId,omitempty" yaml:"webhookId,omitempty"`
 	WebHookToken    string `json:"webhookToken,omitempty" yaml:"webhookToken,omitempty"`
+	//id of the webhook if it is not a number, as in bitbucket cloud
+	WebHookUUID string `json:"webhookUUID,omitempty" yaml:"webhookUUID,omitempty"`
+	//token of the generic webhook, it is separate from the token of the webhook of the SCM
+	GenericWebhookToken string `json:"genericWebhookToken,omitempty" yaml:"genericWebhookToken,omitempty"`
+	//path of the pipeline file in the repository, stages are loaded from it at run time when set
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	//line coverage percentage of last run
+	LastCoverage *float64 `json:"lastCoverage,omitempty" yaml:"lastCoverage,omitempty"`
 	//user defined environment variables
 	Parameters []string `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	//typed parameters which can be overridden in manual runs
+	ParameterDefinitions []*ParameterDefinition `json:"parameterDefinitions,omitempty" yaml:"parameterDefinitions,omitempty"`
 	//for import
 	Templates map[string]string `json:"templates,omitempty" yaml:"templates,omitempty"`
 	//trigger
-	CronTrigger   CronTrigger `json:"cronTrigger,omitempty" yaml:"cronTrigger,omitempty"`
-	Stages        []*Stage    `json:"stages,omitempty" yaml:"stages,omitempty"`
-	KeepWorkspace bool        `json:"keepWorkspace,omitempty" yaml:"keepWorkspace,omitempty"`
+	CronTrigger CronTrigger `json:"cronTrigger,omitempty" yaml:"cronTrigger,omitempty"`
+	//cron schedules in addition to the cron trigger, each runs with its own parameters
+	CronSchedules []*CronSchedule `json:"cronSchedules,omitempty" yaml:"cronSchedules,omitempty"`
+	//status of branches other than the branch of the SCM step in multi-branch mode
+	BranchStates []*BranchState `json:"branchStates,omitempty" yaml:"-"`
+	//trigger when upstream pipelines complete
+	PipelineTriggers []*PipelineTrigger `json:"pipelineTriggers,omitempty" yaml:"pipelineTriggers,omitempty"`
+	//trigger by requests of other tools to the generic webhook url
+	GenericWebhook *GenericWebhook `json:"genericWebhook,omitempty" yaml:"genericWebhook,omitempty"`
+	Stages         []*Stage        `json:"stages,omitempty" yaml:"stages,omitempty"`
+	KeepWorkspace  bool            `json:"keepWorkspace,omitempty" yaml:"keepWorkspace,omitempty"`
+}
+
+//ParameterDefinition declares a typed parameter, it is available as an environment variable
+type ParameterDefinition struct {
+	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	//string, choice or boolean, string if empty
+	Type    string   `json:"type,omitempty" yaml:"type,omitempty"`
+	Default string   `json:"default,omitempty" yaml:"default,omitempty"`
+	Choices []string `json:"choices,omitempty" yaml:"choices,omitempty"`
 }
 
+//BranchState is the last run of a branch of a multi-branch pipeline
+type BranchState struct {
+	Branch        string `json:"branch,omitempty"`
+	LastRunId     string `json:"lastRunId,omitempty"`
+	LastRunStatus string `json:"lastRunStatus,omitempty"`
+	LastRunTime   int64  `json:"lastRunTime,omitempty"`
+	NextRunTime   int64  `json:"nextRunTime,omitempty"`
+	CommitInfo    string `json:"commitInfo,omitempty"`
+}
+
+//IsMultiBranch checks whether the pipeline builds multiple branches
+func (p *PipelineContent) IsMultiBranch() bool {
+	return len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 && p.Stages[0].Steps[0].MultiBranch
+}
+
+//GetBranchState gets the state of the branch, nil if it is not tracked
+func (p *PipelineContent) GetBranchState(branch string) *BranchState {
+	for _, state := range p.BranchStates {
+		if state.Branch == branch {
+			return state
+		}
+	}
+	return nil
+}
+
+//PipelineTrigger runs the pipeline when a run of the upstream pipeline completes
+type PipelineTrigger struct {
+	//name of the upstream pipeline
+	Pipeline string `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	//success, failure or any, success if empty
+	Status string `json:"status,omitempty" yaml:"status,omitempty"`
+	//glob patterns of branches of upstream runs, any branch if empty
+	Branches []string `json:"branches,omitempty" yaml:"branches,omitempty"`
+	//parameters set from variables and step outputs of the upstream run, e.g. VERSION: ${APP_VERSION}
+	Parameters map[string]string `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+}
+
+const PipelineTriggerSuccess = "success"
+const PipelineTriggerFailure = "failure"
+const PipelineTriggerAny = "any"
+
+//GenericWebhook runs the pipeline on authenticated requests to the generic webhook url of the pipeline
+type GenericWebhook struct {
+	Enabled bool `json:"enabled" yaml:"enabled,omitempty"`
+	//token or hmac, token if empty. The webhook token of the pipeline is sent in the X-Pipeline-Token header,
+	//or used to sign the request body in the X-Pipeline-Signature header as sha256=<hex digest> for hmac
+	Auth string `json:"auth,omitempty" yaml:"auth,omitempty"`
+	//parameters set from the json request body by JSONPath expressions, e.g. VERSION: $.artifact.version
+	Parameters map[string]string `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	//conditions on parameters, the pipeline runs only when all of them are true
+	Filters []string `json:"filters,omitempty" yaml:"filters,omitempty"`
+}
+
+const GenericWebhookAuthToken = "token"
+const GenericWebhookAuthHMAC = "hmac"
+
 type CronTrigger struct {
 	TriggerOnUpdate bool   `json:"triggerOnUpdate" yaml:"triggerOnUpdate,omitempty"`
 	Spec            string `json:"spec,omitempty" yaml:"spec,omitempty"`
 	Timezone        string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
 }
 
+//CronSchedule runs the pipeline periodically with its own parameter overrides and branch
+type CronSchedule struct {
+	//unique name of the schedule in the pipeline
+	Name            string `json:"name,omitempty" yaml:"name,omitempty"`
+	Spec            string `json:"spec,omitempty" yaml:"spec,omitempty"`
+	Timezone        string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	TriggerOnUpdate bool   `json:"triggerOnUpdate" yaml:"triggerOnUpdate,omitempty"`
+	//enabled if not set
+	Enabled *bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	//override values of parameters
+	Parameters map[string]string `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	//branch to build instead of the branch of the source code management step
+	Branch string `json:"branch,omitempty" yaml:"branch,omitempty"`
+}
+
+//DefaultScheduleName is the name of the schedule of the cron trigger
+const DefaultScheduleName = "default"
+
+//PollScheduleName is the name of the schedule checking for changes of plain git sources
+const PollScheduleName = "poll"
+
+//DefaultPollInterval is the default minutes between checks for changes of plain git sources
+const DefaultPollInterval = 5
+
+func (s *CronSchedule) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+//RunInput gets the input of runs triggered by the schedule
+func (s *CronSchedule) RunInput() *RunInput {
+	return &RunInput{
+		Parameters: s.Parameters,
+		Branch:     s.Branch,
+	}
+}
+
+//Schedules gets the cron trigger as the default schedule and the cron schedules of the pipeline.
+//Plain git sources have no webhook, changes of them are checked by the poll schedule when webhook is enabled.
+func (p *PipelineContent) Schedules() []*CronSchedule {
+	schedules := []*CronSchedule{}
+	if p.CronTrigger.Spec != "" {
+		schedules = append(schedules, &CronSchedule{
+			Name:            DefaultScheduleName,
+			Spec:            p.CronTrigger.Spec,
+			Timezone:        p.CronTrigger.Timezone,
+			TriggerOnUpdate: p.CronTrigger.TriggerOnUpdate,
+		})
+	}
+	schedules = append(schedules, p.CronSchedules...)
+	if len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 {
+		scmStep := p.Stages[0].Steps[0]
+		if scmStep.Webhook && IsGitAccount(scmStep.GitUser) {
+			schedules = append(schedules, &CronSchedule{
+				Name:            PollScheduleName,
+				Spec:            pollSpec(scmStep.PollInterval),
+				TriggerOnUpdate: true,
+			})
+		}
+	}
+	return schedules
+}
+
+//pollSpec gets the cron spec running every interval minutes, hourly for an hour or more
+func pollSpec(interval int) string {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	if interval >= 60 {
+		return "0 * * * *"
+	}
+	return fmt.Sprintf("*/%d * * * *", interval)
+}
+
+//IsGitAccount checks whether the id is of a plain git account
+func IsGitAccount(accountId string) bool {
+	return strings.HasPrefix(accountId, GitAccountType+":")
+}
+
+//MatchBranch checks whether pushes of the branch are built by the SCM step,
+//branches other than Branch are built in multi-branch mode when they match the patterns
+func (s *Step) MatchBranch(branch string) bool {
+	if branch == s.Branch {
+		return true
+	}
+	if !s.MultiBranch || branch == "" {
+		return false
+	}
+	if len(s.Branches) > 0 && !condition.MatchAny(s.Branches, []string{branch}) {
+		return false
+	}
+	return !condition.MatchAny(s.BranchesIgnore, []string{branch})
+}
+
 type Stage struct {
 	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
 	NeedApprove bool   `json:"needApprove" yaml:"needApprove,omitempty"`
@@ -131,22 +332,66 @@ type Step struct {
 	Branch     string `json:"branch,omitempty" yaml:"branch,omitempty"`
 	GitUser    string `json:"gitUser,omitempty" yaml:"gitUser,omitempty"`
 	Webhook    bool   `json:"webhook" yaml:"webhook,omitempty"`
+	//webhook triggers only when changed files match Paths and not all of them match PathsIgnore
+	Paths       []string `json:"paths,omitempty" yaml:"paths,omitempty"`
+	PathsIgnore []string `json:"pathsIgnore,omitempty" yaml:"pathsIgnore,omitempty"`
+	//webhook triggers on pushed tags matching any of the patterns
+	TagPatterns []string `json:"tagPatterns,omitempty" yaml:"tagPatterns,omitempty"`
+	//webhook triggers on published releases
+	ReleaseEvents bool `json:"releaseEvents,omitempty" yaml:"releaseEvents,omitempty"`
+	//webhook triggers on pull requests and merge requests targeting the branch
+	PullRequests bool `json:"pullRequests,omitempty" yaml:"pullRequests,omitempty"`
+	//authors whose pull requests from forks are built, pull requests from forks are skipped if empty
+	PullRequestAuthors []string `json:"pullRequestAuthors,omitempty" yaml:"pullRequestAuthors,omitempty"`
+	//report commit statuses of activities to the source code management server
+	CommitStatus bool `json:"commitStatus,omitempty" yaml:"commitStatus,omitempty"`
+	//report a commit status for each stage as well
+	StageStatus bool `json:"stageStatus,omitempty" yaml:"stageStatus,omitempty"`
+	//minutes between checks for changes of plain git sources with webhook enabled, DefaultPollInterval if not set
+	PollInterval int `json:"pollInterval,omitempty" yaml:"pollInterval,omitempty"`
+	//build pushes of branches matching Branches and not BranchesIgnore besides Branch, each branch is tracked separately
+	MultiBranch bool `json:"multiBranch,omitempty" yaml:"multiBranch,omitempty"`
+	//glob patterns of branches built in multi-branch mode, all branches if empty
+	Branches       []string `json:"branches,omitempty" yaml:"branches,omitempty"`
+	BranchesIgnore []string `json:"branchesIgnore,omitempty" yaml:"branchesIgnore,omitempty"`
 	//---Build step
 	Dockerfile     string `json:"dockerFileContent,omitempty" yaml:"dockerFileContent,omitempty"`
 	BuildPath      string `json:"buildPath,omitempty" yaml:"buildPath,omitempty"`
-	DockerfilePath string `json:"dockerFilePath,omittempty" yaml:"dockerFilePath,omitempty"`
+	DockerfilePath string `json:"dockerFilePath,omitempty" yaml:"dockerFilePath,omitempty"`
 	TargetImage    string `json:"targetImage,omitempty" yaml:"targetImage,omitempty"`
 	PushFlag       bool   `json:"push" yaml:"push,omitempty"`
+	//build args and labels in `key=val` format, values can refer to environment variables
+	BuildArgs []string `json:"buildArgs,omitempty" yaml:"buildArgs,omitempty"`
+	Labels    []string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	//target stage of a multi-stage Dockerfile
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+	//extra image tags besides TargetImage, pushed together with it
+	Tags      []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	CacheFrom []string `json:"cacheFrom,omitempty" yaml:"cacheFrom,omitempty"`
+	NoCache   bool     `json:"noCache,omitempty" yaml:"noCache,omitempty"`
+	Pull      bool     `json:"pull,omitempty" yaml:"pull,omitempty"`
+	Network   string   `json:"network,omitempty" yaml:"network,omitempty"`
 
 	//---task step
 	Image       string       `json:"image,omitempty" yaml:"image,omitempty"`
 	IsService   bool         `json:"isService" yaml:"isService,omitempty"`
 	Alias       string       `json:"alias,omitempty" yaml:"alias,omitempty"`
 	ShellScript string       `json:"shellScript,omitempty" yaml:"shellScript,omitempty"`
-	Entrypoint  string       `json:"entrypoint,omitempty" yaml:"enrtypoint,omitempty"`
+	Entrypoint  string       `json:"entrypoint,omitempty" yaml:"entrypoint,omitempty"`
 	Args        string       `json:"args,omitempty" yaml:"args,omitempty"`
 	Env         []string     `json:"env,omitempty" yaml:"env,omitempty"`
 	Services    []*CIService `json:"services,omitempty" yaml:"services,omitempty"`
+	//glob patterns of JUnit/xUnit XML reports in workspace
+	TestReports []string `json:"testReports,omitempty" yaml:"testReports,omitempty"`
+	//mark the step unstable/failed when failed tests reach the threshold, 0 means disabled
+	TestUnstableThreshold int `json:"testUnstableThreshold,omitempty" yaml:"testUnstableThreshold,omitempty"`
+	TestFailThreshold     int `json:"testFailThreshold,omitempty" yaml:"testFailThreshold,omitempty"`
+	//glob pattern of Cobertura XML, Go cover profile or lcov coverage reports in workspace
+	CoverageReport string `json:"coverageReport,omitempty" yaml:"coverageReport,omitempty"`
+	//fail the step when line coverage percentage is below MinCoverage,
+	//or drops more than MaxCoverageDrop percentage points from the last run of the branch, 0 means disabled
+	MinCoverage     float64 `json:"minCoverage,omitempty" yaml:"minCoverage,omitempty"`
+	MaxCoverageDrop float64 `json:"maxCoverageDrop,omitempty" yaml:"maxCoverageDrop,omitempty"`
 
 	//---upgradeService step
 	ImageTag        string            `json:"imageTag,omitempty" yaml:"imageTag,omitempty"`
@@ -170,6 +415,38 @@ type Step struct {
 	DeployFlag bool              `json:"deploy" yaml:"deploy,omitempty"`
 	Templates  map[string]string `json:"templates,omitempty" yaml:"templates,omitempty"`
 	Answers    string            `json:"answerString,omitempty" yaml:"answerString,omitempty"`
+
+	//---template step
+	//reference to a step template in `name@version` format
+	Template string `json:"template,omitempty" yaml:"template,omitempty"`
+	//input values of the step template
+	With map[string]string `json:"with,omitempty" yaml:"with,omitempty"`
+}
+
+//StepTemplate is a named and versioned group of steps with input parameters,
+//it is used by template steps in pipelines
+type StepTemplate struct {
+	client.Resource
+	Status string `json:"status,omitempty"`
+	StepTemplateContent
+}
+
+type StepTemplateContent struct {
+	Name        string           `json:"name,omitempty" yaml:"name,omitempty"`
+	Version     string           `json:"version,omitempty" yaml:"version,omitempty"`
+	Description string           `json:"description,omitempty" yaml:"description,omitempty"`
+	Inputs      []*TemplateInput `json:"inputs,omitempty" yaml:"inputs,omitempty"`
+	//steps can refer to inputs by ${inputs.<name>}
+	Steps []*Step `json:"steps,omitempty" yaml:"steps,omitempty"`
+	//for import
+	Templates map[string]string `json:"templates,omitempty" yaml:"-"`
+}
+
+type TemplateInput struct {
+	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Required    bool   `json:"required,omitempty" yaml:"required,omitempty"`
+	Default     string `json:"default,omitempty" yaml:"default,omitempty"`
 }
 
 type PipelineConditions struct {
@@ -194,6 +471,50 @@ type Activity struct {
 	ActivityStages  []*ActivityStage  `json:"activity_stages,omitempty"`
 	EnvVars         map[string]string `json:"envVars,omitempty"`
 	TriggerType     string            `json:"triggerType,omitempty"`
+	Coverage        *float64          `json:"coverage,omitempty"`
+	//images built and pushed in the activity
+	Images []*BuildImage `json:"images,omitempty"`
+	//files changed by the commits to build
+	ChangedFiles []string `json:"changedFiles,omitempty"`
+	//parameters overridden in a manual run
+	Overrides map[string]string `json:"overrides,omitempty"`
+	//git ref checked out instead of the head of the branch, a commit SHA or a full ref
+	GitRef string `json:"gitRef,omitempty"`
+	//tag built by the activity
+	GitTag string `json:"gitTag,omitempty"`
+	//push, tag, release or pull_request for activities triggered by webhooks
+	EventType string `json:"eventType,omitempty"`
+	//pull request built by the activity
+	PullRequest *PullRequest `json:"pullRequest,omitempty"`
+	//upstream run triggering the activity
+	Upstream *UpstreamRun `json:"upstream,omitempty"`
+	//commit states reported to the source code management server by status context
+	ReportedStatuses map[string]string `json:"reportedStatuses,omitempty"`
+}
+
+//PullRequest is a github pull request or a gitlab merge request
+type PullRequest struct {
+	Number       int    `json:"number,omitempty"`
+	Title        string `json:"title,omitempty"`
+	Author       string `json:"author,omitempty"`
+	SourceBranch string `json:"sourceBranch,omitempty"`
+	TargetBranch string `json:"targetBranch,omitempty"`
+	//commit SHA of the head
+	HeadCommit string `json:"headCommit,omitempty"`
+	//ref of the head in the target repository, like refs/pull/1/head
+	Ref string `json:"ref,omitempty"`
+	//the head is in a fork of the target repository
+	Fork bool `json:"fork,omitempty"`
+}
+
+//UpstreamRun is a completed run of an upstream pipeline
+type UpstreamRun struct {
+	PipelineId   string `json:"pipelineId,omitempty"`
+	PipelineName string `json:"pipelineName,omitempty"`
+	ActivityId   string `json:"activityId,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Commit       string `json:"commit,omitempty"`
+	Branch       string `json:"branch,omitempty"`
 }
 
 type ActivityStage struct {
@@ -209,11 +530,140 @@ type ActivityStage struct {
 }
 
 type ActivityStep struct {
-	Name     string `json:"name,omitempty"`
-	Message  string `json:"message,omitempty"`
-	Status   string `json:"status,omitempty"`
-	StartTS  int64  `json:"start_ts,omitempty"`
-	Duration int64  `json:"duration,omitempty"`
+	Name       string      `json:"name,omitempty"`
+	Message    string      `json:"message,omitempty"`
+	Status     string      `json:"status,omitempty"`
+	StartTS    int64       `json:"start_ts,omitempty"`
+	Duration   int64       `json:"duration,omitempty"`
+	TestResult *TestResult `json:"testResult,omitempty"`
+	Coverage   *Coverage   `json:"coverage,omitempty"`
+	Image      *BuildImage `json:"image,omitempty"`
+	//KEY=VALUE outputs written to $CICD_OUTPUT
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+type BuildImage struct {
+	StepName string   `json:"stepName,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	ImageId  string   `json:"imageId,omitempty"`
+	//registry digest and the immutable reference in `repository@digest` format, set when pushed
+	Digest    string `json:"digest,omitempty"`
+	Reference string `json:"reference,omitempty"`
+}
+
+type Coverage struct {
+	LinesCovered int     `json:"linesCovered,omitempty"`
+	LinesValid   int     `json:"linesValid,omitempty"`
+	Percent      float64 `json:"percent"`
+}
+
+type TestResult struct {
+	Total    int            `json:"total"`
+	Passed   int            `json:"passed"`
+	Failed   int            `json:"failed"`
+	Skipped  int            `json:"skipped"`
+	Failures []*TestFailure `json:"failures,omitempty"`
+}
+
+type TestFailure struct {
+	ClassName string `json:"className,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+//TestTrend is the test result and coverage summary of an activity
+type TestTrend struct {
+	client.Resource
+	ActivityId  string   `json:"activityId,omitempty"`
+	RunSequence int      `json:"runSequence,omitempty"`
+	StartTS     int64    `json:"start_ts,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	CommitInfo  string   `json:"commitInfo,omitempty"`
+	Total       int      `json:"total"`
+	Passed      int      `json:"passed"`
+	Failed      int      `json:"failed"`
+	Skipped     int      `json:"skipped"`
+	Coverage    *float64 `json:"coverage,omitempty"`
+}
+
+//RunInput is the input of a manual run
+type RunInput struct {
+	//override values of parameters
+	Parameters map[string]string `json:"parameters,omitempty"`
+	//branch to build instead of the branch of the source code management step
+	Branch string `json:"branch,omitempty"`
+	//commit SHA to build, it can be combined with the branch
+	Commit string `json:"commit,omitempty"`
+	//tag to build
+	Tag string `json:"tag,omitempty"`
+	//full git ref to build, like refs/tags/v1.0 or refs/pull/1/head
+	Ref string `json:"ref,omitempty"`
+	//type of the webhook event triggering the run, set by the server
+	Event string `json:"-"`
+	//pull request to build, set by the server
+	PullRequest *PullRequest `json:"-"`
+	//upstream run triggering the run, set by the server
+	Upstream *UpstreamRun `json:"-"`
+}
+
+//GitRef gets the ref to check out for the input, empty to build the head of the branch
+func (input *RunInput) GitRef() string {
+	if input == nil {
+		return ""
+	}
+	switch {
+	case input.Commit != "":
+		return input.Commit
+	case input.Tag != "":
+		return "refs/tags/" + input.Tag
+	}
+	return input.Ref
+}
+
+//PlanInput is the input of a dry run
+type PlanInput struct {
+	//unsaved pipeline to plan, the saved pipeline is used if not provided
+	Pipeline *Pipeline `json:"pipeline,omitempty"`
+	//values of user defined environment variables, override parameters of the pipeline
+	Parameters  map[string]string `json:"parameters,omitempty"`
+	TriggerType string            `json:"triggerType,omitempty"`
+	//files changed by the commits to build, used by changed() in conditions
+	ChangedFiles []string `json:"changedFiles,omitempty"`
+}
+
+//PipelinePlan is the dry run result of a pipeline, it shows what runs without creating jobs or activities
+type PipelinePlan struct {
+	client.Resource
+	PipelineName string            `json:"pipelineName,omitempty"`
+	EnvVars      map[string]string `json:"envVars,omitempty"`
+	Stages       []*StagePlan      `json:"stages,omitempty"`
+}
+
+type StagePlan struct {
+	Name string `json:"name,omitempty"`
+	//whether the stage runs by its conditions
+	Run        bool               `json:"run"`
+	Conditions []*ConditionResult `json:"conditions,omitempty"`
+	Steps      []*StepPlan        `json:"steps,omitempty"`
+}
+
+type StepPlan struct {
+	Name       string             `json:"name,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Run        bool               `json:"run"`
+	Conditions []*ConditionResult `json:"conditions,omitempty"`
+	//env vars resolved for the step
+	EnvVars map[string]string `json:"envVars,omitempty"`
+	//generated shell script and jenkins job config
+	Script    string `json:"script,omitempty"`
+	JobConfig string `json:"jobConfig,omitempty"`
+}
+
+type ConditionResult struct {
+	Expression string `json:"expression,omitempty"`
+	Result     bool   `json:"result"`
+	Error      string `json:"error,omitempty"`
 }
 
 type CIService struct {
@@ -224,6 +674,16 @@ type CIService struct {
 	Command       string `json:"command,omitempty"`
 }
 
+//BuildImageVarPrefix gets the prefix of env vars for the image built in a build step, like `CICD_BUILD_<STEPNAME>`.
+//Step position is used when the step has no name.
+func BuildImageVarPrefix(step *Step, stageOrdinal int, stepOrdinal int) string {
+	name := strings.Trim(regNonWord.ReplaceAllString(strings.ToUpper(step.Name), "_"), "_")
+	if name == "" {
+		name = fmt.Sprintf("%d_%d", stageOrdinal+1, stepOrdinal+1)
+	}
+	return "CICD_BUILD_" + name
+}
+
 func (activity *Activity) CanApprove(userId string) bool {
 	if activity.Status == ActivityPending && len(activity.Pipeline.Stages) > activity.PendingStage {
 		approvers := activity.Pipeline.Stages[activity.PendingStage].Approvers
@@ -241,7 +701,8 @@ func (activity *Activity) CanApprove(userId string) bool {
 }
 
 type PipelineProvider interface {
-	RunPipeline(*Pipeline, string) (*Activity, error)
+	RunPipeline(*Pipeline, string, *RunInput) (*Activity, error)
+	PlanPipeline(*Pipeline, *PlanInput) (*PipelinePlan, error)
 	RerunActivity(*Activity) error
 	RunStage(*Activity, int) error
 	RunStep(*Activity, int, int) error
@@ -263,7 +724,39 @@ type SCManager interface {
 	OAuth(redirectURL string, clientID string, clientSecret string, code string) (*GitAccount, error)
 	DeleteWebhook(pipeline *Pipeline, gitToken string) error
 	CreateWebhook(pipeline *Pipeline, gitToken string, ciEndpoint string) error
-	VerifyWebhookPayload(pipeline *Pipeline, req *http.Request) bool
+	VerifyWebhookPayload(pipeline *Pipeline, req *http.Request) (*WebhookEvent, bool)
+	GetChangedFiles(pipeline *Pipeline, gitToken string, base string, head string) ([]string, error)
+	GetFileContent(pipeline *Pipeline, gitToken string, path string, ref string) ([]byte, error)
+	CreateCommitStatus(pipeline *Pipeline, gitToken string, commit string, status *CommitStatus) error
+	GetBranches(pipeline *Pipeline, gitToken string) ([]string, error)
+}
+
+//CommitStatus is the status of a commit reported to the source code management server
+type CommitStatus struct {
+	//pending, success, failure or canceled
+	State string
+	//name identifying the status of the pipeline or a stage
+	Context     string
+	Description string
+	//link to the activity
+	TargetURL string
+}
+
+//WebhookEvent is the push, tag, release or pull request event parsed from a verified webhook payload
+type WebhookEvent struct {
+	//push, tag, release or pull_request
+	Type string
+	//tag of tag and release events
+	Tag string
+	//pull request of pull request events
+	PullRequest *PullRequest
+	Ref         string
+	Before      string
+	After       string
+	//files changed by the pushed commits
+	ChangedFiles []string
+	//the payload does not list all pushed commits
+	Truncated bool
 }
 
 type GitAccount struct {
@@ -279,8 +772,18 @@ type GitAccount struct {
 	AvatarURL   string `json:"avatar_url,omitempty"`
 	HTMLURL     string `json:"html_url,omitempty"`
 	AccessToken string `json:"accessToken,omitempty"`
+	//for access tokens expiring in unix time, refreshed before expiry
+	RefreshToken string `json:"refreshToken,omitempty"`
+	TokenExpiry  int64  `json:"tokenExpiry,omitempty"`
+	//for plain git accounts using ssh, the private key and the known hosts to verify servers
+	SSHKey     string `json:"sshKey,omitempty"`
+	KnownHosts string `json:"knownHosts,omitempty"`
 }
 
+//GitAccountType is the account type of plain git servers without an api,
+//Login and AccessToken of these accounts are the username and the password or token for http
+const GitAccountType = "git"
+
 type GitRepository struct {
 	client.Resource
 	CloneURL    string          `json:"clone_url,omitempty"`
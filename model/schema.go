@@ -18,6 +18,12 @@ func NewSchema() *client.Schemas {
 	scmSettingSchema(schemas.AddType("scmSetting", SCMSetting{}))
 	accountSchema(schemas.AddType("gitaccount", GitAccount{}))
 	repositorySchema(schemas.AddType("gitrepository", GitRepository{}))
+	schemas.AddType("testTrend", TestTrend{})
+	schemas.AddType("pipelinePlan", PipelinePlan{})
+	runInput := schemas.AddType("runInput", RunInput{})
+	//fields set by the server are not part of the input
+	delete(runInput.ResourceFields, "-")
+	stepTemplateSchema(schemas.AddType("stepTemplate", StepTemplate{}))
 	return schemas
 }
 
@@ -53,6 +59,7 @@ func pipelineSchema(pipeline *client.Schema) {
 
 	pipeline.ResourceActions = map[string]client.Action{
 		"run": client.Action{
+			Input:  "runInput",
 			Output: "activity",
 		},
 		"update": client.Action{
@@ -70,6 +77,14 @@ func pipelineSchema(pipeline *client.Schema) {
 		"export": client.Action{
 			Output: "pipeline",
 		},
+		"plan": client.Action{
+			Output: "pipelinePlan",
+		},
+	}
+	pipeline.CollectionActions = map[string]client.Action{
+		"plan": client.Action{
+			Output: "pipelinePlan",
+		},
 	}
 
 	pipeline.CollectionMethods = []string{http.MethodGet, http.MethodPost}
@@ -137,6 +152,22 @@ func repositorySchema(repository *client.Schema) {
 	repository.PluralName = "gitrepositories"
 }
 
+func stepTemplateSchema(template *client.Schema) {
+	template.CollectionMethods = []string{http.MethodGet, http.MethodPost}
+	template.PluralName = "steptemplates"
+	template.ResourceActions = map[string]client.Action{
+		"update": client.Action{
+			Output: "stepTemplate",
+		},
+		"remove": client.Action{
+			Output: "stepTemplate",
+		},
+		"export": client.Action{
+			Output: "stepTemplate",
+		},
+	}
+}
+
 func ToPipelineCollections(apiContext *api.ApiContext, pipelines []*Pipeline) []interface{} {
 	var r []interface{}
 	for _, p := range pipelines {
@@ -158,9 +189,14 @@ func ToPipelineResource(apiContext *api.ApiContext, pipeline *Pipeline) *Pipelin
 	pipeline.Actions["activate"] = apiContext.UrlBuilder.ReferenceLink(pipeline.Resource) + "?action=activate"
 	pipeline.Actions["deactivate"] = apiContext.UrlBuilder.ReferenceLink(pipeline.Resource) + "?action=deactivate"
 	pipeline.Actions["export"] = apiContext.UrlBuilder.ReferenceLink(pipeline.Resource) + "?action=export"
+	pipeline.Actions["plan"] = apiContext.UrlBuilder.ReferenceLink(pipeline.Resource) + "?action=plan"
 
 	pipeline.Links["activities"] = apiContext.UrlBuilder.Link(pipeline.Resource, "activities")
 	pipeline.Links["exportConfig"] = apiContext.UrlBuilder.Link(pipeline.Resource, "exportConfig")
+	pipeline.Links["testResults"] = apiContext.UrlBuilder.Link(pipeline.Resource, "testResults")
+	if pipeline.GenericWebhook != nil && pipeline.GenericWebhook.Enabled {
+		pipeline.Links["genericWebhook"] = apiContext.UrlBuilder.Link(pipeline.Resource, "genericWebhook")
+	}
 	FilterPipeline(pipeline)
 	return pipeline
 }
@@ -216,6 +252,20 @@ func ToRepositoryResource(apiContext *api.ApiContext, repository *GitRepository)
 	return repository
 }
 
+func ToStepTemplateResource(apiContext *api.ApiContext, template *StepTemplate) *StepTemplate {
+	template.Resource = client.Resource{
+		Id:      template.Id,
+		Type:    "stepTemplate",
+		Actions: map[string]string{},
+		Links:   map[string]string{},
+	}
+	template.Actions["update"] = apiContext.UrlBuilder.ReferenceLink(template.Resource) + "?action=update"
+	template.Actions["remove"] = apiContext.UrlBuilder.ReferenceLink(template.Resource) + "?action=remove"
+	template.Actions["export"] = apiContext.UrlBuilder.ReferenceLink(template.Resource) + "?action=export"
+	template.Links["exportConfig"] = apiContext.UrlBuilder.Link(template.Resource, "exportConfig")
+	return template
+}
+
 func ToPipelineSettingResource(apiContext *api.ApiContext, setting *PipelineSetting) *PipelineSetting {
 	setting.Resource = client.Resource{
 		Type:    "setting",
@@ -245,6 +295,7 @@ func ToSCMSettingResource(apiContext *api.ApiContext, setting *SCMSetting) *SCMS
 
 func FilterPipeline(pipeline *Pipeline) {
 	pipeline.WebHookToken = ""
+	pipeline.GenericWebhookToken = ""
 	for _, stage := range pipeline.Stages {
 		for _, step := range stage.Steps {
 			step.Secretkey = ""
@@ -261,6 +312,8 @@ func FilterActivity(activity *Activity) {
 
 func FilterAccount(account *GitAccount) {
 	account.AccessToken = ""
+	account.RefreshToken = ""
+	account.SSHKey = ""
 }
 
 func FilterSCMSetting(setting *SCMSetting) {
@@ -0,0 +1,85 @@
+package pipelinefile
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/rancher/pipeline/model"
+)
+
+//migration upgrades a decoded pipeline file from a version to the next one
+type migration struct {
+	from string
+	to   string
+	//keys renamed by the migration, they are allowed in files of older versions
+	renamed map[reflect.Type]map[string]string
+	migrate func(doc map[interface{}]interface{})
+}
+
+//migrations in version order
+var migrations = []*migration{
+	{
+		from: "v1",
+		to:   "v2",
+		renamed: map[reflect.Type]map[string]string{
+			reflect.TypeOf(model.Step{}): {"enrtypoint": "entrypoint"},
+		},
+		migrate: func(doc map[interface{}]interface{}) {
+			forEachStep(doc, func(step map[interface{}]interface{}) {
+				renameKey(step, "enrtypoint", "entrypoint")
+			})
+		},
+	},
+}
+
+//migrationsFrom gets migrations to upgrade a file of the version to the current version
+func migrationsFrom(version string) ([]*migration, error) {
+	if version == CurrentVersion {
+		return nil, nil
+	}
+	for i, m := range migrations {
+		if m.from == version {
+			return migrations[i:], nil
+		}
+	}
+	if n, err := versionNumber(version); err == nil {
+		if current, _ := versionNumber(CurrentVersion); n > current {
+			return nil, &Error{Problems: []string{fmt.Sprintf("pipeline file version '%s' is newer than supported version '%s'", version, CurrentVersion)}}
+		}
+	}
+	return nil, &Error{Problems: []string{fmt.Sprintf("unsupported pipeline file version '%s'", version)}}
+}
+
+func renamedIn(pending []*migration, t reflect.Type, key string) bool {
+	for _, m := range pending {
+		if _, ok := m.renamed[t][key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func forEachStep(doc map[interface{}]interface{}, fn func(step map[interface{}]interface{})) {
+	stages, _ := doc["stages"].([]interface{})
+	for _, stage := range stages {
+		stageMap, _ := stage.(map[interface{}]interface{})
+		steps, _ := stageMap["steps"].([]interface{})
+		for _, step := range steps {
+			if stepMap, ok := step.(map[interface{}]interface{}); ok {
+				fn(stepMap)
+			}
+		}
+	}
+}
+
+//renameKey renames a key, the value of the new key is kept if both exist
+func renameKey(m map[interface{}]interface{}, old string, new string) {
+	v, ok := m[old]
+	if !ok {
+		return
+	}
+	delete(m, old)
+	if _, exists := m[new]; !exists {
+		m[new] = v
+	}
+}
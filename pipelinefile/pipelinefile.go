@@ -0,0 +1,252 @@
+//Package pipelinefile decodes and encodes versioned pipeline files.
+//
+//Pipeline files are decoded strictly, unknown or misspelled keys are reported with line numbers.
+//Files of older versions are migrated to the current version.
+package pipelinefile
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/pipeline/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//CurrentVersion is the version of pipeline files written on export
+const CurrentVersion = "v2"
+
+//files without version are taken as v1
+const defaultVersion = "v1"
+
+//Error contains all problems found in a pipeline file
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid pipeline file:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+var regUnknownField = regexp.MustCompile(`^line (\d+): field (.+) not found in struct (.+)$`)
+
+//Decode decodes a pipeline file of any supported version into content
+func Decode(data []byte, content *model.PipelineContent) error {
+	header := struct {
+		Version string `yaml:"version"`
+	}{}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return &Error{Problems: []string{err.Error()}}
+	}
+	version := header.Version
+	if version == "" {
+		version = defaultVersion
+	}
+	pending, err := migrationsFrom(version)
+	if err != nil {
+		return err
+	}
+	if problems := checkStrict(data, pending); len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	if len(pending) == 0 {
+		if err := yaml.Unmarshal(data, content); err != nil {
+			return &Error{Problems: []string{err.Error()}}
+		}
+		return nil
+	}
+	doc := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return &Error{Problems: []string{err.Error()}}
+	}
+	for _, m := range pending {
+		m.migrate(doc)
+		doc["version"] = m.to
+	}
+	migrated, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(migrated, content); err != nil {
+		return &Error{Problems: []string{err.Error()}}
+	}
+	return nil
+}
+
+//Encode encodes a pipeline file of the current version
+func Encode(content *model.PipelineContent) ([]byte, error) {
+	c := *content
+	c.Version = CurrentVersion
+	return yaml.Marshal(&c)
+}
+
+//checkStrict decodes the file strictly and gets the problems,
+//keys renamed by pending migrations are allowed
+func checkStrict(data []byte, pending []*migration) []string {
+	err := yaml.UnmarshalStrict(data, &model.PipelineContent{})
+	if err == nil {
+		return nil
+	}
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	problems := []string{}
+	for _, msg := range typeErr.Errors {
+		m := regUnknownField.FindStringSubmatch(msg)
+		if m == nil {
+			problems = append(problems, msg)
+			continue
+		}
+		t := structTypes()[m[3]]
+		if t == nil {
+			problems = append(problems, msg)
+			continue
+		}
+		if renamedIn(pending, t, m[2]) {
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+		problem := fmt.Sprintf("line %d: unknown field '%s' in %s", keyLine(data, line, m[2]), m[2], structLabels[t])
+		if suggestion := closestKey(t, m[2]); suggestion != "" {
+			problem += fmt.Sprintf(", did you mean '%s'?", suggestion)
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+//keyLine finds the line of a key in a mapping, decoding errors only tell the line where the mapping starts
+func keyLine(data []byte, mappingLine int, key string) int {
+	regKey := regexp.MustCompile(`^\s*(- )?['"]?` + regexp.QuoteMeta(key) + `['"]?\s*:`)
+	lines := strings.Split(string(data), "\n")
+	for i := mappingLine - 1; i >= 0 && i < len(lines); i++ {
+		if regKey.MatchString(lines[i]) {
+			return i + 1
+		}
+	}
+	return mappingLine
+}
+
+//structLabels names struct types of a pipeline file in problems
+var structLabels = labelStructs(reflect.TypeOf(model.PipelineContent{}), "pipeline", map[reflect.Type]string{})
+
+//labelStructs labels the struct type and struct types of its fields in the pipeline file by their keys,
+//entries of lists are labeled by the singular key, e.g. 'stage' for entries of 'stages'
+func labelStructs(t reflect.Type, label string, labels map[reflect.Type]string) map[reflect.Type]string {
+	if _, ok := labels[t]; ok {
+		return labels
+	}
+	labels[t] = label
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("yaml")
+		if tag == "-" || f.PkgPath != "" {
+			continue
+		}
+		key := strings.Split(tag, ",")[0]
+		if key == "" {
+			key = strings.ToLower(f.Name)
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Slice || ft.Kind() == reflect.Map {
+			key = strings.TrimSuffix(key, "s")
+			ft = ft.Elem()
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+		}
+		if ft.Kind() == reflect.Struct {
+			labelStructs(ft, key, labels)
+		}
+	}
+	return labels
+}
+
+//structTypes gets struct types in a pipeline file by their names in decoding errors
+func structTypes() map[string]reflect.Type {
+	types := map[string]reflect.Type{}
+	for t := range structLabels {
+		types[t.String()] = t
+	}
+	return types
+}
+
+//yamlKeys gets keys of a struct in yaml
+func yamlKeys(t reflect.Type) []string {
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("yaml")
+		if tag == "-" || f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+//closestKey suggests a known key for a misspelled one
+func closestKey(t reflect.Type, key string) string {
+	best := ""
+	bestDistance := 3
+	for _, k := range yamlKeys(t) {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+		if d := distance(strings.ToLower(k), strings.ToLower(key)); d < bestDistance {
+			best = k
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+//distance is the Levenshtein distance of two strings
+func distance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+//versionNumber gets the number of versions like `v2`
+func versionNumber(version string) (int, error) {
+	if !strings.HasPrefix(version, "v") {
+		return 0, fmt.Errorf("invalid version '%s'", version)
+	}
+	return strconv.Atoi(version[1:])
+}
@@ -192,16 +192,52 @@ cihelper --envurl "$R_UPGRADESTACK_ENDPOINT" --accesskey "$R_UPGRADESTACK_ACCESS
 rm -r ../$TEMPDIR
 `
 
+//post build result and the content of workspace files, %s is filled with collectFileScript lines
 const stepFinishScript = `def result = manager.build.result
-def command =  ["sh","-c","curl -s -d '' 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
-manager.listener.logger.println command.execute().text`
+def workspace = manager.build.workspace
+def payload = []
+%s
+def command =  ["sh","-c","curl -s --data-binary @- 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
+def proc = command.execute()
+proc.withWriter { it << payload.join("&") }
+manager.listener.logger.println proc.text`
+
+//collect workspace files matching the ant style patterns as form values of the field
+const collectFileScript = `if (workspace != null) { workspace.list('%s').each { payload << "%s=" + URLEncoder.encode(it.readToString(), "UTF-8") } }
+`
 
+//post build result, git info and the content of workspace files, %s is filled with collectFileScript lines
 const stepSCMFinishScript = `def result = manager.build.result
 def env = manager.build.environment
-def GIT_COMMIT = env.get("GIT_COMMIT")
-def GIT_URL = env.get("GIT_URL")
-def GIT_BRANCH = env.get("GIT_BRANCH")
-def command =  ["sh","-c","curl -s -d 'GIT_URL=${GIT_URL}&GIT_BRANCH=${GIT_BRANCH}&GIT_COMMIT=${GIT_COMMIT}' 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
-manager.listener.logger.println command.execute().text`
+def workspace = manager.build.workspace
+def payload = []
+["GIT_URL","GIT_BRANCH","GIT_COMMIT"].each { payload << it + "=" + URLEncoder.encode(env.get(it) ?: "", "UTF-8") }
+%s
+def command =  ["sh","-c","curl -s --data-binary @- 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
+def proc = command.execute()
+proc.withWriter { it << payload.join("&") }
+manager.listener.logger.println proc.text`
+
+//file listing the changed files since last run
+const changedFilesFile = ".r_cicd_changed_files"
+
+//env vars of the pull request built by an activity
+var pullRequestEnvs = []string{"CICD_PR_NUMBER", "CICD_PR_SOURCE_BRANCH", "CICD_PR_TARGET_BRANCH", "CICD_PR_AUTHOR"}
+
+//env vars of the upstream run triggering an activity
+var upstreamEnvs = []string{"CICD_UPSTREAM_PIPELINE_NAME", "CICD_UPSTREAM_ACTIVITY_ID", "CICD_UPSTREAM_STATUS", "CICD_UPSTREAM_COMMIT", "CICD_UPSTREAM_BRANCH"}
+
+//merge the target branch into the checked out head of a pull request, %s is the remote ref of the target branch
+const mergeTargetScript = `git -c user.name=rancher-pipeline -c user.email=pipeline@rancher.local merge --no-edit %s
+`
+
+//list changed files since the commit of last run(%s) in file %s, or files of the last commit if it is unknown
+const changedFilesScript = `R_CICD_PREVIOUS_COMMIT=%s
+if [ -n "$R_CICD_PREVIOUS_COMMIT" ] && git cat-file -e "$R_CICD_PREVIOUS_COMMIT^{commit}" 2>/dev/null;then
+git diff --name-only "$R_CICD_PREVIOUS_COMMIT" HEAD>%[2]s || true
+else
+git diff-tree --root --no-commit-id --name-only -r HEAD>%[2]s || true
+fi
+`
 
 const stepStartScript = "curl -s -d '' 'pipeline-server:60080/v1/events/stepstart?id=%v&stageOrdinal=%v&stepOrdinal=%v'"
@@ -0,0 +1,122 @@
+package jenkins
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+//planActivityId is the activity id used in jobs rendered by a dry run
+const planActivityId = "dry-run"
+
+//planSecretKey replaces secret keys of environment credentials in jobs rendered by a dry run
+const planSecretKey = "<secretkey>"
+
+//PlanPipeline renders jenkins jobs of the pipeline and evaluates conditions without creating jobs or activities
+func (j JenkinsProvider) PlanPipeline(p *model.Pipeline, input *model.PlanInput) (*model.PipelinePlan, error) {
+	if input == nil {
+		input = &model.PlanInput{}
+	}
+	triggerType := input.TriggerType
+	if triggerType == "" {
+		triggerType = model.TriggerTypeManual
+	}
+	activity := &model.Activity{
+		Id:           planActivityId,
+		Pipeline:     *p,
+		RunSequence:  p.RunCount + 1,
+		Status:       model.ActivityWaiting,
+		TriggerType:  triggerType,
+		ChangedFiles: input.ChangedFiles,
+	}
+	for _, stage := range p.Stages {
+		activity.ActivityStages = append(activity.ActivityStages, ToActivityStage(stage))
+	}
+	//parameters of the input are applied to the pipeline by service.PlanPipeline
+	initActivityEnvvars(activity)
+
+	plan := &model.PipelinePlan{
+		PipelineName: p.Name,
+		EnvVars:      activity.EnvVars,
+	}
+	for stageOrdinal, stage := range p.Stages {
+		stagePlan := &model.StagePlan{
+			Name: stage.Name,
+			Run:  true,
+		}
+		if service.HasStageCondition(stage) {
+			stagePlan.Conditions, stagePlan.Run = planConditions(activity, stage.Conditions)
+		}
+		for stepOrdinal, step := range stage.Steps {
+			stepPlan := &model.StepPlan{
+				Name:    step.Name,
+				Type:    step.Type,
+				Run:     stagePlan.Run,
+				EnvVars: stepEnvVars(activity, step),
+			}
+			if service.HasStepCondition(step) {
+				var run bool
+				stepPlan.Conditions, run = planConditions(activity, step.Conditions)
+				stepPlan.Run = stepPlan.Run && run
+			}
+			conf := j.generateStepJenkinsProject(activity, stageOrdinal, stepOrdinal)
+			if len(conf.Builders.TaskShells) > 0 {
+				stepPlan.Script = conf.Builders.TaskShells[0].Command
+			}
+			bconf, err := xml.MarshalIndent(conf, "  ", "    ")
+			if err != nil {
+				return nil, err
+			}
+			stepPlan.JobConfig = string(bconf)
+			stagePlan.Steps = append(stagePlan.Steps, stepPlan)
+		}
+		plan.Stages = append(plan.Stages, stagePlan)
+	}
+	return plan, nil
+}
+
+//planConditions evaluates each condition like EvaluateConditions,
+//any conditions are ignored when all conditions exist
+func planConditions(activity *model.Activity, conditions *model.PipelineConditions) ([]*model.ConditionResult, bool) {
+	exprs := conditions.All
+	all := true
+	if len(exprs) == 0 {
+		exprs = conditions.Any
+		all = false
+	}
+	results := []*model.ConditionResult{}
+	run := all
+	for _, expr := range exprs {
+		result := &model.ConditionResult{Expression: expr}
+		res, err := EvaluateCondition(activity, expr)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Result = res
+		results = append(results, result)
+		if all {
+			run = run && res && err == nil
+		} else {
+			run = run || (res && err == nil)
+		}
+	}
+	return results, run
+}
+
+//stepEnvVars gets env vars of the activity and the step
+func stepEnvVars(activity *model.Activity, step *model.Step) map[string]string {
+	vars := map[string]string{}
+	for k, v := range activity.EnvVars {
+		vars[k] = v
+	}
+	for _, env := range step.Env {
+		splits := strings.SplitN(env, "=", 2)
+		if len(splits) != 2 {
+			continue
+		}
+		vars[splits[0]] = SubstituteVar(activity, splits[1])
+	}
+	return vars
+}
@@ -16,22 +16,33 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/condition"
 	"github.com/rancher/pipeline/model"
 	"github.com/rancher/pipeline/server/service"
-	"github.com/rancher/pipeline/util"
+	"github.com/rancher/pipeline/stepscript"
 	"github.com/sluu99/uuid"
 )
 
 type JenkinsProvider struct {
 }
 
-func (j JenkinsProvider) RunPipeline(p *model.Pipeline, triggerType string) (*model.Activity, error) {
+func (j JenkinsProvider) RunPipeline(p *model.Pipeline, triggerType string, input *model.RunInput) (*model.Activity, error) {
 
 	activity, err := ToActivity(p)
 	if err != nil {
 		return nil, err
 	}
 	activity.TriggerType = triggerType
+	if input != nil && len(input.Parameters) > 0 {
+		activity.Overrides = input.Parameters
+	}
+	activity.GitRef = input.GitRef()
+	if input != nil {
+		activity.GitTag = input.Tag
+		activity.EventType = input.Event
+		activity.PullRequest = input.PullRequest
+		activity.Upstream = input.Upstream
+	}
 	initActivityEnvvars(activity)
 
 	if len(p.Stages) == 0 {
@@ -193,7 +204,7 @@ func DeleteFormerBuild(activity *model.Activity) error {
 	for stageOrdinal, stage := range activity.ActivityStages {
 		for stepOrdinal, step := range stage.ActivitySteps {
 			jobName := getJobName(activity, stageOrdinal, stepOrdinal)
-			if step.Status == model.ActivityStepSuccess || step.Status == model.ActivityStepFail {
+			if step.Status == model.ActivityStepSuccess || step.Status == model.ActivityStepFail || step.Status == model.ActivityStepUnstable {
 				logrus.Infof("deleting:%v", jobName)
 				if err := DeleteBuild(jobName); err != nil {
 					return err
@@ -255,30 +266,12 @@ func EvaluateConditions(activity *model.Activity, condition *model.PipelineCondi
 	return false, nil
 }
 
-//valid format:     xxx=xxx; xxx!=xxx
-func EvaluateCondition(activity *model.Activity, condition string) (bool, error) {
-	m := util.GetParams(`(?P<Key>.*?)!=(?P<Value>.*)`, condition)
-	if m["Key"] != "" && m["Value"] != "" {
-		key := SubstituteVar(activity, m["Key"])
-		val := SubstituteVar(activity, m["Value"])
-		envVal := activity.EnvVars[key]
-		if envVal != val {
-			return true, nil
-		}
-		return false, nil
-	}
-
-	m = util.GetParams(`(?P<Key>.*?)=(?P<Value>.*)`, condition)
-	if m["Key"] != "" && m["Value"] != "" {
-		key := SubstituteVar(activity, m["Key"])
-		val := SubstituteVar(activity, m["Value"])
-		envVal := activity.EnvVars[key]
-		if envVal == val {
-			return true, nil
-		}
-		return false, nil
-	}
-	return false, fmt.Errorf("cannot parse condition:%s", condition)
+//EvaluateCondition evaluates a condition expression with env vars and changed files of the activity
+func EvaluateCondition(activity *model.Activity, expr string) (bool, error) {
+	return condition.Evaluate(expr, &condition.Context{
+		Env:          activity.EnvVars,
+		ChangedFiles: activity.ChangedFiles,
+	})
 }
 
 func (j JenkinsProvider) RunStage(activity *model.Activity, ordinal int) error {
@@ -391,12 +384,19 @@ func (j JenkinsProvider) generateStepJenkinsProject(activity *model.Activity, st
 
 	step.Services = service.GetServices(activity, stageOrdinal, stepOrdinal)
 	taskShells := []JenkinsTaskShell{}
-	taskShells = append(taskShells, JenkinsTaskShell{Command: commandBuilder(activity, step)})
+	command := commandBuilder(activity, step)
+	if step.Type == model.StepTypeBuild {
+		command += stepscript.CaptureImageScript(step, stageOrdinal, stepOrdinal, step.PushFlag)
+	}
+	if step.Type != model.StepTypeSCM {
+		command = stepscript.OutputScript(stageOrdinal, stepOrdinal, command)
+	}
+	taskShells = append(taskShells, JenkinsTaskShell{Command: command})
 	commandBuilders := JenkinsBuilder{TaskShells: taskShells}
 
 	scm := JenkinsSCM{Class: "hudson.scm.NullSCM"}
 
-	postBuildSctipt := stepFinishScript
+	postBuildSctipt := fmt.Sprintf(stepFinishScript, collectFilesScript(step, stageOrdinal, stepOrdinal), url.QueryEscape(activity.Id), stageOrdinal, stepOrdinal)
 	if step.Type == model.StepTypeSCM {
 		scm = JenkinsSCM{
 			Class:           "hudson.plugins.git.GitSCM",
@@ -406,7 +406,11 @@ func (j JenkinsProvider) generateStepJenkinsProject(activity *model.Activity, st
 			GitCredentialId: step.GitUser,
 			GitBranch:       step.Branch,
 		}
-		postBuildSctipt = stepSCMFinishScript
+		if activity.GitRef != "" {
+			scm.GitBranch, scm.GitRefspec = checkoutSpec(activity.GitRef)
+		}
+		changedFiles := fmt.Sprintf(collectFileScript, changedFilesFile, "CHANGED_FILES")
+		postBuildSctipt = fmt.Sprintf(stepSCMFinishScript, changedFiles, url.QueryEscape(activity.Id), stageOrdinal, stepOrdinal)
 	}
 	preSCMStep := PreSCMBuildStepsWrapper{
 		Plugin:      "preSCMbuildstep@0.3",
@@ -448,7 +452,7 @@ func (j JenkinsProvider) generateStepJenkinsProject(activity *model.Activity, st
 		GroovyScript: GroovyScript{
 			Plugin:  "script-security@1.30",
 			Sandbox: false,
-			Script:  fmt.Sprintf(postBuildSctipt, url.QueryEscape(activity.Id), stageOrdinal, stepOrdinal),
+			Script:  postBuildSctipt,
 		},
 	}
 	v.Publishers = pbt
@@ -457,6 +461,36 @@ func (j JenkinsProvider) generateStepJenkinsProject(activity *model.Activity, st
 
 }
 
+//collectFilesScript generates groovy lines that send back workspace files of the step on finish
+func collectFilesScript(step *model.Step, stageOrdinal int, stepOrdinal int) string {
+	b := new(bytes.Buffer)
+	if step.Type == model.StepTypeBuild {
+		b.WriteString(fmt.Sprintf(collectFileScript, stepscript.ImageInfoFile(stageOrdinal, stepOrdinal), "IMAGE_INFO"))
+	}
+	b.WriteString(fmt.Sprintf(collectFileScript, stepscript.OutputFile(stageOrdinal, stepOrdinal), "STEP_OUTPUTS"))
+	if len(step.TestReports) > 0 {
+		b.WriteString(fmt.Sprintf(collectFileScript, QuoteGroovy(strings.Join(step.TestReports, ",")), "TEST_REPORTS"))
+	}
+	if step.CoverageReport != "" {
+		b.WriteString(fmt.Sprintf(collectFileScript, QuoteGroovy(step.CoverageReport), "COVERAGE_REPORT"))
+	}
+	return b.String()
+}
+
+//checkoutSpec gets the branch spec and the refspec of the git plugin to check out a commit SHA or a full ref,
+//the default refspec fetching branches is kept so commits on branches can be checked out
+func checkoutSpec(ref string) (string, string) {
+	if !strings.HasPrefix(ref, "refs/") {
+		return ref, ""
+	}
+	defaultRefspec := "+refs/heads/*:refs/remotes/origin/*"
+	if strings.HasPrefix(ref, "refs/tags/") {
+		return ref, fmt.Sprintf("%s +%s:%s", defaultRefspec, ref, ref)
+	}
+	remoteRef := "refs/remotes/origin/" + strings.TrimPrefix(ref, "refs/")
+	return remoteRef, fmt.Sprintf("%s +%s:%s", defaultRefspec, ref, remoteRef)
+}
+
 func (j JenkinsProvider) Reset() error {
 	//TODO cleanup
 	return nil
@@ -467,146 +501,72 @@ func commandBuilder(activity *model.Activity, step *model.Step) string {
 	stringBuilder.WriteString("set +x \n")
 	switch step.Type {
 	case model.StepTypeTask:
-
-		envVars := ""
-		if len(step.Env) > 0 {
-			for _, para := range step.Env {
-				envVars += fmt.Sprintf("-e %s ", QuoteShell(para))
-			}
-		}
-
-		entrypointPara := ""
-		argsPara := ""
-		svcPara := ""
-		svcCheck := ""
-		labelPara := fmt.Sprintf("-l activityid=%s", activity.Id)
-		if step.ShellScript != "" {
-			entrypointPara = "--entrypoint /bin/sh"
-			entryFileName := fmt.Sprintf(".r_cicd_entrypoint_%s.sh", util.RandStringRunes(4))
-			argsPara = entryFileName
-
-			//write to a sh file,then docker run it
-			stringBuilder.WriteString(fmt.Sprintf("cat>%s<<R_CICD_EOF\n", entryFileName))
-			stringBuilder.WriteString("set -xe\n")
-			cmd := strings.Replace(step.ShellScript, "\\", "\\\\", -1)
-			cmd = strings.Replace(cmd, "$", "\\$", -1)
-			stringBuilder.WriteString(cmd)
-			stringBuilder.WriteString("\nR_CICD_EOF\n")
-		} else {
-			if step.Entrypoint != "" {
-				entrypointPara = "--entrypoint " + step.Entrypoint
-			}
-			argsPara = step.Args
-		}
-		stringBuilder.WriteString(". ${PWD}/.r_cicd.env\n")
-		//isService
-		if step.IsService {
-			containerName := activity.Id + step.Alias
-			svcPara = "-itd --name " + containerName
-			svcCheck = fmt.Sprintf("\necho 'run a service container with alias %s.'", step.Alias)
-			svcCheck = svcCheck + fmt.Sprintf("\nsleep 3;if [ \"$(docker inspect -f {{.State.Running}} %s)\" = \"false\" ];then docker logs \"%s\";echo \"Error: service container \\\"%s\\\" is stopped.\ncheck above logs or the task step config.\nA running container is expected when using \\\"as a service\\\" option.\";exit 1;fi", containerName, containerName, step.Alias)
-		}
-
-		//add link service
-		linkInfo := ""
-		if len(step.Services) > 0 {
-			linkInfo += ""
-			for _, svc := range step.Services {
-				linkInfo += fmt.Sprintf("--link %s:%s ", svc.ContainerName, svc.Name)
-			}
-
-		}
-
-		volumeInfo := "--volumes-from ${HOSTNAME} -w ${PWD}"
-		//volumeInfo := "-v /var/jenkins_home/workspace:/var/jenkins_home/workspace -w ${PWD}"
-		stringBuilder.WriteString("docker run --rm")
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString("--env-file ${PWD}/.r_cicd.env")
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString(envVars)
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString(labelPara)
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString(svcPara)
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString(volumeInfo)
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString(entrypointPara)
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString(linkInfo)
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString(step.Image)
-		stringBuilder.WriteString(" ")
-		stringBuilder.WriteString(argsPara)
-		stringBuilder.WriteString(svcCheck)
+		stringBuilder.WriteString(stepscript.TaskScript(step, &stepscript.TaskOptions{
+			ActivityId: activity.Id,
+			Workspace:  "--volumes-from ${HOSTNAME} -w ${PWD}",
+			Services:   step.Services,
+		}))
 	case model.StepTypeBuild:
-		stringBuilder.WriteString(". ${PWD}/.r_cicd.env\n")
-		if step.Dockerfile == "" {
-			buildPath := "."
-			if step.BuildPath != "" {
-				buildPath = step.BuildPath
-			}
-			dockerfilePath := "Dockerfile"
-			if step.DockerfilePath != "" {
-				dockerfilePath = step.DockerfilePath
-			}
-			stringBuilder.WriteString("set -xe\n")
-			stringBuilder.WriteString("docker build --tag ")
-			stringBuilder.WriteString(QuoteShell(step.TargetImage))
-			stringBuilder.WriteString(" ")
-			stringBuilder.WriteString("-f " + QuoteShell(dockerfilePath))
-			stringBuilder.WriteString(" ")
-			stringBuilder.WriteString(QuoteShell(buildPath))
-			stringBuilder.WriteString(";")
-		} else {
-			stringBuilder.WriteString("echo " + QuoteShell(step.Dockerfile) + ">.r_cicd_Dockerfile;\n")
-			stringBuilder.WriteString("set -xe\n")
-			stringBuilder.WriteString("docker build --tag ")
-			stringBuilder.WriteString(step.TargetImage)
-			stringBuilder.WriteString(" -f .r_cicd_Dockerfile .;")
-		}
+		pushCommand := ""
 		if step.PushFlag {
-			stringBuilder.WriteString("\ncihelper pushimage ")
-			stringBuilder.WriteString(step.TargetImage)
-			stringBuilder.WriteString(";")
+			pushCommand = "cihelper pushimage"
 		}
+		stringBuilder.WriteString(stepscript.BuildScript(step, pushCommand))
 	case model.StepTypeSCM:
+		previousCommit := activity.Pipeline.CommitInfo
+		if pr := activity.PullRequest; pr != nil {
+			//build the head of the pull request merged into the target branch, changed files are compared with the target branch
+			previousCommit = "refs/remotes/origin/" + pr.TargetBranch
+			stringBuilder.WriteString(fmt.Sprintf(mergeTargetScript, stepscript.Quote(previousCommit)))
+		}
 		//write to a env file that provides the environment variables to use throughout the activity.
-		stringBuilder.WriteString("GIT_BRANCH=$(echo $GIT_BRANCH|cut -d / -f 2)\n")
-		stringBuilder.WriteString("cat>.r_cicd.env<<R_CICD_EOF\n")
-		stringBuilder.WriteString("CICD_GIT_COMMIT=$GIT_COMMIT\n")
-		stringBuilder.WriteString("CICD_GIT_BRANCH=$GIT_BRANCH\n")
-		stringBuilder.WriteString("CICD_GIT_URL=$GIT_URL\n")
-		stringBuilder.WriteString("CICD_PIPELINE_NAME=" + activity.Pipeline.Name + "\n")
-		stringBuilder.WriteString("CICD_PIPELINE_ID=" + activity.Pipeline.Id + "\n")
-		stringBuilder.WriteString("CICD_TRIGGER_TYPE=" + activity.TriggerType + "\n")
-		stringBuilder.WriteString("CICD_NODE_NAME=" + activity.NodeName + "\n")
-		stringBuilder.WriteString("CICD_ACTIVITY_ID=" + activity.Id + "\n")
-		stringBuilder.WriteString("CICD_ACTIVITY_SEQUENCE=" + strconv.Itoa(activity.RunSequence) + "\n")
+		//the branch is taken from the step, GIT_BRANCH of jenkins is the checked out ref when a commit, tag or ref is built
+		vars := map[string]string{
+			"CICD_GIT_BRANCH":        step.Branch,
+			"CICD_GIT_TAG":           activity.GitTag,
+			"CICD_EVENT_TYPE":        activity.EventType,
+			"CICD_GIT_URL":           step.Repository,
+			"CICD_PIPELINE_NAME":     activity.Pipeline.Name,
+			"CICD_PIPELINE_ID":       activity.Pipeline.Id,
+			"CICD_TRIGGER_TYPE":      activity.TriggerType,
+			"CICD_NODE_NAME":         activity.NodeName,
+			"CICD_ACTIVITY_ID":       activity.Id,
+			"CICD_ACTIVITY_SEQUENCE": strconv.Itoa(activity.RunSequence),
+		}
+		keys := []string{"CICD_GIT_BRANCH", "CICD_GIT_TAG", "CICD_EVENT_TYPE"}
+		for _, k := range append(pullRequestEnvs, upstreamEnvs...) {
+			vars[k] = activity.EnvVars[k]
+			keys = append(keys, k)
+		}
+		keys = append(keys, "CICD_GIT_URL", "CICD_PIPELINE_NAME", "CICD_PIPELINE_ID", "CICD_TRIGGER_TYPE", "CICD_NODE_NAME", "CICD_ACTIVITY_ID", "CICD_ACTIVITY_SEQUENCE")
 		//user defined env vars
 		for _, envvar := range activity.Pipeline.Parameters {
 			splits := strings.SplitN(envvar, "=", 2)
 			if len(splits) != 2 {
 				continue
 			}
-			stringBuilder.WriteString(fmt.Sprintf("%s=%s\n", splits[0], QuoteShell(splits[1])))
+			if _, ok := vars[splits[0]]; !ok {
+				keys = append(keys, splits[0])
+			}
+			vars[splits[0]] = splits[1]
 		}
-		stringBuilder.WriteString("\nR_CICD_EOF\n")
+		//values are literal in the quoted here-document, the commit is known when the job runs
+		stringBuilder.WriteString("cat>.r_cicd.env<<'R_CICD_EOF'\n")
+		stringBuilder.WriteString(stepscript.EnvFileContent(keys, vars))
+		stringBuilder.WriteString("R_CICD_EOF\n")
+		stringBuilder.WriteString("echo \"CICD_GIT_COMMIT=$GIT_COMMIT\">>.r_cicd.env\n")
+		stringBuilder.WriteString(fmt.Sprintf(changedFilesScript, stepscript.Quote(previousCommit), changedFilesFile))
 
 	case model.StepTypeUpgradeService:
 		stringBuilder.WriteString(". ${PWD}/.r_cicd.env\n")
 		stringBuilder.WriteString("cihelper")
 		if step.Endpoint != "" {
 			stringBuilder.WriteString(" --envurl ")
-			stringBuilder.WriteString(QuoteShell(step.Endpoint))
+			stringBuilder.WriteString(stepscript.QuoteShell(step.Endpoint))
 			stringBuilder.WriteString(" --accesskey ")
-			stringBuilder.WriteString(QuoteShell(step.Accesskey))
+			stringBuilder.WriteString(stepscript.QuoteShell(step.Accesskey))
 			stringBuilder.WriteString(" --secretkey ")
-			envKey, err := service.GetEnvKey(step.Accesskey)
-			if err != nil {
-				logrus.Errorf("error get env credential:%v", err)
-			}
-			stringBuilder.WriteString(QuoteShell(envKey))
+			stringBuilder.WriteString(stepscript.QuoteShell(stepEnvKey(activity, step)))
 		} else {
 			//read from env var
 			stringBuilder.WriteString(" --envurl $CATTLE_URL")
@@ -620,7 +580,7 @@ func commandBuilder(activity *model.Activity, step *model.Step) string {
 		}
 		for k, v := range step.ServiceSelector {
 			stringBuilder.WriteString(" --selector ")
-			stringBuilder.WriteString(QuoteShell(fmt.Sprintf("%s=%s", k, v)))
+			stringBuilder.WriteString(stepscript.QuoteShell(fmt.Sprintf("%s=%s", k, v)))
 		}
 		if step.BatchSize > 0 {
 			stringBuilder.WriteString(" --batchsize ")
@@ -640,11 +600,7 @@ func commandBuilder(activity *model.Activity, step *model.Step) string {
 			script := fmt.Sprintf(upgradeStackScript, "$CATTLE_URL", "$CATTLE_ACCESS_KEY", "$CATTLE_SECRET_KEY", step.StackName, EscapeShell(activity, step.DockerCompose), EscapeShell(activity, step.RancherCompose))
 			stringBuilder.WriteString(script)
 		} else {
-			envKey, err := service.GetEnvKey(step.Accesskey)
-			if err != nil {
-				logrus.Errorf("error get env credential:%v", err)
-			}
-			script := fmt.Sprintf(upgradeStackScript, step.Endpoint, step.Accesskey, envKey, step.StackName, EscapeShell(activity, step.DockerCompose), EscapeShell(activity, step.RancherCompose))
+			script := fmt.Sprintf(upgradeStackScript, step.Endpoint, step.Accesskey, stepEnvKey(activity, step), step.StackName, EscapeShell(activity, step.DockerCompose), EscapeShell(activity, step.RancherCompose))
 			stringBuilder.WriteString(script)
 		}
 	case model.StepTypeUpgradeCatalog:
@@ -682,14 +638,10 @@ func commandBuilder(activity *model.Activity, step *model.Step) string {
 		var endpoint string
 		var accessKey string
 		var envKey string
-		var err error
 		if step.Endpoint != "" {
 			endpoint = step.Endpoint
 			accessKey = step.Accesskey
-			envKey, err = service.GetEnvKey(step.Accesskey)
-			if err != nil {
-				logrus.Errorf("error get env credential:%v", err)
-			}
+			envKey = stepEnvKey(activity, step)
 		} else {
 			endpoint = "$CATTLE_URL"
 			accessKey = "$CATTLE_ACCESS_KEY"
@@ -704,10 +656,27 @@ func commandBuilder(activity *model.Activity, step *model.Step) string {
 	return stringBuilder.String()
 }
 
+//stepEnvKey gets the secret key of the environment credential of a deploy step, it is masked in dry runs
+func stepEnvKey(activity *model.Activity, step *model.Step) string {
+	if activity.Id == planActivityId {
+		return planSecretKey
+	}
+	envKey, err := service.GetEnvKey(step.Accesskey)
+	if err != nil {
+		logrus.Errorf("error get env credential:%v", err)
+	}
+	return envKey
+}
+
+//DeployScript gets the shell script of a deploy step, it sources env vars from .r_cicd.env in the working directory
+func DeployScript(activity *model.Activity, step *model.Step) string {
+	return commandBuilder(activity, step)
+}
+
 func (j JenkinsProvider) SyncActivity(activity *model.Activity) error {
 	for i, actiStage := range activity.ActivityStages {
 		for j, actiStep := range actiStage.ActivitySteps {
-			if actiStep.Status == model.ActivityStepFail || actiStep.Status == model.ActivityStepSuccess {
+			if actiStep.Status == model.ActivityStepFail || actiStep.Status == model.ActivityStepSuccess || actiStep.Status == model.ActivityStepUnstable {
 				continue
 			}
 			jobName := getJobName(activity, i, j)
@@ -875,6 +844,7 @@ func (j JenkinsProvider) OnActivityCompelte(activity *model.Activity) {
 }
 
 func (j JenkinsProvider) OnCreateAccount(account *model.GitAccount) error {
+	var credential interface{}
 	jenkinsCred := &JenkinsCredential{}
 	jenkinsCred.Class = "com.cloudbees.plugins.credentials.impl.UsernamePasswordCredentialsImpl"
 	jenkinsCred.Scope = "GLOBAL"
@@ -885,11 +855,24 @@ func (j JenkinsProvider) OnCreateAccount(account *model.GitAccount) error {
 	} else if account.AccountType == "gitlab" {
 		jenkinsCred.Username = "oauth2"
 		jenkinsCred.Password = account.AccessToken
+	} else if account.AccountType == "bitbucketcloud" {
+		jenkinsCred.Username = "x-token-auth"
+		jenkinsCred.Password = account.AccessToken
+	} else if account.AccountType == "bitbucketserver" || account.AccountType == "gitea" {
+		jenkinsCred.Username = account.Login
+		jenkinsCred.Password = account.AccessToken
+	} else if account.AccountType == model.GitAccountType {
+		jenkinsCred.Username = account.Login
+		jenkinsCred.Password = account.AccessToken
 	} else {
 		return errors.New("unknown scmtype")
 	}
+	credential = jenkinsCred
+	if account.AccountType == model.GitAccountType && account.SSHKey != "" {
+		credential = gitSSHCredential(account)
+	}
 	bodyContent := map[string]interface{}{}
-	bodyContent["credentials"] = jenkinsCred
+	bodyContent["credentials"] = credential
 	b, err := json.Marshal(bodyContent)
 	if err != nil {
 		return err
@@ -902,6 +885,24 @@ func (j JenkinsProvider) OnCreateAccount(account *model.GitAccount) error {
 	return nil
 }
 
+//gitSSHCredential gets the ssh credential of a plain git account, the username is git if not set
+func gitSSHCredential(account *model.GitAccount) *JenkinsSSHCredential {
+	username := account.Login
+	if username == "" {
+		username = "git"
+	}
+	return &JenkinsSSHCredential{
+		Scope:    "GLOBAL",
+		Id:       account.Id,
+		Username: username,
+		PrivateKeySource: JenkinsPrivateKeySource{
+			PrivateKey:   account.SSHKey,
+			StaplerClass: "com.cloudbees.jenkins.plugins.sshcredentials.impl.BasicSSHUserPrivateKey$DirectEntryPrivateKeySource",
+		},
+		Class: "com.cloudbees.jenkins.plugins.sshcredentials.impl.BasicSSHUserPrivateKey",
+	}
+}
+
 func (j JenkinsProvider) OnDeleteAccount(account *model.GitAccount) error {
 	if account == nil {
 		return errors.New("nil account")
@@ -987,7 +988,7 @@ func parseSteps(actiStage *model.ActivityStage, rawOutput string) bool {
 	for i, step := range actiStage.ActivitySteps {
 		finishStepNum := len(outputs) - 1
 		prevStatus := step.Status
-		logrus.Debug("getting step %v", i)
+		logrus.Debugf("getting step %v", i)
 		if i < finishStepNum-1 {
 			//passed steps
 			step.Status = model.ActivityStepSuccess
@@ -1083,8 +1084,43 @@ func initActivityEnvvars(activity *model.Activity) {
 	vars["CICD_ACTIVITY_SEQUENCE"] = strconv.Itoa(activity.RunSequence)
 	vars["CICD_GIT_URL"] = p.Stages[0].Steps[0].Repository
 	vars["CICD_GIT_BRANCH"] = p.Stages[0].Steps[0].Branch
+	vars["CICD_GIT_TAG"] = activity.GitTag
+	vars["CICD_EVENT_TYPE"] = activity.EventType
+	for _, k := range pullRequestEnvs {
+		vars[k] = ""
+	}
+	if pr := activity.PullRequest; pr != nil {
+		vars["CICD_PR_NUMBER"] = strconv.Itoa(pr.Number)
+		vars["CICD_PR_SOURCE_BRANCH"] = pr.SourceBranch
+		vars["CICD_PR_TARGET_BRANCH"] = pr.TargetBranch
+		vars["CICD_PR_AUTHOR"] = pr.Author
+	}
+	for _, k := range upstreamEnvs {
+		vars[k] = ""
+	}
+	if upstream := activity.Upstream; upstream != nil {
+		vars["CICD_UPSTREAM_PIPELINE_NAME"] = upstream.PipelineName
+		vars["CICD_UPSTREAM_ACTIVITY_ID"] = upstream.ActivityId
+		vars["CICD_UPSTREAM_STATUS"] = upstream.Status
+		vars["CICD_UPSTREAM_COMMIT"] = upstream.Commit
+		vars["CICD_UPSTREAM_BRANCH"] = upstream.Branch
+	}
 	vars["CICD_GIT_COMMIT"] = activity.CommitInfo
 	vars["CICD_TRIGGER_TYPE"] = activity.TriggerType
+	//image vars are set when build steps finish, declare them so later steps can refer to them
+	for stageOrdinal, stage := range p.Stages {
+		for stepOrdinal, step := range stage.Steps {
+			if step.Type != model.StepTypeBuild {
+				continue
+			}
+			prefix := model.BuildImageVarPrefix(step, stageOrdinal, stepOrdinal)
+			vars[prefix+"_IMAGE_ID"] = ""
+			if step.PushFlag {
+				vars[prefix+"_DIGEST"] = ""
+				vars[prefix+"_IMAGE"] = ""
+			}
+		}
+	}
 	//user defined env vars
 	for _, envvar := range activity.Pipeline.Parameters {
 		splits := strings.SplitN(envvar, "=", 2)
@@ -1114,12 +1150,10 @@ func ToActivityStage(stage *model.Stage) *model.ActivityStage {
 
 }
 
-func QuoteShell(script string) string {
-	//Use double quotes so variable substitution works
-
-	escaped := strings.Replace(script, "\\", "\\\\", -1)
-	escaped = strings.Replace(script, "\"", "\\\"", -1)
-	escaped = "\"" + escaped + "\""
+//QuoteGroovy escapes text in a single-quoted groovy string
+func QuoteGroovy(text string) string {
+	escaped := strings.Replace(text, "\\", "\\\\", -1)
+	escaped = strings.Replace(escaped, "'", "\\'", -1)
 	return escaped
 }
 
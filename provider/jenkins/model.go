@@ -36,6 +36,7 @@ type JenkinsSCM struct {
 	ConfigVersion                     int    `xml:"configVersion"`
 	GitRepo                           string `xml:"userRemoteConfigs>hudson.plugins.git.UserRemoteConfig>url"`
 	GitCredentialId                   string `xml:"userRemoteConfigs>hudson.plugins.git.UserRemoteConfig>credentialsId"`
+	GitRefspec                        string `xml:"userRemoteConfigs>hudson.plugins.git.UserRemoteConfig>refspec,omitempty"`
 	GitBranch                         string `xml:"branches>hudson.plugins.git.BranchSpec>name"`
 	DoGenerateSubmoduleConfigurations bool   `xml:"doGenerateSubmoduleConfigurations"`
 	SubmodelCfg                       string `xml:"submoduleCfg,omitempty"`
@@ -267,3 +268,18 @@ type JenkinsCredential struct {
 	Description string `json:"description"`
 	Class       string `json:"$class"`
 }
+
+//JenkinsSSHCredential is a credential of ssh username with private key
+type JenkinsSSHCredential struct {
+	Scope            string                  `json:"scope"`
+	Id               string                  `json:"id"`
+	Username         string                  `json:"username"`
+	PrivateKeySource JenkinsPrivateKeySource `json:"privateKeySource"`
+	Description      string                  `json:"description"`
+	Class            string                  `json:"$class"`
+}
+
+type JenkinsPrivateKeySource struct {
+	PrivateKey   string `json:"privateKey"`
+	StaplerClass string `json:"stapler-class"`
+}
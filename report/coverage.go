@@ -0,0 +1,188 @@
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/pipeline/model"
+)
+
+type coberturaCoverage struct {
+	LineRate     float64 `xml:"line-rate,attr"`
+	LinesCovered int     `xml:"lines-covered,attr"`
+	LinesValid   int     `xml:"lines-valid,attr"`
+}
+
+//ParseCoverageReport parses a Cobertura XML, Go cover profile or lcov report
+func ParseCoverageReport(data []byte) (*model.Coverage, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return parseCobertura(trimmed)
+	case bytes.HasPrefix(trimmed, []byte("mode:")):
+		return parseGoCover(trimmed)
+	case bytes.Contains(trimmed, []byte("end_of_record")):
+		return parseLcov(trimmed)
+	}
+	return nil, errors.New("unknown coverage report format, expect Cobertura XML, Go cover profile or lcov")
+}
+
+//MergeCoverages sums up line counts of several reports,
+//percentages are averaged when line counts are not provided
+func MergeCoverages(coverages ...*model.Coverage) *model.Coverage {
+	merged := &model.Coverage{}
+	count := 0
+	percentSum := 0.0
+	hasLines := true
+	for _, c := range coverages {
+		if c == nil {
+			continue
+		}
+		count++
+		percentSum += c.Percent
+		if c.LinesValid == 0 {
+			hasLines = false
+		}
+		merged.LinesCovered += c.LinesCovered
+		merged.LinesValid += c.LinesValid
+	}
+	if count == 0 {
+		return nil
+	}
+	if hasLines {
+		merged.Percent = percent(merged.LinesCovered, merged.LinesValid)
+	} else {
+		merged.LinesCovered = 0
+		merged.LinesValid = 0
+		merged.Percent = round(percentSum / float64(count))
+	}
+	return merged
+}
+
+func parseCobertura(data []byte) (*model.Coverage, error) {
+	root, err := rootElement(data)
+	if err != nil {
+		return nil, err
+	}
+	if root != "coverage" {
+		return nil, errors.New("unknown coverage report format, expect Cobertura XML")
+	}
+	c := &coberturaCoverage{}
+	if err := xml.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.LinesValid > 0 {
+		return &model.Coverage{
+			LinesCovered: c.LinesCovered,
+			LinesValid:   c.LinesValid,
+			Percent:      percent(c.LinesCovered, c.LinesValid),
+		}, nil
+	}
+	return &model.Coverage{Percent: round(c.LineRate * 100)}, nil
+}
+
+//Go cover profile lines are 'file:startLine.startCol,endLine.endCol numStmts count',
+//the coverage is counted by statements like 'go tool cover'
+func parseGoCover(data []byte) (*model.Coverage, error) {
+	blocks := map[string]int{}
+	covered := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New("invalid Go cover profile line: " + line)
+		}
+		stmts, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, errors.New("invalid Go cover profile line: " + line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, errors.New("invalid Go cover profile line: " + line)
+		}
+		//merged profiles may contain the same block several times
+		blocks[fields[0]] = stmts
+		if count > 0 {
+			covered[fields[0]] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	result := &model.Coverage{}
+	for block, stmts := range blocks {
+		result.LinesValid += stmts
+		if covered[block] {
+			result.LinesCovered += stmts
+		}
+	}
+	result.Percent = percent(result.LinesCovered, result.LinesValid)
+	return result, nil
+}
+
+func parseLcov(data []byte) (*model.Coverage, error) {
+	result := &model.Coverage{}
+	found, hit := 0, 0
+	daFound, daHit := 0, 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "LF:"):
+			n, err := strconv.Atoi(line[3:])
+			if err != nil {
+				return nil, errors.New("invalid lcov line: " + line)
+			}
+			found += n
+		case strings.HasPrefix(line, "LH:"):
+			n, err := strconv.Atoi(line[3:])
+			if err != nil {
+				return nil, errors.New("invalid lcov line: " + line)
+			}
+			hit += n
+		case strings.HasPrefix(line, "DA:"):
+			parts := strings.Split(line[3:], ",")
+			if len(parts) < 2 {
+				return nil, errors.New("invalid lcov line: " + line)
+			}
+			daFound++
+			if parts[1] != "0" {
+				daHit++
+			}
+		case line == "end_of_record":
+			//summary lines are optional, fall back to line data of the record
+			if found == 0 {
+				found, hit = daFound, daHit
+			}
+			result.LinesValid += found
+			result.LinesCovered += hit
+			found, hit, daFound, daHit = 0, 0, 0, 0
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	result.Percent = percent(result.LinesCovered, result.LinesValid)
+	return result, nil
+}
+
+func percent(covered int, valid int) float64 {
+	if valid == 0 {
+		return 0
+	}
+	return round(float64(covered) * 100 / float64(valid))
+}
+
+//round to 2 decimal places
+func round(f float64) float64 {
+	return math.Floor(f*100+0.5) / 100
+}
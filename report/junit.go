@@ -0,0 +1,194 @@
+package report
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strings"
+
+	"github.com/rancher/pipeline/model"
+)
+
+//MaxRecordedFailures limits failing test names kept for a step
+const MaxRecordedFailures = 100
+
+type junitTestSuites struct {
+	Suites []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name   string           `xml:"name,attr"`
+	Suites []junitTestSuite `xml:"testsuite"`
+	Cases  []junitTestCase  `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *junitMessage `xml:"skipped"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+//xunit.net v2 format
+type xunitAssemblies struct {
+	Assemblies []xunitAssembly `xml:"assembly"`
+}
+
+type xunitAssembly struct {
+	Collections []xunitCollection `xml:"collection"`
+}
+
+type xunitCollection struct {
+	Tests []xunitTest `xml:"test"`
+}
+
+type xunitTest struct {
+	Name    string `xml:"name,attr"`
+	Type    string `xml:"type,attr"`
+	Result  string `xml:"result,attr"`
+	Failure struct {
+		Message string `xml:"message"`
+	} `xml:"failure"`
+}
+
+//ParseTestReport parses a JUnit or xUnit XML report
+func ParseTestReport(data []byte) (*model.TestResult, error) {
+	root, err := rootElement(data)
+	if err != nil {
+		return nil, err
+	}
+	result := &model.TestResult{}
+	switch root {
+	case "testsuites":
+		suites := &junitTestSuites{}
+		if err := xml.Unmarshal(data, suites); err != nil {
+			return nil, err
+		}
+		for _, suite := range suites.Suites {
+			addJUnitSuite(result, suite)
+		}
+	case "testsuite":
+		suite := junitTestSuite{}
+		if err := xml.Unmarshal(data, &suite); err != nil {
+			return nil, err
+		}
+		addJUnitSuite(result, suite)
+	case "assemblies":
+		assemblies := &xunitAssemblies{}
+		if err := xml.Unmarshal(data, assemblies); err != nil {
+			return nil, err
+		}
+		for _, assembly := range assemblies.Assemblies {
+			for _, collection := range assembly.Collections {
+				for _, test := range collection.Tests {
+					addXUnitTest(result, test)
+				}
+			}
+		}
+	case "assembly":
+		assembly := xunitAssembly{}
+		if err := xml.Unmarshal(data, &assembly); err != nil {
+			return nil, err
+		}
+		for _, collection := range assembly.Collections {
+			for _, test := range collection.Tests {
+				addXUnitTest(result, test)
+			}
+		}
+	default:
+		return nil, errors.New("unknown test report format, expect JUnit or xUnit XML")
+	}
+	return result, nil
+}
+
+//MergeTestResults sums up results of several reports
+func MergeTestResults(results ...*model.TestResult) *model.TestResult {
+	merged := &model.TestResult{}
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		merged.Total += r.Total
+		merged.Passed += r.Passed
+		merged.Failed += r.Failed
+		merged.Skipped += r.Skipped
+		for _, f := range r.Failures {
+			if len(merged.Failures) >= MaxRecordedFailures {
+				break
+			}
+			merged.Failures = append(merged.Failures, f)
+		}
+	}
+	return merged
+}
+
+func rootElement(data []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", errors.New("invalid XML test report")
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+func addJUnitSuite(result *model.TestResult, suite junitTestSuite) {
+	for _, nested := range suite.Suites {
+		addJUnitSuite(result, nested)
+	}
+	for _, c := range suite.Cases {
+		result.Total++
+		switch {
+		case c.Failure != nil:
+			addFailure(result, c.ClassName, c.Name, c.Failure.message())
+		case c.Error != nil:
+			addFailure(result, c.ClassName, c.Name, c.Error.message())
+		case c.Skipped != nil:
+			result.Skipped++
+		default:
+			result.Passed++
+		}
+	}
+}
+
+func addXUnitTest(result *model.TestResult, test xunitTest) {
+	result.Total++
+	switch strings.ToLower(test.Result) {
+	case "fail":
+		addFailure(result, test.Type, test.Name, test.Failure.Message)
+	case "skip":
+		result.Skipped++
+	default:
+		result.Passed++
+	}
+}
+
+func addFailure(result *model.TestResult, className string, name string, message string) {
+	result.Failed++
+	if len(result.Failures) >= MaxRecordedFailures {
+		return
+	}
+	result.Failures = append(result.Failures, &model.TestFailure{
+		ClassName: className,
+		Name:      name,
+		Message:   message,
+	})
+}
+
+func (m *junitMessage) message() string {
+	msg := m.Message
+	if msg == "" {
+		msg = strings.TrimSpace(m.Content)
+	}
+	//keep the first line only, full stacks stay in the log
+	return strings.SplitN(msg, "\n", 2)[0]
+}
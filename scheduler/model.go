@@ -8,13 +8,14 @@ import (
 )
 
 type CronRunner struct {
-	PipelineId string
-	Cron       *cron.Cron
-	Spec       string
-	Timezone   string
+	PipelineId   string
+	ScheduleName string
+	Cron         *cron.Cron
+	Spec         string
+	Timezone     string
 }
 
-func NewCronRunner(pipelineId string, spec string, timezone string) *CronRunner {
+func NewCronRunner(pipelineId string, scheduleName string, spec string, timezone string) *CronRunner {
 	//use Local as default
 	loc, err := time.LoadLocation(timezone)
 	if err != nil || timezone == "" || timezone == "Local" {
@@ -30,9 +31,11 @@ func NewCronRunner(pipelineId string, spec string, timezone string) *CronRunner
 
 	logrus.Debugf("cron timezone is %v", c.Location().String())
 	return &CronRunner{
-		PipelineId: pipelineId,
-		Spec:       "0 " + spec, //accept standard cron spec and convert to 6 entries for corn library
-		Cron:       c,
+		PipelineId:   pipelineId,
+		ScheduleName: scheduleName,
+		Spec:         "0 " + spec, //accept standard cron spec and convert to 6 entries for corn library
+		Timezone:     timezone,
+		Cron:         c,
 	}
 
 }
@@ -0,0 +1,117 @@
+package scm
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/util"
+)
+
+const (
+	bitbucketStateInProgress = "INPROGRESS"
+	bitbucketStateSuccessful = "SUCCESSFUL"
+	bitbucketStateFailed     = "FAILED"
+	bitbucketStateStopped    = "STOPPED"
+	//max length of build status keys
+	bitbucketMaxKeyLength = 40
+)
+
+//bitbucketBuildStatus is the build status of a commit in both bitbucket cloud and server
+type bitbucketBuildStatus struct {
+	State       string `json:"state"`
+	Key         string `json:"key"`
+	Name        string `json:"name,omitempty"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+func getFromBitbucket(bitbucketAccessToken string, url string) (*http.Response, error) {
+	return requestBitbucket(bitbucketAccessToken, http.MethodGet, url, nil)
+}
+
+//requestBitbucket sends a request with the json body if it is not nil, status codes other than 2xx are returned as error
+func requestBitbucket(bitbucketAccessToken string, method string, url string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.Header.Add("Authorization", "Bearer "+bitbucketAccessToken)
+	req.Header.Add("Accept", "application/json")
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		logrus.Errorf("Received error from bitbucket: %v", err)
+		return resp, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		io.Copy(&body, resp.Body)
+		return resp, fmt.Errorf("Request failed, got status code: %d. Response: %s",
+			resp.StatusCode, body.Bytes())
+	}
+	return resp, nil
+}
+
+//decodeBitbucket decodes the json body of the response and closes it
+func decodeBitbucket(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+//bitbucketBuildStatusOf converts the commit status, the key is hashed if it is too long
+func bitbucketBuildStatusOf(status *model.CommitStatus, canceledState string) *bitbucketBuildStatus {
+	state := bitbucketStateInProgress
+	switch status.State {
+	case model.CommitStateSuccess:
+		state = bitbucketStateSuccessful
+	case model.CommitStateFailure:
+		state = bitbucketStateFailed
+	case model.CommitStateCanceled:
+		state = canceledState
+	}
+	key := status.Context
+	if len(key) > bitbucketMaxKeyLength {
+		sum := sha1.Sum([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	return &bitbucketBuildStatus{
+		State:       state,
+		Key:         key,
+		Name:        status.Context,
+		URL:         status.TargetURL,
+		Description: status.Description,
+	}
+}
+
+func VerifyBitbucketWebhookSignature(secret []byte, signature string, body []byte) bool {
+	const signaturePrefix = "sha256="
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	return util.VerifyHMACSHA256(secret, strings.TrimPrefix(signature, signaturePrefix), body)
+}
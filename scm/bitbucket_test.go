@@ -0,0 +1,457 @@
+package scm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rancher/pipeline/model"
+)
+
+//newTestPipeline gets a pipeline whose SCM step builds the branch of the repository by webhooks
+func newTestPipeline(repository string, branch string) *model.Pipeline {
+	p := &model.Pipeline{}
+	p.Id = "pipeline1"
+	p.WebHookToken = "webhook-token"
+	p.Stages = []*model.Stage{{
+		Name: "SCM",
+		Steps: []*model.Step{{
+			Type:       model.StepTypeSCM,
+			Repository: repository,
+			Branch:     branch,
+			Webhook:    true,
+		}},
+	}}
+	return p
+}
+
+//hmacSignature gets the hex HMAC-SHA256 signature of the body
+func hmacSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//checkBearer fails the request if it is not authorized by the token
+func checkBearer(t *testing.T, w http.ResponseWriter, r *http.Request, token string) bool {
+	if got := r.Header.Get("Authorization"); got != "Bearer "+token {
+		t.Errorf("%s %s: expected bearer token '%s', got authorization '%s'", r.Method, r.URL.Path, token, got)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func newBitbucketCloudTestManager(server *httptest.Server) BitbucketCloudManager {
+	return BitbucketCloudManager{
+		scheme:      "http://",
+		host:        strings.TrimPrefix(server.URL, "http://"),
+		apiEndpoint: server.URL + "/2.0",
+	}
+}
+
+func TestBitbucketCloudOAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/site/oauth2/access_token":
+			r.ParseForm()
+			if r.Form.Get("code") != "code1" || r.Form.Get("grant_type") != "authorization_code" {
+				t.Errorf("unexpected token request: %v", r.Form)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"token1","token_type":"bearer","refresh_token":"refresh1","expires_in":7200}`)
+		case "/2.0/user":
+			if !checkBearer(t, w, r, "token1") {
+				return
+			}
+			fmt.Fprint(w, `{"username":"alice","display_name":"Alice","links":{"avatar":{"href":"https://avatar/alice"},"html":{"href":"https://bitbucket.org/alice"}}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	account, err := newBitbucketCloudTestManager(server).OAuth("http://redirect", "client", "secret", "code1")
+	if err != nil {
+		t.Fatalf("OAuth: %v", err)
+	}
+	if account.Id != "bitbucketcloud:alice" || account.Login != "alice" || account.Name != "Alice" {
+		t.Errorf("unexpected account %+v", account)
+	}
+	if account.AccessToken != "token1" || account.RefreshToken != "refresh1" || account.TokenExpiry == 0 {
+		t.Errorf("tokens are not kept in the account: %+v", account)
+	}
+	if account.AvatarURL != "https://avatar/alice" || account.HTMLURL != "https://bitbucket.org/alice" {
+		t.Errorf("unexpected links of the account: %+v", account)
+	}
+}
+
+func TestBitbucketCloudGetReposPaginated(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2.0/user/permissions/repositories" || !checkBearer(t, w, r, "token1") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"next":"%s/2.0/user/permissions/repositories?page=2","values":[{"permission":"read","repository":{"full_name":"alice/read"}},{"permission":"write","repository":{"full_name":"alice/write"}}]}`, server.URL)
+			return
+		}
+		fmt.Fprint(w, `{"values":[{"permission":"admin","repository":{"full_name":"team/admin"}}]}`)
+	}))
+	defer server.Close()
+
+	m := newBitbucketCloudTestManager(server)
+	repos, err := m.GetRepos(&model.GitAccount{AccessToken: "token1"})
+	if err != nil {
+		t.Fatalf("GetRepos: %v", err)
+	}
+	expected := map[string]map[string]bool{
+		"alice/read":  {"pull": true},
+		"alice/write": {"pull": true, "push": true},
+		"team/admin":  {"pull": true, "push": true, "admin": true},
+	}
+	if len(repos) != len(expected) {
+		t.Fatalf("expected %d repos of both pages, got %d", len(expected), len(repos))
+	}
+	for _, repo := range repos {
+		name := strings.TrimSuffix(strings.TrimPrefix(repo.CloneURL, "http://"+m.host+"/"), ".git")
+		permissions, ok := expected[name]
+		if !ok {
+			t.Errorf("unexpected repo %s", repo.CloneURL)
+			continue
+		}
+		if fmt.Sprint(repo.Permissions) != fmt.Sprint(permissions) {
+			t.Errorf("repo %s: expected permissions %v, got %v", name, permissions, repo.Permissions)
+		}
+	}
+}
+
+func TestBitbucketCloudWebhook(t *testing.T) {
+	deleted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkBearer(t, w, r, "token1") {
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/2.0/repositories/alice/repo/hooks":
+			hook := &bitbucketCloudHook{}
+			if err := json.NewDecoder(r.Body).Decode(hook); err != nil {
+				t.Errorf("decode hook: %v", err)
+			}
+			if hook.URL != "http://ci/webhook?scm=bitbucketcloud&pipelineId=pipeline1&token=webhook-token" || !hook.Active {
+				t.Errorf("unexpected hook %+v", hook)
+			}
+			if strings.Join(hook.Events, ",") != "repo:push,pullrequest:created,pullrequest:updated" {
+				t.Errorf("unexpected events of the hook: %v", hook.Events)
+			}
+			fmt.Fprint(w, `{"uuid":"{hook-uuid}"}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/2.0/repositories/alice/repo/hooks/{hook-uuid}":
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := newBitbucketCloudTestManager(server)
+	p := newTestPipeline("https://bitbucket.org/alice/repo.git", "master")
+	if err := m.CreateWebhook(p, "token1", "http://ci/webhook?scm=bitbucketcloud"); err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+	if p.WebHookUUID != "{hook-uuid}" {
+		t.Errorf("expected webhook uuid to be kept, got '%s'", p.WebHookUUID)
+	}
+	if err := m.DeleteWebhook(p, "token1"); err != nil {
+		t.Fatalf("DeleteWebhook: %v", err)
+	}
+	if !deleted || p.WebHookUUID != "" {
+		t.Errorf("webhook is not deleted")
+	}
+}
+
+func newBitbucketCloudWebhookRequest(eventKey string, token string, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhook?scm=bitbucketcloud&pipelineId=pipeline1&token="+token, strings.NewReader(body))
+	req.Header.Set("X-Event-Key", eventKey)
+	return req
+}
+
+func TestBitbucketCloudVerifyWebhookPayload(t *testing.T) {
+	m := BitbucketCloudManager{}
+	p := newTestPipeline("https://bitbucket.org/alice/repo.git", "master")
+	p.Stages[0].Steps[0].PullRequests = true
+	push := `{"push":{"changes":[
+		{"new":{"type":"branch","name":"other","target":{"hash":"aaa"}},"old":{"type":"branch","name":"other","target":{"hash":"bbb"}}},
+		{"new":{"type":"branch","name":"master","target":{"hash":"ccc"}},"old":{"type":"branch","name":"master","target":{"hash":"ddd"}}}]}}`
+
+	if _, ok := m.VerifyWebhookPayload(p, newBitbucketCloudWebhookRequest("repo:push", "wrong", push)); ok {
+		t.Error("webhook with a wrong token should be rejected")
+	}
+	if _, ok := m.VerifyWebhookPayload(p, newBitbucketCloudWebhookRequest("repo:fork", "webhook-token", push)); ok {
+		t.Error("webhook of other events should be rejected")
+	}
+	event, ok := m.VerifyWebhookPayload(p, newBitbucketCloudWebhookRequest("repo:push", "webhook-token", push))
+	if !ok {
+		t.Fatal("push of the branch should be accepted")
+	}
+	if event.Type != model.WebhookEventPush || event.Ref != "refs/heads/master" || event.Before != "ddd" || event.After != "ccc" || !event.Truncated {
+		t.Errorf("unexpected push event %+v", event)
+	}
+
+	pullRequest := `{"pullrequest":{"id":3,"title":"fix","author":{"username":"bob"},
+		"source":{"branch":{"name":"fix"},"commit":{"hash":"eee"},"repository":{"full_name":"%s"}},
+		"destination":{"branch":{"name":"master"},"commit":{"hash":"fff"},"repository":{"full_name":"alice/repo"}}}}`
+	event, ok = m.VerifyWebhookPayload(p, newBitbucketCloudWebhookRequest("pullrequest:created", "webhook-token", fmt.Sprintf(pullRequest, "alice/repo")))
+	if !ok {
+		t.Fatal("pull request targeting the branch should be accepted")
+	}
+	pr := event.PullRequest
+	if event.Type != model.WebhookEventPullRequest || pr == nil || pr.Number != 3 || pr.Author != "bob" || pr.HeadCommit != "eee" || pr.Ref != "refs/heads/fix" {
+		t.Errorf("unexpected pull request event %+v", event)
+	}
+	if _, ok := m.VerifyWebhookPayload(p, newBitbucketCloudWebhookRequest("pullrequest:updated", "webhook-token", fmt.Sprintf(pullRequest, "bob/repo"))); ok {
+		t.Error("pull request from a fork should be skipped")
+	}
+	p.Stages[0].Steps[0].PullRequests = false
+	if _, ok := m.VerifyWebhookPayload(p, newBitbucketCloudWebhookRequest("pullrequest:created", "webhook-token", fmt.Sprintf(pullRequest, "alice/repo"))); ok {
+		t.Error("pull request should be skipped when pull request builds are not enabled")
+	}
+}
+
+func newBitbucketServerTestManager(server *httptest.Server) BitbucketServerManager {
+	return BitbucketServerManager{}.Config(&model.SCMSetting{
+		Scheme:   "http://",
+		HostName: strings.TrimPrefix(server.URL, "http://"),
+	}).(BitbucketServerManager)
+}
+
+func TestBitbucketServerOAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/oauth2/latest/token":
+			r.ParseForm()
+			if r.Form.Get("code") != "code1" || r.Form.Get("client_id") != "client" || r.Form.Get("client_secret") != "secret" {
+				t.Errorf("client credentials and the code should be in the form: %v", r.Form)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"token1","token_type":"Bearer","refresh_token":"refresh1","expires_in":3600}`)
+		case "/rest/api/1.0/application-properties":
+			if !checkBearer(t, w, r, "token1") {
+				return
+			}
+			w.Header().Set("X-AUSERNAME", "alice")
+			fmt.Fprint(w, `{"version":"7.0.0"}`)
+		case "/rest/api/1.0/users/alice":
+			if !checkBearer(t, w, r, "token1") {
+				return
+			}
+			fmt.Fprint(w, `{"name":"alice","slug":"alice","displayName":"Alice"}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := newBitbucketServerTestManager(server)
+	account, err := m.OAuth("http://redirect", "client", "secret", "code1")
+	if err != nil {
+		t.Fatalf("OAuth: %v", err)
+	}
+	if account.Id != "bitbucketserver:alice" || account.Login != "alice" || account.Name != "Alice" {
+		t.Errorf("unexpected account %+v", account)
+	}
+	if account.AccessToken != "token1" || account.RefreshToken != "refresh1" {
+		t.Errorf("tokens are not kept in the account: %+v", account)
+	}
+	if account.HTMLURL != server.URL+"/users/alice" {
+		t.Errorf("unexpected html url '%s'", account.HTMLURL)
+	}
+}
+
+func TestBitbucketServerGetReposPaginated(t *testing.T) {
+	repo := func(name string) string {
+		return fmt.Sprintf(`{"links":{"clone":[{"name":"ssh","href":"ssh://git@host/prj/%s.git"},{"name":"http","href":"http://alice@host/scm/prj/%s.git"}]}}`, name, name)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/api/1.0/repos" || !checkBearer(t, w, r, "token1") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("limit") != fmt.Sprint(bitbucketServerPageSize) {
+			t.Errorf("unexpected page size '%s'", query.Get("limit"))
+		}
+		switch query.Get("permission") + "/" + query.Get("start") {
+		case "REPO_READ/0":
+			fmt.Fprintf(w, `{"values":[%s,%s],"isLastPage":false,"nextPageStart":2}`, repo("read"), repo("write"))
+		case "REPO_READ/2":
+			fmt.Fprintf(w, `{"values":[%s],"isLastPage":true}`, repo("admin"))
+		case "REPO_WRITE/0":
+			fmt.Fprintf(w, `{"values":[%s,%s],"isLastPage":true}`, repo("write"), repo("admin"))
+		case "REPO_ADMIN/0":
+			fmt.Fprintf(w, `{"values":[%s],"isLastPage":true}`, repo("admin"))
+		default:
+			t.Errorf("unexpected query %v", query)
+			fmt.Fprint(w, `{"values":[],"isLastPage":true}`)
+		}
+	}))
+	defer server.Close()
+
+	repos, err := newBitbucketServerTestManager(server).GetRepos(&model.GitAccount{AccessToken: "token1"})
+	if err != nil {
+		t.Fatalf("GetRepos: %v", err)
+	}
+	expected := map[string]map[string]bool{
+		"http://host/scm/prj/read.git":  {"pull": true},
+		"http://host/scm/prj/write.git": {"pull": true, "push": true},
+		"http://host/scm/prj/admin.git": {"pull": true, "push": true, "admin": true},
+	}
+	if len(repos) != len(expected) {
+		t.Fatalf("expected %d repos, got %d", len(expected), len(repos))
+	}
+	for _, r := range repos {
+		permissions, ok := expected[r.CloneURL]
+		if !ok {
+			t.Errorf("unexpected repo %s, clone urls should be http without user info", r.CloneURL)
+			continue
+		}
+		if fmt.Sprint(r.Permissions) != fmt.Sprint(permissions) {
+			t.Errorf("repo %s: expected permissions %v, got %v", r.CloneURL, permissions, r.Permissions)
+		}
+	}
+}
+
+func TestBitbucketServerWebhook(t *testing.T) {
+	deleted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkBearer(t, w, r, "token1") {
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/rest/api/1.0/projects/PRJ/repos/repo/webhooks":
+			hook := &bitbucketServerHook{}
+			if err := json.NewDecoder(r.Body).Decode(hook); err != nil {
+				t.Errorf("decode hook: %v", err)
+			}
+			if hook.URL != "http://ci/webhook?scm=bitbucketserver&pipelineId=pipeline1" || !hook.Active {
+				t.Errorf("unexpected hook %+v", hook)
+			}
+			if hook.Configuration["secret"] != "webhook-token" {
+				t.Errorf("payloads should be signed by the webhook token, got configuration %v", hook.Configuration)
+			}
+			if strings.Join(hook.Events, ",") != "repo:refs_changed,pr:opened,pr:from_ref_updated" {
+				t.Errorf("unexpected events of the hook: %v", hook.Events)
+			}
+			fmt.Fprint(w, `{"id":7}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/rest/api/1.0/projects/PRJ/repos/repo/webhooks/7":
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := newBitbucketServerTestManager(server)
+	p := newTestPipeline("http://host/scm/PRJ/repo.git", "master")
+	if err := m.CreateWebhook(p, "token1", "http://ci/webhook?scm=bitbucketserver"); err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+	if p.WebHookId != 7 {
+		t.Errorf("expected webhook id 7, got %d", p.WebHookId)
+	}
+	if err := m.DeleteWebhook(p, "token1"); err != nil {
+		t.Fatalf("DeleteWebhook: %v", err)
+	}
+	if !deleted || p.WebHookId != 0 {
+		t.Errorf("webhook is not deleted")
+	}
+}
+
+func newBitbucketServerWebhookRequest(eventKey string, signature string, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhook?scm=bitbucketserver&pipelineId=pipeline1", bytes.NewBufferString(body))
+	req.Header.Set("X-Event-Key", eventKey)
+	if signature != "" {
+		req.Header.Set("X-Hub-Signature", signature)
+	}
+	return req
+}
+
+func TestBitbucketServerVerifyWebhookPayload(t *testing.T) {
+	m := BitbucketServerManager{}
+	p := newTestPipeline("http://host/scm/PRJ/repo.git", "master")
+	p.Stages[0].Steps[0].TagPatterns = []string{"v*"}
+	p.Stages[0].Steps[0].PullRequests = true
+	sign := func(body string) string {
+		return "sha256=" + hmacSignature(p.WebHookToken, []byte(body))
+	}
+	refsChanged := `{"changes":[
+		{"refId":"refs/heads/master","fromHash":"aaa","toHash":"0000000000000000000000000000000000000000","type":"DELETE"},
+		{"refId":"refs/tags/other","fromHash":"0000000000000000000000000000000000000000","toHash":"bbb","type":"ADD"},
+		{"refId":"refs/tags/v1.0","fromHash":"0000000000000000000000000000000000000000","toHash":"ccc","type":"ADD"}]}`
+
+	if _, ok := m.VerifyWebhookPayload(p, newBitbucketServerWebhookRequest("repo:refs_changed", "", refsChanged)); ok {
+		t.Error("webhook without a signature should be rejected")
+	}
+	if _, ok := m.VerifyWebhookPayload(p, newBitbucketServerWebhookRequest("repo:refs_changed", "sha256="+hmacSignature("wrong", []byte(refsChanged)), refsChanged)); ok {
+		t.Error("webhook with a wrong signature should be rejected")
+	}
+	event, ok := m.VerifyWebhookPayload(p, newBitbucketServerWebhookRequest("repo:refs_changed", sign(refsChanged), refsChanged))
+	if !ok {
+		t.Fatal("push of a matching tag should be accepted")
+	}
+	if event.Type != model.WebhookEventTag || event.Tag != "v1.0" || event.Ref != "refs/tags/v1.0" || event.After != "ccc" {
+		t.Errorf("unexpected tag event %+v", event)
+	}
+	deleteOnly := `{"changes":[{"refId":"refs/heads/master","fromHash":"aaa","toHash":"0000000000000000000000000000000000000000","type":"DELETE"}]}`
+	if _, ok := m.VerifyWebhookPayload(p, newBitbucketServerWebhookRequest("repo:refs_changed", sign(deleteOnly), deleteOnly)); ok {
+		t.Error("deleted branches should not trigger")
+	}
+
+	pullRequest := `{"pullRequest":{"id":5,"title":"fix","author":{"user":{"name":"bob"}},
+		"fromRef":{"id":"refs/heads/fix","displayId":"fix","latestCommit":"ddd","repository":{"id":%d}},
+		"toRef":{"id":"refs/heads/master","displayId":"master","latestCommit":"eee","repository":{"id":1}}}}`
+	body := fmt.Sprintf(pullRequest, 1)
+	event, ok = m.VerifyWebhookPayload(p, newBitbucketServerWebhookRequest("pr:opened", sign(body), body))
+	if !ok {
+		t.Fatal("pull request targeting the branch should be accepted")
+	}
+	pr := event.PullRequest
+	if event.Type != model.WebhookEventPullRequest || pr == nil || pr.Number != 5 || pr.Author != "bob" || pr.HeadCommit != "ddd" || pr.Ref != "refs/pull-requests/5/from" || pr.Fork {
+		t.Errorf("unexpected pull request event %+v", event)
+	}
+	body = fmt.Sprintf(pullRequest, 2)
+	event, ok = m.VerifyWebhookPayload(p, newBitbucketServerWebhookRequest("pr:from_ref_updated", sign(body), body))
+	if !ok || !event.PullRequest.Fork {
+		t.Error("pull request from another repository should be marked as a fork")
+	}
+}
+
+func TestVerifyBitbucketWebhookSignature(t *testing.T) {
+	body := []byte(`{"changes":[]}`)
+	signature := hmacSignature("secret", body)
+	if !VerifyBitbucketWebhookSignature([]byte("secret"), "sha256="+signature, body) {
+		t.Error("valid signature should be verified")
+	}
+	if VerifyBitbucketWebhookSignature([]byte("secret"), signature, body) {
+		t.Error("signature without the sha256= prefix should be rejected")
+	}
+	if VerifyBitbucketWebhookSignature([]byte("other"), "sha256="+signature, body) {
+		t.Error("signature of another secret should be rejected")
+	}
+	if VerifyBitbucketWebhookSignature([]byte("secret"), "sha256=zz", body) {
+		t.Error("malformed signature should be rejected")
+	}
+}
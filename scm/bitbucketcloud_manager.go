@@ -0,0 +1,483 @@
+package scm
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultBitbucketCloudAPI  = "https://api.bitbucket.org/2.0"
+	defaultBitbucketCloudHost = "bitbucket.org"
+	bitbucketCloudPageLen     = "100"
+)
+
+type BitbucketCloudManager struct {
+	scheme       string
+	host         string
+	apiEndpoint  string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+}
+
+type bitbucketCloudUser struct {
+	Username    string `json:"username,omitempty"`
+	Nickname    string `json:"nickname,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Links       struct {
+		Avatar bitbucketCloudLink `json:"avatar,omitempty"`
+		HTML   bitbucketCloudLink `json:"html,omitempty"`
+	} `json:"links,omitempty"`
+}
+
+type bitbucketCloudLink struct {
+	Href string `json:"href,omitempty"`
+}
+
+type bitbucketCloudRepository struct {
+	FullName string `json:"full_name,omitempty"`
+}
+
+//bitbucketCloudPage is a page of a paginated response, values are decoded by the caller
+type bitbucketCloudPage struct {
+	Next   string          `json:"next,omitempty"`
+	Values json.RawMessage `json:"values,omitempty"`
+}
+
+type bitbucketCloudRepositoryPermission struct {
+	Permission string                   `json:"permission,omitempty"`
+	Repository bitbucketCloudRepository `json:"repository,omitempty"`
+}
+
+type bitbucketCloudHook struct {
+	UUID        string   `json:"uuid,omitempty"`
+	Description string   `json:"description,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	Active      bool     `json:"active"`
+	Events      []string `json:"events,omitempty"`
+}
+
+type bitbucketCloudDiffStat struct {
+	Old *struct {
+		Path string `json:"path,omitempty"`
+	} `json:"old,omitempty"`
+	New *struct {
+		Path string `json:"path,omitempty"`
+	} `json:"new,omitempty"`
+}
+
+type bitbucketCloudRef struct {
+	//branch or tag
+	Type   string `json:"type,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Target struct {
+		Hash string `json:"hash,omitempty"`
+	} `json:"target,omitempty"`
+}
+
+type bitbucketCloudPushPayload struct {
+	Push struct {
+		Changes []struct {
+			New       *bitbucketCloudRef `json:"new,omitempty"`
+			Old       *bitbucketCloudRef `json:"old,omitempty"`
+			Closed    bool               `json:"closed,omitempty"`
+			Truncated bool               `json:"truncated,omitempty"`
+		} `json:"changes,omitempty"`
+	} `json:"push,omitempty"`
+}
+
+type bitbucketCloudPullRequestEndpoint struct {
+	Branch struct {
+		Name string `json:"name,omitempty"`
+	} `json:"branch,omitempty"`
+	Commit struct {
+		Hash string `json:"hash,omitempty"`
+	} `json:"commit,omitempty"`
+	Repository bitbucketCloudRepository `json:"repository,omitempty"`
+}
+
+type bitbucketCloudPullRequestPayload struct {
+	PullRequest *struct {
+		ID          int                               `json:"id,omitempty"`
+		Title       string                            `json:"title,omitempty"`
+		Author      bitbucketCloudUser                `json:"author,omitempty"`
+		Source      bitbucketCloudPullRequestEndpoint `json:"source,omitempty"`
+		Destination bitbucketCloudPullRequestEndpoint `json:"destination,omitempty"`
+	} `json:"pullrequest,omitempty"`
+}
+
+func (b BitbucketCloudManager) Config(setting *model.SCMSetting) model.SCManager {
+	b.scheme = "https://"
+	b.host = defaultBitbucketCloudHost
+	b.apiEndpoint = defaultBitbucketCloudAPI
+	b.clientID = setting.ClientID
+	b.clientSecret = setting.ClientSecret
+	b.redirectURL = setting.RedirectURL
+	return b
+}
+
+func (b BitbucketCloudManager) GetType() string {
+	return "bitbucketcloud"
+}
+
+func (b BitbucketCloudManager) oauthConfig(redirectURL string, clientID string, clientSecret string) *oauth2.Config {
+	return &oauth2.Config{
+		RedirectURL:  redirectURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  fmt.Sprintf("%s%s/site/oauth2/authorize", b.scheme, b.host),
+			TokenURL: fmt.Sprintf("%s%s/site/oauth2/access_token", b.scheme, b.host),
+		},
+	}
+}
+
+//OAuth gets the account by the code, scopes are set on the bitbucket oauth consumer
+func (b BitbucketCloudManager) OAuth(redirectURL string, clientID string, clientSecret string, code string) (*model.GitAccount, error) {
+	return oauthAccount(b.oauthConfig(redirectURL, clientID, clientSecret), code, b.GetAccount)
+}
+
+//RefreshToken gets a new access token of the account, bitbucket cloud access tokens expire in two hours
+func (b BitbucketCloudManager) RefreshToken(account *model.GitAccount) error {
+	return refreshOAuthToken(b.oauthConfig(b.redirectURL, b.clientID, b.clientSecret), account)
+}
+
+func (b BitbucketCloudManager) GetAccount(accessToken string) (*model.GitAccount, error) {
+	resp, err := getFromBitbucket(accessToken, b.apiEndpoint+"/user")
+	if err != nil {
+		logrus.Errorf("Bitbucket GetAccount: received error from bitbucket, err: %v", err)
+		return nil, err
+	}
+	user := &bitbucketCloudUser{}
+	if err := decodeBitbucket(resp, user); err != nil {
+		return nil, err
+	}
+	login := user.Username
+	if login == "" {
+		login = user.Nickname
+	}
+	if login == "" {
+		return nil, errors.New("fail to get bitbucket user name")
+	}
+	account := &model.GitAccount{}
+	account.AccountType = b.GetType()
+	account.AccessToken = accessToken
+	account.AvatarURL = user.Links.Avatar.Href
+	account.HTMLURL = user.Links.HTML.Href
+	account.Id = b.GetType() + ":" + login
+	account.Login = login
+	account.Name = user.DisplayName
+	account.Private = false
+	return account, nil
+}
+
+func (b BitbucketCloudManager) GetRepos(account *model.GitAccount) ([]*model.GitRepository, error) {
+	if account == nil {
+		return nil, fmt.Errorf("empty account")
+	}
+	url := fmt.Sprintf("%s/user/permissions/repositories?pagelen=%s", b.apiEndpoint, bitbucketCloudPageLen)
+	var permissions []bitbucketCloudRepositoryPermission
+	for url != "" {
+		resp, err := getFromBitbucket(account.AccessToken, url)
+		if err != nil {
+			logrus.Errorf("Bitbucket GetRepos: GET url %v received error from bitbucket, err: %v", url, err)
+			return nil, err
+		}
+		page := &bitbucketCloudPage{}
+		if err := decodeBitbucket(resp, page); err != nil {
+			return nil, err
+		}
+		var values []bitbucketCloudRepositoryPermission
+		if err := json.Unmarshal(page.Values, &values); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, values...)
+		url = page.Next
+	}
+	result := []*model.GitRepository{}
+	for _, permission := range permissions {
+		r := &model.GitRepository{}
+		r.CloneURL = fmt.Sprintf("%s%s/%s.git", b.scheme, b.host, permission.Repository.FullName)
+		r.Permissions = map[string]bool{"pull": true}
+		if permission.Permission == "write" || permission.Permission == "admin" {
+			r.Permissions["push"] = true
+		}
+		if permission.Permission == "admin" {
+			r.Permissions["admin"] = true
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func (b BitbucketCloudManager) repoURL(p *model.Pipeline) (string, error) {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/repositories/%s/%s", b.apiEndpoint, url.PathEscape(user), url.PathEscape(repo)), nil
+}
+
+func (b BitbucketCloudManager) DeleteWebhook(p *model.Pipeline, token string) error {
+	logrus.Debugf("deletewebhook for pipeline:%v", p.Id)
+	if p == nil {
+		return errors.New("empty pipeline to delete webhook")
+	}
+
+	//delete webhook
+	if len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 {
+		if p.WebHookUUID != "" {
+			repoURL, err := b.repoURL(p)
+			if err != nil {
+				return nil
+			}
+			resp, err := requestBitbucket(token, http.MethodDelete, repoURL+"/hooks/"+url.PathEscape(p.WebHookUUID), nil)
+			if err != nil {
+				logrus.Errorf("error delete webhook,%v", err)
+				return err
+			}
+			resp.Body.Close()
+			p.WebHookUUID = ""
+		}
+	}
+	return nil
+}
+
+//CreateWebhook creates the webhook with the webhook token in its url,
+//as the payload is not signed
+func (b BitbucketCloudManager) CreateWebhook(p *model.Pipeline, token string, ciWebhookEndpoint string) error {
+	logrus.Debugf("createwebhook for pipeline:%v", p.Id)
+	if p == nil {
+		return errors.New("empty pipeline to create webhook")
+	}
+
+	//create webhook
+	if len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 {
+		if p.Stages[0].Steps[0].Webhook {
+			repoURL, err := b.repoURL(p)
+			if err != nil {
+				return nil
+			}
+			hook := &bitbucketCloudHook{
+				Description: "Rancher Pipeline",
+				URL:         fmt.Sprintf("%s&pipelineId=%s&token=%s", ciWebhookEndpoint, p.Id, url.QueryEscape(p.WebHookToken)),
+				Active:      true,
+				Events:      []string{"repo:push", "pullrequest:created", "pullrequest:updated"},
+			}
+			resp, err := requestBitbucket(token, http.MethodPost, repoURL+"/hooks", hook)
+			if err != nil {
+				logrus.Errorf("error create webhook,%v", err)
+				return err
+			}
+			created := &bitbucketCloudHook{}
+			if err := decodeBitbucket(resp, created); err != nil {
+				return err
+			}
+			p.WebHookUUID = created.UUID
+		}
+	}
+	return nil
+}
+
+func (b BitbucketCloudManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request) (*model.WebhookEvent, bool) {
+	eventKey := req.Header.Get("X-Event-Key")
+	if eventKey != "repo:push" && eventKey != "pullrequest:created" && eventKey != "pullrequest:updated" {
+		logrus.Errorf("receive bitbucket webhook,not push or pull request event")
+		return nil, false
+	}
+	if p == nil {
+		return nil, false
+	}
+	token := req.URL.Query().Get("token")
+	if p.WebHookToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.WebHookToken)) != 1 {
+		logrus.Errorf("receive bitbucket webhook, invalid token")
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logrus.Errorf("receive bitbucket webhook, got error:%v", err)
+		return nil, false
+	}
+	if eventKey != "repo:push" {
+		return bitbucketCloudPullRequestEvent(p, body)
+	}
+	payload := &bitbucketCloudPushPayload{}
+	if err := json.Unmarshal(body, payload); err != nil {
+		logrus.Error("fail to parse bitbucket webhook payload")
+		return nil, false
+	}
+	//a push may change several refs, take the one the pipeline triggers on
+	for _, change := range payload.Push.Changes {
+		if change.Closed || change.New == nil {
+			continue
+		}
+		ref := "refs/heads/" + change.New.Name
+		if change.New.Type == "tag" {
+			ref = "refs/tags/" + change.New.Name
+		}
+		eventType, tag, ok := refEvent(p.Stages[0].Steps[0], ref)
+		if !ok {
+			continue
+		}
+		event := &model.WebhookEvent{
+			Type:  eventType,
+			Tag:   tag,
+			Ref:   ref,
+			After: change.New.Target.Hash,
+			//changed files are not listed in the payload
+			Truncated: true,
+		}
+		if change.Old != nil {
+			event.Before = change.Old.Target.Hash
+		}
+		return event, true
+	}
+	logrus.Warningf("receive bitbucket webhook, no change of branch %v or matching tags", p.Stages[0].Steps[0].Branch)
+	return nil, false
+}
+
+//bitbucketCloudPullRequestEvent gets the event of a created or updated pull request targeting the branch of the SCM step,
+//pull requests from forks are skipped as their commits are not in the repository
+func bitbucketCloudPullRequestEvent(p *model.Pipeline, body []byte) (*model.WebhookEvent, bool) {
+	scmStep := p.Stages[0].Steps[0]
+	if !scmStep.PullRequests {
+		logrus.Warningf("receive bitbucket pull request webhook, pull request builds are not enabled")
+		return nil, false
+	}
+	payload := &bitbucketCloudPullRequestPayload{}
+	if err := json.Unmarshal(body, payload); err != nil || payload.PullRequest == nil {
+		logrus.Error("fail to parse bitbucket pull request webhook payload")
+		return nil, false
+	}
+	pr := payload.PullRequest
+	if pr.Destination.Branch.Name != scmStep.Branch {
+		logrus.Warningf("receive bitbucket pull request webhook, target branch not match:%v,%v", pr.Destination.Branch.Name, scmStep.Branch)
+		return nil, false
+	}
+	if pr.Source.Repository.FullName != pr.Destination.Repository.FullName {
+		logrus.Warningf("receive bitbucket pull request webhook, skip pull request from fork '%s'", pr.Source.Repository.FullName)
+		return nil, false
+	}
+	author := pr.Author.Username
+	if author == "" {
+		author = pr.Author.Nickname
+	}
+	return &model.WebhookEvent{
+		Type: model.WebhookEventPullRequest,
+		PullRequest: &model.PullRequest{
+			Number:       pr.ID,
+			Title:        pr.Title,
+			Author:       author,
+			SourceBranch: pr.Source.Branch.Name,
+			TargetBranch: pr.Destination.Branch.Name,
+			HeadCommit:   pr.Source.Commit.Hash,
+			//bitbucket cloud has no pull request refs
+			Ref: "refs/heads/" + pr.Source.Branch.Name,
+		},
+	}, true
+}
+
+//GetChangedFiles gets files changed between two commits by diffstat API
+func (b BitbucketCloudManager) GetChangedFiles(p *model.Pipeline, token string, base string, head string) ([]string, error) {
+	repoURL, err := b.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/diffstat/%s..%s?pagelen=%s", repoURL, head, base, bitbucketCloudPageLen)
+	files := []string{}
+	for url != "" {
+		resp, err := getFromBitbucket(token, url)
+		if err != nil {
+			return nil, err
+		}
+		page := &bitbucketCloudPage{}
+		if err := decodeBitbucket(resp, page); err != nil {
+			return nil, err
+		}
+		var diffStats []bitbucketCloudDiffStat
+		if err := json.Unmarshal(page.Values, &diffStats); err != nil {
+			return nil, err
+		}
+		for _, diffStat := range diffStats {
+			if diffStat.New != nil {
+				files = append(files, diffStat.New.Path)
+			}
+			if diffStat.Old != nil && (diffStat.New == nil || diffStat.Old.Path != diffStat.New.Path) {
+				files = append(files, diffStat.Old.Path)
+			}
+		}
+		url = page.Next
+	}
+	return files, nil
+}
+
+//GetFileContent gets content of a file in the repository at the ref
+func (b BitbucketCloudManager) GetFileContent(p *model.Pipeline, token string, path string, ref string) ([]byte, error) {
+	repoURL, err := b.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	filePath := (&url.URL{Path: strings.TrimPrefix(path, "/")}).EscapedPath()
+	resp, err := getFromBitbucket(token, fmt.Sprintf("%s/src/%s/%s", repoURL, url.PathEscape(trimRefPrefix(ref)), filePath))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+//GetBranches gets names of branches in the repository by refs API
+func (b BitbucketCloudManager) GetBranches(p *model.Pipeline, token string) ([]string, error) {
+	repoURL, err := b.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/refs/branches?pagelen=%s", repoURL, bitbucketCloudPageLen)
+	branches := []string{}
+	for url != "" {
+		resp, err := getFromBitbucket(token, url)
+		if err != nil {
+			return nil, err
+		}
+		page := &bitbucketCloudPage{}
+		if err := decodeBitbucket(resp, page); err != nil {
+			return nil, err
+		}
+		var refs []struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(page.Values, &refs); err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			branches = append(branches, ref.Name)
+		}
+		url = page.Next
+	}
+	return branches, nil
+}
+
+//CreateCommitStatus posts the build status of a commit
+func (b BitbucketCloudManager) CreateCommitStatus(p *model.Pipeline, token string, commit string, status *model.CommitStatus) error {
+	repoURL, err := b.repoURL(p)
+	if err != nil {
+		return err
+	}
+	buildStatus := bitbucketBuildStatusOf(status, bitbucketStateStopped)
+	resp, err := requestBitbucket(token, http.MethodPost, fmt.Sprintf("%s/commit/%s/statuses/build", repoURL, commit), buildStatus)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,496 @@
+package scm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"golang.org/x/oauth2"
+)
+
+const (
+	bitbucketServerAPI      = "%s%s/rest/api/1.0"
+	bitbucketServerPageSize = 100
+)
+
+type BitbucketServerManager struct {
+	scheme       string
+	host         string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+}
+
+type bitbucketServerUser struct {
+	Name        string `json:"name,omitempty"`
+	Slug        string `json:"slug,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+//bitbucketServerPage is a page of a paginated response, values are decoded by the caller
+type bitbucketServerPage struct {
+	Values        json.RawMessage `json:"values,omitempty"`
+	IsLastPage    bool            `json:"isLastPage"`
+	NextPageStart int             `json:"nextPageStart,omitempty"`
+}
+
+type bitbucketServerRepository struct {
+	Links struct {
+		Clone []struct {
+			Name string `json:"name,omitempty"`
+			Href string `json:"href,omitempty"`
+		} `json:"clone,omitempty"`
+	} `json:"links,omitempty"`
+}
+
+type bitbucketServerHook struct {
+	ID            int               `json:"id,omitempty"`
+	Name          string            `json:"name,omitempty"`
+	URL           string            `json:"url,omitempty"`
+	Active        bool              `json:"active"`
+	Events        []string          `json:"events,omitempty"`
+	Configuration map[string]string `json:"configuration,omitempty"`
+}
+
+type bitbucketServerChange struct {
+	Path struct {
+		ToString string `json:"toString,omitempty"`
+	} `json:"path,omitempty"`
+	SrcPath *struct {
+		ToString string `json:"toString,omitempty"`
+	} `json:"srcPath,omitempty"`
+}
+
+type bitbucketServerRefsChangedPayload struct {
+	Changes []struct {
+		RefID    string `json:"refId,omitempty"`
+		FromHash string `json:"fromHash,omitempty"`
+		ToHash   string `json:"toHash,omitempty"`
+		//ADD, UPDATE or DELETE
+		Type string `json:"type,omitempty"`
+	} `json:"changes,omitempty"`
+}
+
+type bitbucketServerPullRequestRef struct {
+	ID           string `json:"id,omitempty"`
+	DisplayID    string `json:"displayId,omitempty"`
+	LatestCommit string `json:"latestCommit,omitempty"`
+	Repository   struct {
+		ID int `json:"id,omitempty"`
+	} `json:"repository,omitempty"`
+}
+
+type bitbucketServerPullRequestPayload struct {
+	PullRequest *struct {
+		ID     int    `json:"id,omitempty"`
+		Title  string `json:"title,omitempty"`
+		Author struct {
+			User bitbucketServerUser `json:"user,omitempty"`
+		} `json:"author,omitempty"`
+		FromRef bitbucketServerPullRequestRef `json:"fromRef,omitempty"`
+		ToRef   bitbucketServerPullRequestRef `json:"toRef,omitempty"`
+	} `json:"pullRequest,omitempty"`
+}
+
+func (b BitbucketServerManager) Config(setting *model.SCMSetting) model.SCManager {
+	if setting.Scheme != "" {
+		b.scheme = setting.Scheme
+	} else {
+		b.scheme = "https://"
+	}
+	b.host = setting.HostName
+	b.clientID = setting.ClientID
+	b.clientSecret = setting.ClientSecret
+	b.redirectURL = setting.RedirectURL
+	return b
+}
+
+func (b BitbucketServerManager) GetType() string {
+	return "bitbucketserver"
+}
+
+func (b BitbucketServerManager) apiEndpoint() string {
+	return fmt.Sprintf(bitbucketServerAPI, b.scheme, b.host)
+}
+
+func (b BitbucketServerManager) oauthConfig(redirectURL string, clientID string, clientSecret string) *oauth2.Config {
+	tokenURL := fmt.Sprintf("%s%s/rest/oauth2/latest/token", b.scheme, b.host)
+	//client credentials are sent in the form
+	oauth2.RegisterBrokenAuthHeaderProvider(tokenURL)
+	return &oauth2.Config{
+		RedirectURL:  redirectURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       []string{"REPO_ADMIN"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  fmt.Sprintf("%s%s/rest/oauth2/latest/authorize", b.scheme, b.host),
+			TokenURL: tokenURL,
+		},
+	}
+}
+
+//OAuth gets the account by the code of an incoming application link
+func (b BitbucketServerManager) OAuth(redirectURL string, clientID string, clientSecret string, code string) (*model.GitAccount, error) {
+	return oauthAccount(b.oauthConfig(redirectURL, clientID, clientSecret), code, b.GetAccount)
+}
+
+//RefreshToken gets a new access token of the account
+func (b BitbucketServerManager) RefreshToken(account *model.GitAccount) error {
+	return refreshOAuthToken(b.oauthConfig(b.redirectURL, b.clientID, b.clientSecret), account)
+}
+
+//GetAccount gets the account of the token, the user name is in the header of any authenticated response
+func (b BitbucketServerManager) GetAccount(accessToken string) (*model.GitAccount, error) {
+	resp, err := getFromBitbucket(accessToken, b.apiEndpoint()+"/application-properties")
+	if err != nil {
+		logrus.Errorf("Bitbucket GetAccount: received error from bitbucket, err: %v", err)
+		return nil, err
+	}
+	resp.Body.Close()
+	userName := resp.Header.Get("X-AUSERNAME")
+	if userName == "" {
+		return nil, errors.New("fail to get bitbucket user name")
+	}
+	resp, err = getFromBitbucket(accessToken, b.apiEndpoint()+"/users/"+url.PathEscape(userName))
+	if err != nil {
+		logrus.Errorf("Bitbucket GetAccount: received error from bitbucket, err: %v", err)
+		return nil, err
+	}
+	user := &bitbucketServerUser{}
+	if err := decodeBitbucket(resp, user); err != nil {
+		return nil, err
+	}
+	account := &model.GitAccount{}
+	account.AccountType = b.GetType()
+	account.AccessToken = accessToken
+	account.AvatarURL = fmt.Sprintf("%s%s/users/%s/avatar.png", b.scheme, b.host, user.Slug)
+	account.HTMLURL = fmt.Sprintf("%s%s/users/%s", b.scheme, b.host, user.Slug)
+	account.Id = b.GetType() + ":" + user.Name
+	account.Login = user.Name
+	account.Name = user.DisplayName
+	account.Private = false
+	return account, nil
+}
+
+//paginateBitbucketServer gets values of all pages, the url should have a query
+func paginateBitbucketServer(accessToken string, url string, handle func(json.RawMessage) error) error {
+	start := 0
+	for {
+		resp, err := getFromBitbucket(accessToken, fmt.Sprintf("%s&limit=%d&start=%d", url, bitbucketServerPageSize, start))
+		if err != nil {
+			return err
+		}
+		page := &bitbucketServerPage{}
+		if err := decodeBitbucket(resp, page); err != nil {
+			return err
+		}
+		if err := handle(page.Values); err != nil {
+			return err
+		}
+		if page.IsLastPage || page.NextPageStart <= start {
+			return nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+//GetRepos gets repositories the account can read, and checks write and admin permissions
+func (b BitbucketServerManager) GetRepos(account *model.GitAccount) ([]*model.GitRepository, error) {
+	if account == nil {
+		return nil, fmt.Errorf("empty account")
+	}
+	result := []*model.GitRepository{}
+	reposByURL := map[string]*model.GitRepository{}
+	permissions := []struct {
+		level string
+		name  string
+	}{
+		{"REPO_READ", "pull"},
+		{"REPO_WRITE", "push"},
+		{"REPO_ADMIN", "admin"},
+	}
+	for _, permission := range permissions {
+		url := fmt.Sprintf("%s/repos?permission=%s", b.apiEndpoint(), permission.level)
+		err := paginateBitbucketServer(account.AccessToken, url, func(values json.RawMessage) error {
+			var repos []bitbucketServerRepository
+			if err := json.Unmarshal(values, &repos); err != nil {
+				return err
+			}
+			for _, repo := range repos {
+				cloneURL := bitbucketServerCloneURL(repo)
+				if cloneURL == "" {
+					continue
+				}
+				r, ok := reposByURL[cloneURL]
+				if !ok {
+					r = &model.GitRepository{CloneURL: cloneURL, Permissions: map[string]bool{}}
+					reposByURL[cloneURL] = r
+					result = append(result, r)
+				}
+				r.Permissions[permission.name] = true
+			}
+			return nil
+		})
+		if err != nil {
+			logrus.Errorf("Bitbucket GetRepos: GET url %v received error from bitbucket, err: %v", url, err)
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+//bitbucketServerCloneURL gets the http clone url without user info
+func bitbucketServerCloneURL(repo bitbucketServerRepository) string {
+	for _, link := range repo.Links.Clone {
+		if link.Name != "http" {
+			continue
+		}
+		u, err := url.Parse(link.Href)
+		if err != nil {
+			return ""
+		}
+		u.User = nil
+		return u.String()
+	}
+	return ""
+}
+
+func (b BitbucketServerManager) repoURL(p *model.Pipeline) (string, error) {
+	project, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/projects/%s/repos/%s", b.apiEndpoint(), url.PathEscape(project), url.PathEscape(repo)), nil
+}
+
+func (b BitbucketServerManager) DeleteWebhook(p *model.Pipeline, token string) error {
+	logrus.Debugf("deletewebhook for pipeline:%v", p.Id)
+	if p == nil {
+		return errors.New("empty pipeline to delete webhook")
+	}
+
+	//delete webhook
+	if len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 {
+		if p.WebHookId > 0 {
+			repoURL, err := b.repoURL(p)
+			if err != nil {
+				return nil
+			}
+			resp, err := requestBitbucket(token, http.MethodDelete, fmt.Sprintf("%s/webhooks/%d", repoURL, p.WebHookId), nil)
+			if err != nil {
+				logrus.Errorf("error delete webhook,%v", err)
+				return err
+			}
+			resp.Body.Close()
+			p.WebHookId = 0
+		}
+	}
+	return nil
+}
+
+func (b BitbucketServerManager) CreateWebhook(p *model.Pipeline, token string, ciWebhookEndpoint string) error {
+	logrus.Debugf("createwebhook for pipeline:%v", p.Id)
+	if p == nil {
+		return errors.New("empty pipeline to create webhook")
+	}
+
+	//create webhook
+	if len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 {
+		if p.Stages[0].Steps[0].Webhook {
+			repoURL, err := b.repoURL(p)
+			if err != nil {
+				return nil
+			}
+			hook := &bitbucketServerHook{
+				Name:          "Rancher Pipeline",
+				URL:           fmt.Sprintf("%s&pipelineId=%s", ciWebhookEndpoint, p.Id),
+				Active:        true,
+				Events:        []string{"repo:refs_changed", "pr:opened", "pr:from_ref_updated"},
+				Configuration: map[string]string{"secret": p.WebHookToken},
+			}
+			resp, err := requestBitbucket(token, http.MethodPost, repoURL+"/webhooks", hook)
+			if err != nil {
+				logrus.Errorf("error create webhook,%v", err)
+				return err
+			}
+			created := &bitbucketServerHook{}
+			if err := decodeBitbucket(resp, created); err != nil {
+				return err
+			}
+			p.WebHookId = created.ID
+		}
+	}
+	return nil
+}
+
+func (b BitbucketServerManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request) (*model.WebhookEvent, bool) {
+	var signature string
+	eventKey := req.Header.Get("X-Event-Key")
+	if eventKey != "repo:refs_changed" && eventKey != "pr:opened" && eventKey != "pr:from_ref_updated" {
+		logrus.Errorf("receive bitbucket webhook,not push or pull request event")
+		return nil, false
+	}
+	if signature = req.Header.Get("X-Hub-Signature"); len(signature) == 0 {
+		logrus.Errorf("receive bitbucket webhook,no signature")
+		return nil, false
+	}
+	if p == nil {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logrus.Errorf("receive bitbucket webhook, got error:%v", err)
+		return nil, false
+	}
+	if match := VerifyBitbucketWebhookSignature([]byte(p.WebHookToken), signature, body); !match {
+		logrus.Errorf("receive bitbucket webhook, invalid signature")
+		return nil, false
+	}
+	if eventKey != "repo:refs_changed" {
+		return bitbucketServerPullRequestEvent(p, body)
+	}
+	payload := &bitbucketServerRefsChangedPayload{}
+	if err := json.Unmarshal(body, payload); err != nil {
+		logrus.Error("fail to parse bitbucket webhook payload")
+		return nil, false
+	}
+	//a push may change several refs, take the one the pipeline triggers on
+	for _, change := range payload.Changes {
+		if change.Type == "DELETE" || isDeletedRef(change.ToHash) {
+			continue
+		}
+		eventType, tag, ok := refEvent(p.Stages[0].Steps[0], change.RefID)
+		if !ok {
+			continue
+		}
+		return &model.WebhookEvent{
+			Type:   eventType,
+			Tag:    tag,
+			Ref:    change.RefID,
+			Before: change.FromHash,
+			After:  change.ToHash,
+			//changed files are not listed in the payload
+			Truncated: true,
+		}, true
+	}
+	logrus.Warningf("receive bitbucket webhook, no change of branch %v or matching tags", p.Stages[0].Steps[0].Branch)
+	return nil, false
+}
+
+//bitbucketServerPullRequestEvent gets the event of an opened or updated pull request targeting the branch of the SCM step
+func bitbucketServerPullRequestEvent(p *model.Pipeline, body []byte) (*model.WebhookEvent, bool) {
+	scmStep := p.Stages[0].Steps[0]
+	if !scmStep.PullRequests {
+		logrus.Warningf("receive bitbucket pull request webhook, pull request builds are not enabled")
+		return nil, false
+	}
+	payload := &bitbucketServerPullRequestPayload{}
+	if err := json.Unmarshal(body, payload); err != nil || payload.PullRequest == nil {
+		logrus.Error("fail to parse bitbucket pull request webhook payload")
+		return nil, false
+	}
+	pr := payload.PullRequest
+	if pr.ToRef.DisplayID != scmStep.Branch {
+		logrus.Warningf("receive bitbucket pull request webhook, target branch not match:%v,%v", pr.ToRef.DisplayID, scmStep.Branch)
+		return nil, false
+	}
+	return &model.WebhookEvent{
+		Type: model.WebhookEventPullRequest,
+		PullRequest: &model.PullRequest{
+			Number:       pr.ID,
+			Title:        pr.Title,
+			Author:       pr.Author.User.Name,
+			SourceBranch: pr.FromRef.DisplayID,
+			TargetBranch: pr.ToRef.DisplayID,
+			HeadCommit:   pr.FromRef.LatestCommit,
+			Ref:          fmt.Sprintf("refs/pull-requests/%d/from", pr.ID),
+			Fork:         pr.FromRef.Repository.ID != pr.ToRef.Repository.ID,
+		},
+	}, true
+}
+
+//GetChangedFiles gets files changed between two commits by compare API
+func (b BitbucketServerManager) GetChangedFiles(p *model.Pipeline, token string, base string, head string) ([]string, error) {
+	repoURL, err := b.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	url := fmt.Sprintf("%s/compare/changes?from=%s&to=%s", repoURL, url.QueryEscape(head), url.QueryEscape(base))
+	err = paginateBitbucketServer(token, url, func(values json.RawMessage) error {
+		var changes []bitbucketServerChange
+		if err := json.Unmarshal(values, &changes); err != nil {
+			return err
+		}
+		for _, change := range changes {
+			files = append(files, change.Path.ToString)
+			if change.SrcPath != nil && change.SrcPath.ToString != "" && change.SrcPath.ToString != change.Path.ToString {
+				files = append(files, change.SrcPath.ToString)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+//GetFileContent gets content of a file in the repository at the ref
+func (b BitbucketServerManager) GetFileContent(p *model.Pipeline, token string, path string, ref string) ([]byte, error) {
+	repoURL, err := b.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	filePath := (&url.URL{Path: strings.TrimPrefix(path, "/")}).EscapedPath()
+	resp, err := getFromBitbucket(token, fmt.Sprintf("%s/raw/%s?at=%s", repoURL, filePath, url.QueryEscape(ref)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+//GetBranches gets names of branches in the repository by branches API
+func (b BitbucketServerManager) GetBranches(p *model.Pipeline, token string) ([]string, error) {
+	repoURL, err := b.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	branches := []string{}
+	err = paginateBitbucketServer(token, repoURL+"/branches?orderBy=ALPHABETICAL", func(values json.RawMessage) error {
+		var refs []struct {
+			DisplayID string `json:"displayId"`
+		}
+		if err := json.Unmarshal(values, &refs); err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			branches = append(branches, ref.DisplayID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return branches, nil
+}
+
+//CreateCommitStatus posts the build status of a commit by build status API,
+//canceled runs are reported as failed
+func (b BitbucketServerManager) CreateCommitStatus(p *model.Pipeline, token string, commit string, status *model.CommitStatus) error {
+	buildStatus := bitbucketBuildStatusOf(status, bitbucketStateFailed)
+	APIURL := fmt.Sprintf("%s%s/rest/build-status/1.0/commits/%s", b.scheme, b.host, commit)
+	resp, err := requestBitbucket(token, http.MethodPost, APIURL, buildStatus)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,114 @@
+package scm
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rancher/pipeline/git"
+	"github.com/rancher/pipeline/model"
+)
+
+//GitManager accesses repositories on plain git servers using credentials of the account,
+//there is no api for repositories, webhooks or commit statuses, changes are found by polling
+type GitManager struct {
+	Account *model.GitAccount
+}
+
+var errGitNotSupported = errors.New("not supported by plain git servers")
+
+func (g GitManager) Config(setting *model.SCMSetting) model.SCManager {
+	return g
+}
+
+func (g GitManager) GetType() string {
+	return model.GitAccountType
+}
+
+func (g GitManager) OAuth(redirectURL string, clientID string, clientSecret string, code string) (*model.GitAccount, error) {
+	return nil, errGitNotSupported
+}
+
+func (g GitManager) GetAccount(accessToken string) (*model.GitAccount, error) {
+	return nil, errGitNotSupported
+}
+
+//GetRepos gets no repository, there is no way to list repositories of the account
+func (g GitManager) GetRepos(account *model.GitAccount) ([]*model.GitRepository, error) {
+	return []*model.GitRepository{}, nil
+}
+
+//DeleteWebhook does nothing, no webhook is created for plain git sources
+func (g GitManager) DeleteWebhook(p *model.Pipeline, token string) error {
+	return nil
+}
+
+//CreateWebhook does nothing, changes of plain git sources are polled instead
+func (g GitManager) CreateWebhook(p *model.Pipeline, token string, ciWebhookEndpoint string) error {
+	return nil
+}
+
+func (g GitManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request) (*model.WebhookEvent, bool) {
+	return nil, false
+}
+
+func (g GitManager) GetChangedFiles(p *model.Pipeline, token string, base string, head string) ([]string, error) {
+	return nil, errGitNotSupported
+}
+
+//GetFileContent fetches the ref of the repository to read the file
+func (g GitManager) GetFileContent(p *model.Pipeline, token string, path string, ref string) ([]byte, error) {
+	remote, env, cleanup, err := g.remote(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return git.FileContent(remote, ref, path, env...)
+}
+
+func (g GitManager) CreateCommitStatus(p *model.Pipeline, token string, commit string, status *model.CommitStatus) error {
+	return errGitNotSupported
+}
+
+//GetBranches lists branches of the repository by ls-remote
+func (g GitManager) GetBranches(p *model.Pipeline, token string) ([]string, error) {
+	remote, env, cleanup, err := g.remote(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return git.Branches(remote, env...)
+}
+
+//BranchHeadCommit gets the head commit of the branch in the repository
+func (g GitManager) BranchHeadCommit(repository string, branch string) (string, error) {
+	remote, env, cleanup, err := g.remote(repository)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	return git.BranchHeadCommit(remote, branch, env...)
+}
+
+//remote gets the url and environment for git to access the repository with the ssh key,
+//or the username and password of the account. Repositories are accessed anonymously without credentials.
+func (g GitManager) remote(repository string) (string, []string, func(), error) {
+	if g.Account == nil {
+		return "", nil, nil, errors.New("git account not provided")
+	}
+	if g.Account.SSHKey != "" {
+		env, cleanup, err := git.SSHCommandEnv(g.Account.SSHKey, g.Account.KnownHosts)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return repository, env, cleanup, nil
+	}
+	remote := repository
+	if g.Account.Login != "" && g.Account.AccessToken != "" {
+		var err error
+		remote, err = git.GetUserPasswordRepoUrl(repository, g.Account.Login, g.Account.AccessToken)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return remote, nil, func() {}, nil
+}
@@ -0,0 +1,556 @@
+package scm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/util"
+	"github.com/tomnomnom/linkheader"
+	"golang.org/x/oauth2"
+)
+
+//gitea api, also served by gogs
+const giteaAPI = "%s%s/api/v1"
+
+type GiteaManager struct {
+	scheme       string
+	host         string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+}
+
+type giteaUser struct {
+	Login     string `json:"login,omitempty"`
+	Username  string `json:"username,omitempty"`
+	FullName  string `json:"full_name,omitempty"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+}
+
+type giteaRepository struct {
+	CloneURL    string          `json:"clone_url,omitempty"`
+	Permissions map[string]bool `json:"permissions,omitempty"`
+}
+
+type giteaHook struct {
+	ID     int               `json:"id,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Config map[string]string `json:"config,omitempty"`
+	Events []string          `json:"events,omitempty"`
+	Active bool              `json:"active"`
+}
+
+type giteaCommitStatus struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context,omitempty"`
+}
+
+type giteaPushPayload struct {
+	Ref          string `json:"ref,omitempty"`
+	Before       string `json:"before,omitempty"`
+	After        string `json:"after,omitempty"`
+	TotalCommits int    `json:"total_commits,omitempty"`
+	Commits      []struct {
+		Added    []string `json:"added,omitempty"`
+		Removed  []string `json:"removed,omitempty"`
+		Modified []string `json:"modified,omitempty"`
+	} `json:"commits,omitempty"`
+}
+
+type giteaReleasePayload struct {
+	Action  string `json:"action,omitempty"`
+	Release *struct {
+		TagName string `json:"tag_name,omitempty"`
+	} `json:"release,omitempty"`
+}
+
+type giteaPullRequestPayload struct {
+	Action      string `json:"action,omitempty"`
+	Number      int    `json:"number,omitempty"`
+	PullRequest *struct {
+		Title string    `json:"title,omitempty"`
+		User  giteaUser `json:"user,omitempty"`
+		Head  struct {
+			Ref    string `json:"ref,omitempty"`
+			Sha    string `json:"sha,omitempty"`
+			RepoID int    `json:"repo_id,omitempty"`
+		} `json:"head,omitempty"`
+		Base struct {
+			Ref    string `json:"ref,omitempty"`
+			RepoID int    `json:"repo_id,omitempty"`
+		} `json:"base,omitempty"`
+	} `json:"pull_request,omitempty"`
+}
+
+type giteaCompare struct {
+	Commits []struct {
+		Files []struct {
+			Filename string `json:"filename,omitempty"`
+		} `json:"files,omitempty"`
+	} `json:"commits,omitempty"`
+}
+
+func (g GiteaManager) Config(setting *model.SCMSetting) model.SCManager {
+	if setting.Scheme != "" {
+		g.scheme = setting.Scheme
+	} else {
+		g.scheme = "https://"
+	}
+	g.host = setting.HostName
+	g.clientID = setting.ClientID
+	g.clientSecret = setting.ClientSecret
+	g.redirectURL = setting.RedirectURL
+	return g
+}
+
+func (g GiteaManager) GetType() string {
+	return "gitea"
+}
+
+func (g GiteaManager) apiEndpoint() string {
+	return fmt.Sprintf(giteaAPI, g.scheme, g.host)
+}
+
+func (g GiteaManager) oauthConfig(redirectURL string, clientID string, clientSecret string) *oauth2.Config {
+	return &oauth2.Config{
+		RedirectURL:  redirectURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  fmt.Sprintf("%s%s/login/oauth/authorize", g.scheme, g.host),
+			TokenURL: fmt.Sprintf("%s%s/login/oauth/access_token", g.scheme, g.host),
+		},
+	}
+}
+
+//OAuth gets the account by the code of a gitea oauth2 application, gogs does not support oauth2
+func (g GiteaManager) OAuth(redirectURL string, clientID string, clientSecret string, code string) (*model.GitAccount, error) {
+	return oauthAccount(g.oauthConfig(redirectURL, clientID, clientSecret), code, g.GetAccount)
+}
+
+//RefreshToken gets a new access token of the account, gitea access tokens expire in an hour by default
+func (g GiteaManager) RefreshToken(account *model.GitAccount) error {
+	return refreshOAuthToken(g.oauthConfig(g.redirectURL, g.clientID, g.clientSecret), account)
+}
+
+func (g GiteaManager) GetAccount(accessToken string) (*model.GitAccount, error) {
+	url := g.apiEndpoint() + "/user"
+	resp, err := requestGitea(accessToken, http.MethodGet, url, nil)
+	if err != nil {
+		logrus.Errorf("Gitea GetAccount: GET url %v received error from gitea, err: %v", url, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	user := &giteaUser{}
+	if err := json.NewDecoder(resp.Body).Decode(user); err != nil {
+		logrus.Errorf("Gitea GetAccount: error unmarshalling response, err: %v", err)
+		return nil, err
+	}
+	login := user.Login
+	if login == "" {
+		login = user.Username
+	}
+	account := &model.GitAccount{}
+	account.AccountType = g.GetType()
+	account.AccessToken = accessToken
+	account.AvatarURL = user.AvatarURL
+	account.HTMLURL = fmt.Sprintf("%s%s/%s", g.scheme, g.host, login)
+	account.Id = g.GetType() + ":" + login
+	account.Login = login
+	account.Name = user.FullName
+	account.Private = false
+	return account, nil
+}
+
+func (g GiteaManager) GetRepos(account *model.GitAccount) ([]*model.GitRepository, error) {
+	if account == nil {
+		return nil, fmt.Errorf("empty account")
+	}
+	result := []*model.GitRepository{}
+	//gitea paginates by link headers, gogs lists all repositories
+	nextURL := g.apiEndpoint() + "/user/repos?limit=50"
+	for nextURL != "" {
+		resp, err := requestGitea(account.AccessToken, http.MethodGet, nextURL, nil)
+		if err != nil {
+			logrus.Errorf("Gitea GetRepos: GET url %v received error from gitea, err: %v", nextURL, err)
+			return nil, err
+		}
+		var repos []giteaRepository
+		err = json.NewDecoder(resp.Body).Decode(&repos)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range repos {
+			result = append(result, &model.GitRepository{
+				CloneURL:    repo.CloneURL,
+				Permissions: repo.Permissions,
+			})
+		}
+		nextURL = nextGiteaPage(resp)
+	}
+	return result, nil
+}
+
+func nextGiteaPage(response *http.Response) string {
+	header := response.Header.Get("link")
+	if header != "" {
+		for _, link := range linkheader.Parse(header) {
+			if link.Rel == "next" {
+				return link.URL
+			}
+		}
+	}
+	return ""
+}
+
+//requestGitea sends a request with the json body if it is not nil, status codes other than 2xx are returned as error
+func requestGitea(accessToken string, method string, url string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.Header.Add("Authorization", "token "+accessToken)
+	req.Header.Add("Accept", "application/json")
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		logrus.Errorf("Received error from gitea: %v", err)
+		return resp, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		io.Copy(&body, resp.Body)
+		return resp, fmt.Errorf("Request failed, got status code: %d. Response: %s",
+			resp.StatusCode, body.Bytes())
+	}
+	return resp, nil
+}
+
+func (g GiteaManager) repoURL(p *model.Pipeline) (string, error) {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/repos/%s/%s", g.apiEndpoint(), url.PathEscape(user), url.PathEscape(repo)), nil
+}
+
+func (g GiteaManager) DeleteWebhook(p *model.Pipeline, token string) error {
+	logrus.Debugf("deletewebhook for pipeline:%v", p.Id)
+	if p == nil {
+		return errors.New("empty pipeline to delete webhook")
+	}
+
+	//delete webhook
+	if len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 {
+		if p.WebHookId > 0 {
+			repoURL, err := g.repoURL(p)
+			if err != nil {
+				return nil
+			}
+			resp, err := requestGitea(token, http.MethodDelete, fmt.Sprintf("%s/hooks/%d", repoURL, p.WebHookId), nil)
+			if err != nil {
+				logrus.Errorf("error delete webhook,%v", err)
+				return err
+			}
+			resp.Body.Close()
+			p.WebHookId = 0
+		}
+	}
+	return nil
+}
+
+//CreateWebhook creates a gogs type webhook, which is supported by both gitea and gogs
+func (g GiteaManager) CreateWebhook(p *model.Pipeline, token string, ciWebhookEndpoint string) error {
+	logrus.Debugf("createwebhook for pipeline:%v", p.Id)
+	if p == nil {
+		return errors.New("empty pipeline to create webhook")
+	}
+
+	//create webhook
+	if len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 {
+		if p.Stages[0].Steps[0].Webhook {
+			repoURL, err := g.repoURL(p)
+			if err != nil {
+				return nil
+			}
+			hook := &giteaHook{
+				Type: "gogs",
+				Config: map[string]string{
+					"url":          fmt.Sprintf("%s&pipelineId=%s", ciWebhookEndpoint, p.Id),
+					"content_type": "json",
+					"secret":       p.WebHookToken,
+				},
+				Events: []string{"push", "release", "pull_request"},
+				Active: true,
+			}
+			resp, err := requestGitea(token, http.MethodPost, repoURL+"/hooks", hook)
+			if err != nil {
+				logrus.Errorf("error create webhook,%v", err)
+				return err
+			}
+			defer resp.Body.Close()
+			created := &giteaHook{}
+			if err := json.NewDecoder(resp.Body).Decode(created); err != nil {
+				return err
+			}
+			p.WebHookId = created.ID
+		}
+	}
+	return nil
+}
+
+func (g GiteaManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request) (*model.WebhookEvent, bool) {
+	signature := req.Header.Get("X-Gitea-Signature")
+	if signature == "" {
+		signature = req.Header.Get("X-Gogs-Signature")
+	}
+	eventType := req.Header.Get("X-Gitea-Event")
+	if eventType == "" {
+		eventType = req.Header.Get("X-Gogs-Event")
+	}
+	if signature == "" {
+		logrus.Errorf("receive gitea webhook,no signature")
+		return nil, false
+	}
+	if eventType != "push" && eventType != "release" && eventType != "pull_request" {
+		logrus.Errorf("receive gitea webhook,not push, release or pull request event")
+		return nil, false
+	}
+	if p == nil {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logrus.Errorf("receive gitea webhook, got error:%v", err)
+		return nil, false
+	}
+	if match := VerifyGiteaWebhookSignature([]byte(p.WebHookToken), signature, body); !match {
+		logrus.Errorf("receive gitea webhook, invalid signature")
+		return nil, false
+	}
+	if eventType == "release" {
+		return giteaReleaseEvent(p, body)
+	}
+	if eventType == "pull_request" {
+		return giteaPullRequestEvent(p, body)
+	}
+	//check branch or tag
+	payload := &giteaPushPayload{}
+	if err := json.Unmarshal(body, payload); err != nil {
+		logrus.Error("fail to parse gitea webhook payload")
+		return nil, false
+	}
+	eventType, tag, ok := refEvent(p.Stages[0].Steps[0], payload.Ref)
+	if !ok {
+		logrus.Warningf("branch not match:%v,%v", payload.Ref, p.Stages[0].Steps[0].Branch)
+		return nil, false
+	}
+	if isDeletedRef(payload.After) {
+		logrus.Debugf("receive gitea webhook, ref %v is deleted", payload.Ref)
+		return nil, false
+	}
+	event := &model.WebhookEvent{
+		Type:   eventType,
+		Tag:    tag,
+		Ref:    payload.Ref,
+		Before: payload.Before,
+		After:  payload.After,
+		//the number of commits in a push payload is limited
+		Truncated: payload.TotalCommits > len(payload.Commits),
+	}
+	for _, commit := range payload.Commits {
+		event.ChangedFiles = append(event.ChangedFiles, commit.Added...)
+		event.ChangedFiles = append(event.ChangedFiles, commit.Modified...)
+		event.ChangedFiles = append(event.ChangedFiles, commit.Removed...)
+	}
+	return event, true
+}
+
+//giteaReleaseEvent gets the event of a published release if the SCM step triggers on release events
+func giteaReleaseEvent(p *model.Pipeline, body []byte) (*model.WebhookEvent, bool) {
+	if !p.Stages[0].Steps[0].ReleaseEvents {
+		logrus.Warningf("receive gitea release webhook, release events are not enabled")
+		return nil, false
+	}
+	payload := &giteaReleasePayload{}
+	if err := json.Unmarshal(body, payload); err != nil || payload.Release == nil {
+		logrus.Error("fail to parse gitea release webhook payload")
+		return nil, false
+	}
+	if payload.Action != "published" {
+		logrus.Debugf("receive gitea release webhook, skip '%s' action", payload.Action)
+		return nil, false
+	}
+	if !matchReleaseTag(p.Stages[0].Steps[0], payload.Release.TagName) {
+		logrus.Debugf("receive gitea release webhook, skip tag '%s' not matching tag patterns", payload.Release.TagName)
+		return nil, false
+	}
+	return &model.WebhookEvent{
+		Type: model.WebhookEventRelease,
+		Tag:  payload.Release.TagName,
+		Ref:  "refs/tags/" + payload.Release.TagName,
+	}, true
+}
+
+//giteaPullRequestEvent gets the event of an opened, synchronized or reopened pull request targeting the branch of the SCM step
+func giteaPullRequestEvent(p *model.Pipeline, body []byte) (*model.WebhookEvent, bool) {
+	scmStep := p.Stages[0].Steps[0]
+	if !scmStep.PullRequests {
+		logrus.Warningf("receive gitea pull request webhook, pull request builds are not enabled")
+		return nil, false
+	}
+	payload := &giteaPullRequestPayload{}
+	if err := json.Unmarshal(body, payload); err != nil || payload.PullRequest == nil {
+		logrus.Error("fail to parse gitea pull request webhook payload")
+		return nil, false
+	}
+	if payload.Action != "opened" && payload.Action != "synchronized" && payload.Action != "reopened" {
+		logrus.Debugf("receive gitea pull request webhook, skip '%s' action", payload.Action)
+		return nil, false
+	}
+	pr := payload.PullRequest
+	if pr.Base.Ref != scmStep.Branch {
+		logrus.Warningf("receive gitea pull request webhook, target branch not match:%v,%v", pr.Base.Ref, scmStep.Branch)
+		return nil, false
+	}
+	author := pr.User.Login
+	if author == "" {
+		author = pr.User.Username
+	}
+	return &model.WebhookEvent{
+		Type: model.WebhookEventPullRequest,
+		PullRequest: &model.PullRequest{
+			Number:       payload.Number,
+			Title:        pr.Title,
+			Author:       author,
+			SourceBranch: pr.Head.Ref,
+			TargetBranch: pr.Base.Ref,
+			HeadCommit:   pr.Head.Sha,
+			Ref:          fmt.Sprintf("refs/pull/%d/head", payload.Number),
+			//pull requests without repository ids are taken as from forks
+			Fork: pr.Head.RepoID == 0 || pr.Head.RepoID != pr.Base.RepoID,
+		},
+	}, true
+}
+
+//GetChangedFiles gets files changed between two commits by compare API, which is not supported by gogs
+func (g GiteaManager) GetChangedFiles(p *model.Pipeline, token string, base string, head string) ([]string, error) {
+	repoURL, err := g.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := requestGitea(token, http.MethodGet, fmt.Sprintf("%s/compare/%s...%s", repoURL, base, head), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	comparison := &giteaCompare{}
+	if err := json.NewDecoder(resp.Body).Decode(comparison); err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, commit := range comparison.Commits {
+		for _, file := range commit.Files {
+			files = append(files, file.Filename)
+		}
+	}
+	return files, nil
+}
+
+//GetFileContent gets content of a file in the repository at the ref
+func (g GiteaManager) GetFileContent(p *model.Pipeline, token string, path string, ref string) ([]byte, error) {
+	repoURL, err := g.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	filePath := (&url.URL{Path: strings.TrimPrefix(path, "/")}).EscapedPath()
+	resp, err := requestGitea(token, http.MethodGet, fmt.Sprintf("%s/raw/%s?ref=%s", repoURL, filePath, url.QueryEscape(trimRefPrefix(ref))), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+//GetBranches gets names of branches in the repository by branches API
+func (g GiteaManager) GetBranches(p *model.Pipeline, token string) ([]string, error) {
+	repoURL, err := g.repoURL(p)
+	if err != nil {
+		return nil, err
+	}
+	branches := []string{}
+	nextURL := repoURL + "/branches?limit=50"
+	for nextURL != "" {
+		resp, err := requestGitea(token, http.MethodGet, nextURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		var refs []struct {
+			Name string `json:"name"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&refs)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			branches = append(branches, ref.Name)
+		}
+		nextURL = nextGiteaPage(resp)
+	}
+	return branches, nil
+}
+
+//CreateCommitStatus posts the status of a commit by statuses API
+func (g GiteaManager) CreateCommitStatus(p *model.Pipeline, token string, commit string, status *model.CommitStatus) error {
+	repoURL, err := g.repoURL(p)
+	if err != nil {
+		return err
+	}
+	state := status.State
+	if state == model.CommitStateCanceled {
+		//gitea has no canceled state
+		state = "error"
+	}
+	commitStatus := &giteaCommitStatus{
+		State:       state,
+		TargetURL:   status.TargetURL,
+		Description: status.Description,
+		Context:     status.Context,
+	}
+	resp, err := requestGitea(token, http.MethodPost, fmt.Sprintf("%s/statuses/%s", repoURL, commit), commitStatus)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//VerifyGiteaWebhookSignature checks the hex encoded HMAC-SHA256 signature of gitea and gogs
+func VerifyGiteaWebhookSignature(secret []byte, signature string, body []byte) bool {
+	return util.VerifyHMACSHA256(secret, signature, body)
+}
@@ -0,0 +1,274 @@
+package scm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rancher/pipeline/model"
+)
+
+//checkGiteaToken fails the request if it is not authorized by the access token
+func checkGiteaToken(t *testing.T, w http.ResponseWriter, r *http.Request, token string) bool {
+	if got := r.Header.Get("Authorization"); got != "token "+token {
+		t.Errorf("%s %s: expected token '%s', got authorization '%s'", r.Method, r.URL.Path, token, got)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func newGiteaTestManager(server *httptest.Server) GiteaManager {
+	return GiteaManager{}.Config(&model.SCMSetting{
+		Scheme:   "http://",
+		HostName: strings.TrimPrefix(server.URL, "http://"),
+	}).(GiteaManager)
+}
+
+func TestGiteaOAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login/oauth/access_token":
+			r.ParseForm()
+			if r.Form.Get("code") != "code1" || r.Form.Get("grant_type") != "authorization_code" {
+				t.Errorf("unexpected token request: %v", r.Form)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"token1","token_type":"bearer","refresh_token":"refresh1","expires_in":3600}`)
+		case "/api/v1/user":
+			if !checkGiteaToken(t, w, r, "token1") {
+				return
+			}
+			fmt.Fprint(w, `{"login":"alice","full_name":"Alice","avatar_url":"http://avatar/alice"}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	account, err := newGiteaTestManager(server).OAuth("http://redirect", "client", "secret", "code1")
+	if err != nil {
+		t.Fatalf("OAuth: %v", err)
+	}
+	if account.Id != "gitea:alice" || account.Login != "alice" || account.Name != "Alice" || account.AvatarURL != "http://avatar/alice" {
+		t.Errorf("unexpected account %+v", account)
+	}
+	if account.AccessToken != "token1" || account.RefreshToken != "refresh1" || account.TokenExpiry == 0 {
+		t.Errorf("tokens are not kept in the account: %+v", account)
+	}
+	if account.HTMLURL != server.URL+"/alice" {
+		t.Errorf("unexpected html url '%s'", account.HTMLURL)
+	}
+}
+
+func TestGiteaGetAccountOfGogs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/user" || !checkGiteaToken(t, w, r, "token1") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		//gogs names the login username
+		fmt.Fprint(w, `{"username":"bob","full_name":"Bob"}`)
+	}))
+	defer server.Close()
+
+	account, err := newGiteaTestManager(server).GetAccount("token1")
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	if account.Id != "gitea:bob" || account.Login != "bob" {
+		t.Errorf("unexpected account %+v", account)
+	}
+}
+
+func TestGiteaGetReposPaginated(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/user/repos" || !checkGiteaToken(t, w, r, "token1") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/user/repos?limit=50&page=2>; rel="next", <%s/api/v1/user/repos?limit=50&page=2>; rel="last"`, server.URL, server.URL))
+			fmt.Fprint(w, `[{"clone_url":"http://gitea/alice/a.git","permissions":{"admin":true,"push":true,"pull":true}}]`)
+			return
+		}
+		fmt.Fprint(w, `[{"clone_url":"http://gitea/team/b.git","permissions":{"admin":false,"push":false,"pull":true}}]`)
+	}))
+	defer server.Close()
+
+	repos, err := newGiteaTestManager(server).GetRepos(&model.GitAccount{AccessToken: "token1"})
+	if err != nil {
+		t.Fatalf("GetRepos: %v", err)
+	}
+	if len(repos) != 2 {
+		t.Fatalf("expected repos of both pages, got %d", len(repos))
+	}
+	if repos[0].CloneURL != "http://gitea/alice/a.git" || !repos[0].Permissions["admin"] {
+		t.Errorf("unexpected repo %+v", repos[0])
+	}
+	if repos[1].CloneURL != "http://gitea/team/b.git" || repos[1].Permissions["push"] || !repos[1].Permissions["pull"] {
+		t.Errorf("unexpected repo %+v", repos[1])
+	}
+}
+
+func TestGiteaWebhook(t *testing.T) {
+	deleted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkGiteaToken(t, w, r, "token1") {
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/repos/alice/repo/hooks":
+			hook := &giteaHook{}
+			if err := json.NewDecoder(r.Body).Decode(hook); err != nil {
+				t.Errorf("decode hook: %v", err)
+			}
+			if hook.Type != "gogs" || !hook.Active {
+				t.Errorf("expected an active gogs type hook, got %+v", hook)
+			}
+			if hook.Config["url"] != "http://ci/webhook?scm=gitea&pipelineId=pipeline1" || hook.Config["content_type"] != "json" {
+				t.Errorf("unexpected hook config %v", hook.Config)
+			}
+			if hook.Config["secret"] != "webhook-token" {
+				t.Errorf("payloads should be signed by the webhook token, got config %v", hook.Config)
+			}
+			if strings.Join(hook.Events, ",") != "push,release,pull_request" {
+				t.Errorf("unexpected events of the hook: %v", hook.Events)
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id":9}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/v1/repos/alice/repo/hooks/9":
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := newGiteaTestManager(server)
+	p := newTestPipeline("http://gitea/alice/repo.git", "master")
+	if err := m.CreateWebhook(p, "token1", "http://ci/webhook?scm=gitea"); err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+	if p.WebHookId != 9 {
+		t.Errorf("expected webhook id 9, got %d", p.WebHookId)
+	}
+	if err := m.DeleteWebhook(p, "token1"); err != nil {
+		t.Fatalf("DeleteWebhook: %v", err)
+	}
+	if !deleted || p.WebHookId != 0 {
+		t.Errorf("webhook is not deleted")
+	}
+}
+
+//newGiteaWebhookRequest gets a webhook request with gitea or gogs headers
+func newGiteaWebhookRequest(headerPrefix string, eventType string, signature string, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhook?scm=gitea&pipelineId=pipeline1", strings.NewReader(body))
+	req.Header.Set(headerPrefix+"-Event", eventType)
+	if signature != "" {
+		req.Header.Set(headerPrefix+"-Signature", signature)
+	}
+	return req
+}
+
+func TestGiteaVerifyWebhookPayload(t *testing.T) {
+	m := GiteaManager{}
+	p := newTestPipeline("http://gitea/alice/repo.git", "master")
+	step := p.Stages[0].Steps[0]
+	sign := func(body string) string {
+		return hmacSignature(p.WebHookToken, []byte(body))
+	}
+	push := `{"ref":"refs/heads/%s","before":"aaa","after":"%s","total_commits":2,"commits":[{"added":["a.go"],"modified":["b.go"],"removed":["c.go"]}]}`
+	body := fmt.Sprintf(push, "master", "bbb")
+
+	for _, prefix := range []string{"X-Gitea", "X-Gogs"} {
+		event, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest(prefix, "push", sign(body), body))
+		if !ok {
+			t.Fatalf("push of the branch with %s headers should be accepted", prefix)
+		}
+		if event.Type != model.WebhookEventPush || event.Ref != "refs/heads/master" || event.Before != "aaa" || event.After != "bbb" {
+			t.Errorf("unexpected push event %+v", event)
+		}
+		if strings.Join(event.ChangedFiles, ",") != "a.go,b.go,c.go" || !event.Truncated {
+			t.Errorf("changed files of a push listing part of its commits should be truncated: %+v", event)
+		}
+	}
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "push", "", body)); ok {
+		t.Error("webhook without a signature should be rejected")
+	}
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "push", hmacSignature("wrong", []byte(body)), body)); ok {
+		t.Error("webhook with a wrong signature should be rejected")
+	}
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "issues", sign(body), body)); ok {
+		t.Error("webhook of other events should be rejected")
+	}
+	other := fmt.Sprintf(push, "other", "bbb")
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "push", sign(other), other)); ok {
+		t.Error("push of another branch should be skipped")
+	}
+	step.MultiBranch = true
+	step.Branches = []string{"release/*"}
+	release := fmt.Sprintf(push, "release/1.0", "bbb")
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "push", sign(release), release)); !ok {
+		t.Error("push of a branch matching the branch pattern should be accepted")
+	}
+	deleted := fmt.Sprintf(push, "release/1.0", "0000000000000000000000000000000000000000")
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "push", sign(deleted), deleted)); ok {
+		t.Error("deleted branches should not trigger")
+	}
+	step.MultiBranch = false
+
+	step.PullRequests = true
+	pullRequest := `{"action":"%s","number":4,"pull_request":{"title":"fix","user":{"login":"bob"},
+		"head":{"ref":"fix","sha":"ccc","repo_id":1},"base":{"ref":"master","repo_id":1}}}`
+	body = fmt.Sprintf(pullRequest, "synchronized")
+	event, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "pull_request", sign(body), body))
+	if !ok {
+		t.Fatal("updated pull request targeting the branch should be accepted")
+	}
+	pr := event.PullRequest
+	if event.Type != model.WebhookEventPullRequest || pr == nil || pr.Number != 4 || pr.Author != "bob" || pr.HeadCommit != "ccc" || pr.Ref != "refs/pull/4/head" || pr.Fork {
+		t.Errorf("unexpected pull request event %+v", event)
+	}
+	body = fmt.Sprintf(pullRequest, "closed")
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "pull_request", sign(body), body)); ok {
+		t.Error("closed pull requests should be skipped")
+	}
+
+	releaseEvent := `{"action":"published","release":{"tag_name":"%s"}}`
+	body = fmt.Sprintf(releaseEvent, "v1.0")
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "release", sign(body), body)); ok {
+		t.Error("release should be skipped when release events are not enabled")
+	}
+	step.ReleaseEvents = true
+	step.TagPatterns = []string{"v*"}
+	event, ok = m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "release", sign(body), body))
+	if !ok || event.Type != model.WebhookEventRelease || event.Tag != "v1.0" || event.Ref != "refs/tags/v1.0" {
+		t.Errorf("release of a tag matching tag patterns should be accepted, got %+v", event)
+	}
+	body = fmt.Sprintf(releaseEvent, "nightly")
+	if _, ok := m.VerifyWebhookPayload(p, newGiteaWebhookRequest("X-Gitea", "release", sign(body), body)); ok {
+		t.Error("release of a tag not matching tag patterns should be skipped")
+	}
+}
+
+func TestVerifyGiteaWebhookSignature(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/master"}`)
+	signature := hmacSignature("secret", body)
+	if !VerifyGiteaWebhookSignature([]byte("secret"), signature, body) {
+		t.Error("valid signature should be verified")
+	}
+	if VerifyGiteaWebhookSignature([]byte("other"), signature, body) {
+		t.Error("signature of another secret should be rejected")
+	}
+	if VerifyGiteaWebhookSignature([]byte("secret"), signature, []byte(`{"ref":"refs/heads/other"}`)) {
+		t.Error("signature of another body should be rejected")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 
@@ -24,9 +25,10 @@ import (
 )
 
 const (
-	defaultGithubAPI = "https://api.github.com"
-	maxPerPage       = "100"
-	gheAPI           = "/api/v3"
+	defaultGithubAPI  = "https://api.github.com"
+	maxPerPage        = "100"
+	gheAPI            = "/api/v3"
+	maxPayloadCommits = 20
 )
 
 type GithubAccount struct {
@@ -296,44 +298,246 @@ func (g GithubManager) CreateWebhook(p *model.Pipeline, token string, ciWebhookE
 	return nil
 }
 
-func (g GithubManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request) bool {
+func (g GithubManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request) (*model.WebhookEvent, bool) {
 	var signature string
 	var event_type string
 	if signature = req.Header.Get("X-Hub-Signature"); len(signature) == 0 {
 		logrus.Errorf("receive github webhook,no signature")
-		return false
+		return nil, false
 	}
 	if event_type = req.Header.Get("X-GitHub-Event"); len(event_type) == 0 {
 		logrus.Errorf("receive github webhook,no event")
-		return false
+		return nil, false
 	}
-	if event_type != "push" {
-		logrus.Errorf("receive github webhook,not push event")
-		return false
+	if event_type != "push" && event_type != "release" && event_type != "pull_request" {
+		logrus.Errorf("receive github webhook,not push, release or pull request event")
+		return nil, false
 	}
 	if p == nil {
-		return false
+		return nil, false
 	}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		logrus.Errorf("receive github webhook, got error:%v", err)
-		return false
+		return nil, false
 	}
 	if match := VerifyGithubWebhookSignature([]byte(p.WebHookToken), signature, body); !match {
 		logrus.Errorf("receive github webhook, invalid signature")
-		return false
+		return nil, false
+	}
+	if event_type == "release" {
+		return githubReleaseEvent(p, body)
+	}
+	if event_type == "pull_request" {
+		return githubPullRequestEvent(p, body)
 	}
-	//check branch
+	//check branch or tag
 	payload := &github.WebHookPayload{}
 	if err := json.Unmarshal(body, payload); err != nil {
 		logrus.Error("fail to parse github webhook payload")
-		return false
+		return nil, false
+	}
+	eventType, tag, ok := refEvent(p.Stages[0].Steps[0], payload.GetRef())
+	if !ok {
+		logrus.Warningf("branch not match:%v,%v", payload.GetRef(), p.Stages[0].Steps[0].Branch)
+		return nil, false
+	}
+	if eventType == model.WebhookEventTag && (payload.GetDeleted() || isDeletedRef(payload.GetAfter())) {
+		logrus.Debugf("receive github webhook, tag %v is deleted", tag)
+		return nil, false
+	}
+	event := &model.WebhookEvent{
+		Type:   eventType,
+		Tag:    tag,
+		Ref:    payload.GetRef(),
+		Before: payload.GetBefore(),
+		After:  payload.GetAfter(),
+		//github sends at most 20 commits in a push payload
+		Truncated: len(payload.Commits) >= maxPayloadCommits,
+	}
+	for _, commit := range payload.Commits {
+		event.ChangedFiles = append(event.ChangedFiles, commit.Added...)
+		event.ChangedFiles = append(event.ChangedFiles, commit.Modified...)
+		event.ChangedFiles = append(event.ChangedFiles, commit.Removed...)
+	}
+	return event, true
+}
+
+//githubReleaseEvent gets the event of a published release if the SCM step triggers on release events
+func githubReleaseEvent(p *model.Pipeline, body []byte) (*model.WebhookEvent, bool) {
+	if !p.Stages[0].Steps[0].ReleaseEvents {
+		logrus.Warningf("receive github release webhook, release events are not enabled")
+		return nil, false
+	}
+	payload := &github.ReleaseEvent{}
+	if err := json.Unmarshal(body, payload); err != nil || payload.Release == nil {
+		logrus.Error("fail to parse github release webhook payload")
+		return nil, false
+	}
+	if payload.GetAction() != "published" {
+		logrus.Debugf("receive github release webhook, skip '%s' action", payload.GetAction())
+		return nil, false
+	}
+	tag := payload.Release.GetTagName()
+	if !matchReleaseTag(p.Stages[0].Steps[0], tag) {
+		logrus.Debugf("receive github release webhook, skip tag '%s' not matching tag patterns", tag)
+		return nil, false
+	}
+	return &model.WebhookEvent{
+		Type: model.WebhookEventRelease,
+		Tag:  tag,
+		Ref:  "refs/tags/" + tag,
+	}, true
+}
+
+//githubPullRequestEvent gets the event of an opened, synchronized or reopened pull request targeting the branch of the SCM step
+func githubPullRequestEvent(p *model.Pipeline, body []byte) (*model.WebhookEvent, bool) {
+	scmStep := p.Stages[0].Steps[0]
+	if !scmStep.PullRequests {
+		logrus.Warningf("receive github pull request webhook, pull request builds are not enabled")
+		return nil, false
+	}
+	payload := &github.PullRequestEvent{}
+	if err := json.Unmarshal(body, payload); err != nil || payload.PullRequest == nil {
+		logrus.Error("fail to parse github pull request webhook payload")
+		return nil, false
+	}
+	action := payload.GetAction()
+	if action != "opened" && action != "synchronize" && action != "reopened" {
+		logrus.Debugf("receive github pull request webhook, skip '%s' action", action)
+		return nil, false
+	}
+	pr := payload.PullRequest
+	if pr.Base.GetRef() != scmStep.Branch {
+		logrus.Warningf("receive github pull request webhook, target branch not match:%v,%v", pr.Base.GetRef(), scmStep.Branch)
+		return nil, false
+	}
+	return &model.WebhookEvent{
+		Type: model.WebhookEventPullRequest,
+		PullRequest: &model.PullRequest{
+			Number:       pr.GetNumber(),
+			Title:        pr.GetTitle(),
+			Author:       pr.User.GetLogin(),
+			SourceBranch: pr.Head.GetRef(),
+			TargetBranch: pr.Base.GetRef(),
+			HeadCommit:   pr.Head.GetSHA(),
+			Ref:          fmt.Sprintf("refs/pull/%d/head", pr.GetNumber()),
+			Fork:         pr.Head == nil || pr.Base == nil || pr.Head.Repo.GetID() != pr.Base.Repo.GetID(),
+		},
+	}, true
+}
+
+//GetChangedFiles gets files changed between two commits by compare API
+func (g GithubManager) GetChangedFiles(p *model.Pipeline, token string, base string, head string) ([]string, error) {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return nil, err
 	}
-	if *payload.Ref != "refs/heads/"+p.Stages[0].Steps[0].Branch {
-		logrus.Warningf("branch not match:%v,%v", *payload.Ref, p.Stages[0].Steps[0].Branch)
-		return false
+	url := fmt.Sprintf("%s/repos/%s/%s/compare/%s...%s", g.apiEndpoint, user, repo, base, head)
+	resp, err := getFromGithub(token, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	comparison := &github.CommitsComparison{}
+	if err := json.NewDecoder(resp.Body).Decode(comparison); err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, file := range comparison.Files {
+		files = append(files, file.GetFilename())
+	}
+	return files, nil
+}
+
+//GetFileContent gets content of a file in the repository at the ref
+func (g GithubManager) GetFileContent(p *model.Pipeline, token string, path string, ref string) ([]byte, error) {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return nil, err
+	}
+	filePath := (&url.URL{Path: strings.TrimPrefix(path, "/")}).EscapedPath()
+	fileURL := fmt.Sprintf("%s/repos/%s/%s/contents/%s?ref=%s", g.apiEndpoint, user, repo, filePath, url.QueryEscape(ref))
+	resp, err := getFromGithub(token, fileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content := &github.RepositoryContent{}
+	if err := json.NewDecoder(resp.Body).Decode(content); err != nil {
+		return nil, err
+	}
+	decoded, err := content.GetContent()
+	if err != nil {
+		return nil, err
 	}
-	return true
+	return []byte(decoded), nil
+}
+
+//GetBranches gets names of branches in the repository by branches API
+func (g GithubManager) GetBranches(p *model.Pipeline, token string) ([]string, error) {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return nil, err
+	}
+	responses, err := paginateGithub(token, fmt.Sprintf("%s/repos/%s/%s/branches", g.apiEndpoint, user, repo))
+	if err != nil {
+		return nil, err
+	}
+	branches := []string{}
+	for _, response := range responses {
+		var branchesObj []github.Branch
+		err := json.NewDecoder(response.Body).Decode(&branchesObj)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, branch := range branchesObj {
+			branches = append(branches, branch.GetName())
+		}
+	}
+	return branches, nil
+}
+
+//CreateCommitStatus posts the status of a commit by statuses API
+func (g GithubManager) CreateCommitStatus(p *model.Pipeline, token string, commit string, status *model.CommitStatus) error {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return err
+	}
+	state := status.State
+	if state == model.CommitStateCanceled {
+		//github has no canceled state
+		state = "error"
+	}
+	repoStatus := &github.RepoStatus{
+		State:       github.String(state),
+		TargetURL:   github.String(status.TargetURL),
+		Description: github.String(status.Description),
+		Context:     github.String(status.Context),
+	}
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(repoStatus); err != nil {
+		return err
+	}
+	APIURL := fmt.Sprintf("%s/repos/%s/%s/statuses/%s", g.apiEndpoint, user, repo, commit)
+	req, err := http.NewRequest("POST", APIURL, b)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "token "+token)
+	req.Header.Add("Accept", "application/json")
+	client := http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 399 {
+		return errors.New(string(respData))
+	}
+	return err
 }
 
 func VerifyGithubWebhookSignature(secret []byte, signature string, body []byte) bool {
@@ -363,7 +567,7 @@ func createGithubWebhook(user string, repo string, accesstoken string, webhookUr
 		Name:   &name,
 		Active: &active,
 		Config: make(map[string]interface{}),
-		Events: []string{"push"},
+		Events: []string{"push", "release", "pull_request"},
 	}
 
 	hook.Config["url"] = webhookUrl
@@ -417,7 +621,7 @@ func deleteGithubWebhook(user string, repo string, accesstoken string, id int) e
 	if resp.StatusCode > 399 {
 		return errors.New(string(respData))
 	}
-	logrus.Debugf("after delete,%v,%v", string(respData))
+	logrus.Debugf("after delete,%v", string(respData))
 	return err
 }
 
@@ -2,6 +2,7 @@ package scm
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -308,46 +309,291 @@ func (g GitlabManager) CreateWebhook(p *model.Pipeline, token string, ciWebhookE
 	return nil
 }
 
-func (g GitlabManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request) bool {
+func (g GitlabManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request) (*model.WebhookEvent, bool) {
 	var signature string
 	var event_type string
 	if signature = req.Header.Get("X-Gitlab-Token"); len(signature) == 0 {
 		logrus.Warningf("receive gitlab webhook, but got no token")
-		return false
+		return nil, false
 	}
 	if event_type = req.Header.Get("X-Gitlab-Event"); len(event_type) == 0 {
 		logrus.Warningf("receive gitlab webhook, but got no event")
-		return false
+		return nil, false
 	}
 
-	if event_type != "Push Hook" {
-		logrus.Warningf("receive gitlab webhook '%s' event, expected push hook event", event_type)
-		return false
+	if event_type != "Push Hook" && event_type != "Tag Push Hook" && event_type != "Release Hook" && event_type != "Merge Request Hook" {
+		logrus.Warningf("receive gitlab webhook '%s' event, expected push, tag push, release or merge request hook event", event_type)
+		return nil, false
 	}
 	if p == nil {
-		return false
+		return nil, false
 	}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		logrus.Warningf("receive gitlab webhook, got error:%v", err)
-		return false
+		return nil, false
 	}
 	if p.WebHookToken != signature {
 		logrus.Warning("receive gitlab webhook, invalid token")
-		return false
+		return nil, false
 	}
-	//check branch
-	payload := map[string]interface{}{}
+	if event_type == "Release Hook" {
+		return gitlabReleaseEvent(p, body)
+	}
+	if event_type == "Merge Request Hook" {
+		return gitlabMergeRequestEvent(p, body)
+	}
+	//check branch or tag
+	payload := &gitlabPushPayload{}
 	logrus.Debugf("gitlab webhook got payload:\n%v", string(body))
-	if err := json.Unmarshal(body, &payload); err != nil {
-		logrus.Error("fail to parse github webhook payload,err:%v", err)
-		return false
+	if err := json.Unmarshal(body, payload); err != nil {
+		logrus.Errorf("fail to parse github webhook payload,err:%v", err)
+		return nil, false
+	}
+	eventType, tag, ok := refEvent(p.Stages[0].Steps[0], payload.Ref)
+	if !ok {
+		logrus.Warningf("receive gitlab webhook, branch not match:%v,%v", payload.Ref, p.Stages[0].Steps[0].Branch)
+		return nil, false
+	}
+	if eventType == model.WebhookEventTag && isDeletedRef(payload.After) {
+		logrus.Debugf("receive gitlab webhook, tag %v is deleted", tag)
+		return nil, false
+	}
+	event := &model.WebhookEvent{
+		Type:   eventType,
+		Tag:    tag,
+		Ref:    payload.Ref,
+		Before: payload.Before,
+		After:  payload.After,
+		//gitlab sends at most 20 commits in a push payload
+		Truncated: payload.TotalCommitsCount > len(payload.Commits),
+	}
+	for _, commit := range payload.Commits {
+		event.ChangedFiles = append(event.ChangedFiles, commit.Added...)
+		event.ChangedFiles = append(event.ChangedFiles, commit.Modified...)
+		event.ChangedFiles = append(event.ChangedFiles, commit.Removed...)
+	}
+	return event, true
+}
+
+//gitlabReleaseEvent gets the event of a created release if the SCM step triggers on release events
+func gitlabReleaseEvent(p *model.Pipeline, body []byte) (*model.WebhookEvent, bool) {
+	if !p.Stages[0].Steps[0].ReleaseEvents {
+		logrus.Warningf("receive gitlab release webhook, release events are not enabled")
+		return nil, false
+	}
+	payload := &gitlabReleasePayload{}
+	if err := json.Unmarshal(body, payload); err != nil || payload.Tag == "" {
+		logrus.Errorf("fail to parse gitlab release webhook payload,err:%v", err)
+		return nil, false
+	}
+	if payload.Action != "create" {
+		logrus.Debugf("receive gitlab release webhook, skip '%s' action", payload.Action)
+		return nil, false
+	}
+	if !matchReleaseTag(p.Stages[0].Steps[0], payload.Tag) {
+		logrus.Debugf("receive gitlab release webhook, skip tag '%s' not matching tag patterns", payload.Tag)
+		return nil, false
+	}
+	return &model.WebhookEvent{
+		Type: model.WebhookEventRelease,
+		Tag:  payload.Tag,
+		Ref:  "refs/tags/" + payload.Tag,
+	}, true
+}
+
+//GetChangedFiles gets files changed between two commits by compare API
+func (g GitlabManager) GetChangedFiles(p *model.Pipeline, token string, base string, head string) ([]string, error) {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return nil, err
+	}
+	project := url.QueryEscape(user + "/" + repo)
+	APIURL := fmt.Sprintf(gitlabAPI+"/projects/%s/repository/compare?from=%s&to=%s", g.scheme, g.host, project, base, head)
+	resp, err := getFromGitlab(token, APIURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	comparison := &gitlab.Compare{}
+	if err := json.NewDecoder(resp.Body).Decode(comparison); err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, diff := range comparison.Diffs {
+		files = append(files, diff.NewPath)
+		if diff.OldPath != diff.NewPath {
+			files = append(files, diff.OldPath)
+		}
+	}
+	return files, nil
+}
+
+//GetFileContent gets content of a file in the repository at the ref
+func (g GitlabManager) GetFileContent(p *model.Pipeline, token string, path string, ref string) ([]byte, error) {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return nil, err
+	}
+	project := url.QueryEscape(user + "/" + repo)
+	APIURL := fmt.Sprintf(gitlabAPI+"/projects/%s/repository/files?file_path=%s&ref=%s", g.scheme, g.host, project, url.QueryEscape(path), url.QueryEscape(ref))
+	resp, err := getFromGitlab(token, APIURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	file := &gitlab.File{}
+	if err := json.NewDecoder(resp.Body).Decode(file); err != nil {
+		return nil, err
+	}
+	if file.Encoding != "base64" {
+		return []byte(file.Content), nil
+	}
+	return base64.StdEncoding.DecodeString(file.Content)
+}
+
+//GetBranches gets names of branches in the repository by branches API
+func (g GitlabManager) GetBranches(p *model.Pipeline, token string) ([]string, error) {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return nil, err
+	}
+	project := url.QueryEscape(user + "/" + repo)
+	responses, err := paginateGitlab(token, fmt.Sprintf(gitlabAPI+"/projects/%s/repository/branches", g.scheme, g.host, project))
+	if err != nil {
+		return nil, err
+	}
+	branches := []string{}
+	for _, response := range responses {
+		var branchesObj []gitlab.Branch
+		err := json.NewDecoder(response.Body).Decode(&branchesObj)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, branch := range branchesObj {
+			branches = append(branches, branch.Name)
+		}
+	}
+	return branches, nil
+}
+
+//CreateCommitStatus posts the status of a commit by commit status API
+func (g GitlabManager) CreateCommitStatus(p *model.Pipeline, token string, commit string, status *model.CommitStatus) error {
+	user, repo, err := getUserRepoFromURL(p.Stages[0].Steps[0].Repository)
+	if err != nil {
+		return err
+	}
+	state := gitlab.BuildState(status.State)
+	if status.State == model.CommitStateFailure {
+		state = gitlab.Failed
+	}
+	opt := &gitlab.SetCommitStatusOptions{
+		State:       state,
+		Name:        gitlab.String(status.Context),
+		TargetURL:   gitlab.String(status.TargetURL),
+		Description: gitlab.String(status.Description),
+	}
+	q, err := query.Values(opt)
+	if err != nil {
+		return err
+	}
+	project := url.QueryEscape(user + "/" + repo)
+	APIURL := fmt.Sprintf(gitlabAPI+"/projects/%s/statuses/%s", g.scheme, g.host, project, commit)
+	req, err := http.NewRequest("POST", APIURL, nil)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = q.Encode()
+	req.Header.Add("Authorization", "Bearer "+token)
+	client := http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
 	}
-	if payload["ref"] != "refs/heads/"+p.Stages[0].Steps[0].Branch {
-		logrus.Warningf("receive gitlab webhook, branch not match:%v,%v", payload["ref"], p.Stages[0].Steps[0].Branch)
-		return false
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 399 {
+		return errors.New(string(respData))
 	}
-	return true
+	return err
+}
+
+//gitlabMergeRequestEvent gets the event of an opened, updated or reopened merge request targeting the branch of the SCM step,
+//updates without new commits are skipped
+func gitlabMergeRequestEvent(p *model.Pipeline, body []byte) (*model.WebhookEvent, bool) {
+	scmStep := p.Stages[0].Steps[0]
+	if !scmStep.PullRequests {
+		logrus.Warningf("receive gitlab merge request webhook, merge request builds are not enabled")
+		return nil, false
+	}
+	payload := &gitlabMergeRequestPayload{}
+	if err := json.Unmarshal(body, payload); err != nil {
+		logrus.Errorf("fail to parse gitlab merge request webhook payload,err:%v", err)
+		return nil, false
+	}
+	attrs := payload.ObjectAttributes
+	if attrs.Action != "open" && attrs.Action != "reopen" && (attrs.Action != "update" || attrs.OldRev == "") {
+		logrus.Debugf("receive gitlab merge request webhook, skip '%s' action", attrs.Action)
+		return nil, false
+	}
+	if attrs.TargetBranch != scmStep.Branch {
+		logrus.Warningf("receive gitlab merge request webhook, target branch not match:%v,%v", attrs.TargetBranch, scmStep.Branch)
+		return nil, false
+	}
+	return &model.WebhookEvent{
+		Type: model.WebhookEventPullRequest,
+		PullRequest: &model.PullRequest{
+			Number:       attrs.IID,
+			Title:        attrs.Title,
+			Author:       payload.User.Username,
+			SourceBranch: attrs.SourceBranch,
+			TargetBranch: attrs.TargetBranch,
+			HeadCommit:   attrs.LastCommit.ID,
+			Ref:          fmt.Sprintf("refs/merge-requests/%d/head", attrs.IID),
+			Fork:         attrs.SourceProjectID != attrs.TargetProjectID,
+		},
+	}, true
+}
+
+//gitlabMergeRequestPayload is the part of gitlab merge request hook payload in use
+type gitlabMergeRequestPayload struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	ObjectAttributes struct {
+		IID          int    `json:"iid"`
+		Title        string `json:"title"`
+		Action       string `json:"action"`
+		OldRev       string `json:"oldrev"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		//projects of the source and target branches, they differ for merge requests from forks
+		SourceProjectID int `json:"source_project_id"`
+		TargetProjectID int `json:"target_project_id"`
+		LastCommit      struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+//gitlabReleasePayload is the part of gitlab release hook payload in use
+type gitlabReleasePayload struct {
+	Action string `json:"action"`
+	Tag    string `json:"tag"`
+}
+
+//gitlabPushPayload is the part of gitlab push and tag push hook payload in use
+type gitlabPushPayload struct {
+	Ref               string `json:"ref"`
+	Before            string `json:"before"`
+	After             string `json:"after"`
+	TotalCommitsCount int    `json:"total_commits_count"`
+	Commits           []struct {
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
 }
 
 func VerifyGitlabWebhookSignature(secret []byte, signature string, body []byte) bool {
@@ -363,15 +609,19 @@ func (g GitlabManager) createGitlabWebhook(user string, repo string, accesstoken
 	req, err := http.NewRequest("POST", APIURL, nil)
 
 	opt := &gitlab.AddProjectHookOptions{
-		PushEvents: gitlab.Bool(true),
-		URL:        gitlab.String(webhookUrl),
+		PushEvents:            gitlab.Bool(true),
+		TagPushEvents:         gitlab.Bool(true),
+		MergeRequestsEvents:   gitlab.Bool(true),
+		URL:                   gitlab.String(webhookUrl),
 		EnableSSLVerification: gitlab.Bool(false),
-		Token: gitlab.String(secret),
+		Token:                 gitlab.String(secret),
 	}
 	q, err := query.Values(opt)
 	if err != nil {
 		return 0, err
 	}
+	//not supported by the client options
+	q.Set("releases_events", "true")
 	logrus.Debugf("gitlab hook to create:%v", opt)
 	req.URL.RawQuery = q.Encode()
 	req.Header.Add("Authorization", "Bearer "+accesstoken)
@@ -0,0 +1,56 @@
+package scm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"golang.org/x/oauth2"
+)
+
+//oauthAccount exchanges the code for a token, the refresh token and expiry are kept in the account
+func oauthAccount(config *oauth2.Config, code string, getAccount func(string) (*model.GitAccount, error)) (*model.GitAccount, error) {
+	token, err := config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		logrus.Errorf("Code exchange failed with '%s'\n", err)
+		return nil, err
+	} else if !strings.EqualFold(token.TokenType, "bearer") || token.AccessToken == "" {
+		return nil, fmt.Errorf("Fail to get accesstoken with oauth config")
+	}
+	account, err := getAccount(token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	setAccountToken(account, token)
+	return account, nil
+}
+
+//refreshOAuthToken gets a new access token of the account by its refresh token
+func refreshOAuthToken(config *oauth2.Config, account *model.GitAccount) error {
+	if account.RefreshToken == "" {
+		return errors.New("no refresh token")
+	}
+	expired := &oauth2.Token{
+		RefreshToken: account.RefreshToken,
+		Expiry:       time.Now().Add(-time.Minute),
+	}
+	token, err := config.TokenSource(oauth2.NoContext, expired).Token()
+	if err != nil {
+		return err
+	}
+	setAccountToken(account, token)
+	return nil
+}
+
+func setAccountToken(account *model.GitAccount, token *oauth2.Token) {
+	account.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		account.RefreshToken = token.RefreshToken
+	}
+	if !token.Expiry.IsZero() {
+		account.TokenExpiry = token.Expiry.Unix()
+	}
+}
@@ -0,0 +1,55 @@
+package scm
+
+import (
+	"strings"
+	"time"
+
+	"github.com/rancher/pipeline/condition"
+	"github.com/rancher/pipeline/model"
+)
+
+//requestTimeout limits API requests to source code management servers, such as posting commit statuses
+const requestTimeout = 30 * time.Second
+
+//refEvent gets the event type and the tag of a pushed ref,
+//the ref should be a branch built by the SCM step or a tag matching its tag patterns
+func refEvent(step *model.Step, ref string) (string, string, bool) {
+	if strings.HasPrefix(ref, "refs/heads/") && step.MatchBranch(strings.TrimPrefix(ref, "refs/heads/")) {
+		return model.WebhookEventPush, "", true
+	}
+	if strings.HasPrefix(ref, "refs/tags/") {
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		if matchTag(step, tag) {
+			return model.WebhookEventTag, tag, true
+		}
+	}
+	return "", "", false
+}
+
+//matchTag checks the tag against tag patterns of the SCM step
+func matchTag(step *model.Step, tag string) bool {
+	for _, pattern := range step.TagPatterns {
+		if condition.MatchGlob(pattern, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchReleaseTag checks the tag of a release against tag patterns of the SCM step, releases of all tags are built without patterns
+func matchReleaseTag(step *model.Step, tag string) bool {
+	return len(step.TagPatterns) == 0 || matchTag(step, tag)
+}
+
+//isDeletedRef checks if the commit after a push is empty, which means the ref is deleted
+func isDeletedRef(after string) bool {
+	return after == "" || strings.Trim(after, "0") == ""
+}
+
+//trimRefPrefix gets the branch or tag name of a full ref
+func trimRefPrefix(ref string) string {
+	if strings.HasPrefix(ref, "refs/heads/") {
+		return strings.TrimPrefix(ref, "refs/heads/")
+	}
+	return strings.TrimPrefix(ref, "refs/tags/")
+}
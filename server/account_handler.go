@@ -52,6 +52,37 @@ func (s *Server) GetAccount(rw http.ResponseWriter, req *http.Request) error {
 	return apiContext.WriteResource(model.ToAccountResource(apiContext, r))
 }
 
+//CreateGitAccount creates an account of plain git servers, the credential is checked against the repository if it is given
+func (s *Server) CreateGitAccount(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	requestBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	input := struct {
+		model.GitAccount
+		Repository string `json:"repository,omitempty"`
+	}{}
+	if err := json.Unmarshal(requestBytes, &input); err != nil {
+		return err
+	}
+	account := &input.GitAccount
+	uid, err := util.GetCurrentUser(req.Cookies())
+	if err == nil && uid != "" {
+		account.RancherUserID = uid
+	}
+	if err := service.CreateGitAccount(account, input.Repository); err != nil {
+		return err
+	}
+	if err := s.Provider.OnCreateAccount(account); err != nil {
+		logrus.Errorf("fail to create credential for account '%s': %v", account.Id, err)
+	}
+	filtered := *account
+	model.FilterAccount(&filtered)
+	broadcastResourceChange(filtered)
+	return apiContext.WriteResource(model.ToAccountResource(apiContext, account))
+}
+
 func (s *Server) RemoveAccount(rw http.ResponseWriter, req *http.Request) error {
 	id := mux.Vars(req)["id"]
 	if !service.ValidAccountAccess(req, id) {
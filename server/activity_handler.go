@@ -132,6 +132,7 @@ func (s *Server) RerunActivity(rw http.ResponseWriter, req *http.Request) error
 		logrus.Errorf("rerun activity error:%v", err)
 		return err
 	}
+	service.ReportCommitStatus(r)
 	if err = service.UpdateActivity(r); err != nil {
 		logrus.Errorf("update activity error:%v", err)
 		return err
@@ -166,6 +167,7 @@ func (s *Server) ApproveActivity(rw http.ResponseWriter, req *http.Request) erro
 	r.Status = model.ActivityWaiting
 	r.ActivityStages[r.PendingStage].Status = model.ActivityStageWaiting
 	r.PendingStage = 0
+	service.ReportCommitStatus(r)
 	if err = service.UpdateActivity(r); err != nil {
 		logrus.Errorf("fail update activity:%v", err)
 		return err
@@ -200,6 +202,7 @@ func (s *Server) DenyActivity(rw http.ResponseWriter, req *http.Request) error {
 		logrus.Errorf("fail denyActivity:%v", err)
 		return err
 	}
+	service.ReportCommitStatus(r)
 	if err = service.UpdateActivity(r); err != nil {
 		logrus.Errorf("fail update activity:%v", err)
 		return err
@@ -235,6 +238,7 @@ func (s *Server) StopActivity(rw http.ResponseWriter, req *http.Request) error {
 		logrus.Errorf("fail stop activity:%v", err)
 		return err
 	}
+	service.ReportCommitStatus(r)
 	if err = service.UpdateActivity(r); err != nil {
 		logrus.Errorf("fail update activity:%v", err)
 		return err
@@ -336,11 +340,22 @@ func (s *Server) UpdateLastActivity(activity *model.Activity) {
 	if err != nil {
 		return
 	}
+	isBranchRun, err := service.UpdateLastBranchActivity(p, activity)
+	if err != nil {
+		logrus.Errorf("fail update pipeline last run status of branch,%v", err)
+	}
+	if isBranchRun {
+		broadcastResourceChange(*p)
+		return
+	}
 	if activity.Id != p.LastRunId {
 		return
 	}
 	p.LastRunStatus = activity.Status
 	p.CommitInfo = activity.CommitInfo
+	if activity.Coverage != nil {
+		p.LastCoverage = activity.Coverage
+	}
 	p.NextRunTime = service.GetNextRunTime(p)
 
 	if err := service.UpdatePipeline(p); err != nil {
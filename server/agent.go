@@ -5,7 +5,6 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/rancher/pipeline/git"
 	"github.com/rancher/pipeline/model"
 	"github.com/rancher/pipeline/scheduler"
 	"github.com/rancher/pipeline/server/service"
@@ -25,9 +24,9 @@ type Agent struct {
 
 	broadcast chan WSMsg
 
-	//scheduler
-	cronRunners           map[string]*scheduler.CronRunner
-	registerCronRunnerC   chan *scheduler.CronRunner
+	//scheduler, cron runners of enabled schedules by pipeline id
+	cronRunners           map[string][]*scheduler.CronRunner
+	registerCronRunnerC   chan []*scheduler.CronRunner
 	unregisterCronRunnerC chan string
 
 	activityLocks syncmap.Map
@@ -35,6 +34,14 @@ type Agent struct {
 
 var GlobalAgent *Agent
 
+const (
+	tokenRefreshInterval = 5 * time.Minute
+	//refresh tokens expiring before next check with some margin
+	tokenRefreshWindow = 15 * time.Minute
+	//interval to discover branches of multi-branch pipelines
+	branchSyncInterval = 10 * time.Minute
+)
+
 func broadcastResourceChange(obj interface{}) {
 	resourceType := ""
 	switch obj.(type) {
@@ -48,6 +55,8 @@ func broadcastResourceChange(obj interface{}) {
 		resourceType = "setting"
 	case model.SCMSetting:
 		resourceType = "scmSetting"
+	case model.StepTemplate:
+		resourceType = "stepTemplate"
 	default:
 		logrus.Warningf("unsupported resource type to broadcast")
 		return
@@ -69,14 +78,16 @@ func InitAgent(s *Server) {
 		register:              make(chan *ConnHolder),
 		unregister:            make(chan *ConnHolder),
 		broadcast:             make(chan WSMsg),
-		cronRunners:           make(map[string]*scheduler.CronRunner),
-		registerCronRunnerC:   make(chan *scheduler.CronRunner),
+		cronRunners:           make(map[string][]*scheduler.CronRunner),
+		registerCronRunnerC:   make(chan []*scheduler.CronRunner),
 		unregisterCronRunnerC: make(chan string),
 		activityLocks:         syncmap.Map{},
 	}
 	logrus.Debugf("inited GlobalAgent:%v", GlobalAgent)
 	go GlobalAgent.handleWS()
 	go GlobalAgent.RunScheduler()
+	go GlobalAgent.RefreshAccountTokens()
+	go GlobalAgent.SyncBranches()
 
 }
 
@@ -110,38 +121,78 @@ func (a *Agent) RunScheduler() {
 
 	pipelines := service.ListPipelines()
 	for _, pipeline := range pipelines {
-		if pipeline.IsActivate && pipeline.CronTrigger.Spec != "" {
-			cr := scheduler.NewCronRunner(pipeline.Id, pipeline.CronTrigger.Spec, pipeline.CronTrigger.Timezone)
-			a.registerCronRunner(cr)
+		if runners := newCronRunners(pipeline); pipeline.IsActivate && len(runners) > 0 {
+			a.registerCronRunners(runners)
 		}
 	}
 	logrus.Debugf("run scheduler,init size:%v", len(a.cronRunners))
 	for {
 		select {
-		case cr := <-a.registerCronRunnerC:
-			a.registerCronRunner(cr)
+		case runners := <-a.registerCronRunnerC:
+			a.registerCronRunners(runners)
 		case pId := <-a.unregisterCronRunnerC:
 			a.unregisterCronRunner(pId)
 		}
 	}
 }
 
-func (a *Agent) onPipelineChange(p *model.Pipeline) {
-	logrus.Debugf("on pipeline change")
-	pId := p.Id
-	spec := ""
-	timezone := ""
-	if (!p.IsActivate) || (p.CronTrigger.Spec == "") {
-		//deactivate,remove the cron
-		a.unregisterCronRunnerC <- pId
+//RefreshAccountTokens refreshes access tokens before they expire, and updates the credentials in the provider
+func (a *Agent) RefreshAccountTokens() {
+	for {
+		accounts, err := service.ListExpiringAccounts(tokenRefreshWindow)
+		if err != nil {
+			logrus.Errorf("fail to list accounts to refresh tokens: %v", err)
+		}
+		for _, account := range accounts {
+			if err := service.RefreshAccountToken(account); err != nil {
+				logrus.Errorf("fail to refresh token of account '%s': %v", account.Id, err)
+				continue
+			}
+			if err := a.Server.Provider.OnDeleteAccount(account); err != nil {
+				logrus.Errorf("fail to remove credential of account '%s': %v", account.Id, err)
+			}
+			if err := a.Server.Provider.OnCreateAccount(account); err != nil {
+				logrus.Errorf("fail to update credential of account '%s': %v", account.Id, err)
+			}
+		}
+		time.Sleep(tokenRefreshInterval)
 	}
+}
 
-	if p.IsActivate && p.CronTrigger.Spec != "" {
-		spec = p.CronTrigger.Spec
-		timezone = p.CronTrigger.Timezone
-		cr := scheduler.NewCronRunner(pId, spec, timezone)
-		a.registerCronRunnerC <- cr
+//SyncBranches discovers branches of active multi-branch pipelines periodically,
+//new branches are tracked and deleted branches are cleaned up
+func (a *Agent) SyncBranches() {
+	for {
+		for _, p := range service.ListPipelines() {
+			if !p.IsActivate || !p.IsMultiBranch() && len(p.BranchStates) == 0 {
+				continue
+			}
+			a.syncPipelineBranches(p.Id)
+		}
+		time.Sleep(branchSyncInterval)
 	}
+}
+
+//syncPipelineBranches syncs branches of the pipeline and broadcasts the change
+func (a *Agent) syncPipelineBranches(pId string) {
+	p, err := service.GetPipelineById(pId)
+	if err != nil {
+		logrus.Errorf("fail to get pipeline:%v", err)
+		return
+	}
+	changed, err := service.SyncPipelineBranches(p)
+	if err != nil {
+		logrus.Errorf("fail to sync branches of pipeline '%s': %v", p.Name, err)
+		return
+	}
+	if changed {
+		broadcastResourceChange(*p)
+	}
+}
+
+func (a *Agent) onPipelineChange(p *model.Pipeline) {
+	logrus.Debugf("on pipeline change")
+	a.scheduleCronRunners(p)
 	p.NextRunTime = service.GetNextRunTime(p)
 	service.UpdatePipeline(p)
 	a.broadcast <- WSMsg{
@@ -151,6 +202,9 @@ func (a *Agent) onPipelineChange(p *model.Pipeline) {
 		Time:         time.Now(),
 		Data:         p,
 	}
+	if p.IsMultiBranch() || len(p.BranchStates) > 0 {
+		go a.syncPipelineBranches(p.Id)
+	}
 
 }
 
@@ -169,13 +223,7 @@ func (a *Agent) onPipelineDelete(p *model.Pipeline) {
 	}
 }
 func (a *Agent) onPipelineActivate(p *model.Pipeline) {
-	if p.CronTrigger.Spec != "" {
-		pId := p.Id
-		spec := p.CronTrigger.Spec
-		timezone := p.CronTrigger.Timezone
-		cr := scheduler.NewCronRunner(pId, spec, timezone)
-		a.registerCronRunnerC <- cr
-	}
+	a.scheduleCronRunners(p)
 	a.broadcast <- WSMsg{
 		Id:           uuid.Rand().Hex(),
 		Name:         "resource.change",
@@ -196,84 +244,128 @@ func (a *Agent) onPipelineDeActivate(p *model.Pipeline) {
 	}
 }
 
-//registerCronRunner add or update a cronRunner
-func (a *Agent) registerCronRunner(cr *scheduler.CronRunner) {
-	pId := cr.PipelineId
-	existing := a.cronRunners[pId]
-	logrus.Debugf("registering conrunner,pid:%v,spec:%v", pId, cr.Spec)
-	if existing != nil {
-		if existing.Spec == cr.Spec {
-			return
+//newCronRunners gets cron runners of enabled schedules of the pipeline
+func newCronRunners(p *model.Pipeline) []*scheduler.CronRunner {
+	runners := []*scheduler.CronRunner{}
+	for _, schedule := range p.Schedules() {
+		if schedule.IsEnabled() && schedule.Spec != "" {
+			runners = append(runners, scheduler.NewCronRunner(p.Id, schedule.Name, schedule.Spec, schedule.Timezone))
 		}
-		existing.Stop()
-		delete(a.cronRunners, pId)
 	}
-	if cr.Spec != "" {
-		err := cr.AddFunc(cr.Spec, func() {
-			logrus.Debugf("invoke pipeline %v cron job", cr.PipelineId)
-			ppl, err := service.GetPipelineById(pId)
-			if err != nil {
-				logrus.Errorf("fail to get pipeline:%v", err)
-				return
-			}
+	return runners
+}
 
-			if ppl.CronTrigger.TriggerOnUpdate {
-				//run only when new changes exist
+//scheduleCronRunners registers cron runners of an active pipeline, or removes them when there is no enabled schedule
+func (a *Agent) scheduleCronRunners(p *model.Pipeline) {
+	runners := newCronRunners(p)
+	if !p.IsActivate || len(runners) == 0 {
+		a.unregisterCronRunnerC <- p.Id
+		return
+	}
+	a.registerCronRunnerC <- runners
+}
 
-				gitUser := ppl.Stages[0].Steps[0].GitUser
-				token, err := service.GetUserToken(gitUser)
-				if err != nil {
-					logrus.Errorf("fail to get user credential for %s: %v", gitUser, err)
-					return
-				}
-				repoUrl, err := git.GetAuthRepoUrl(ppl.Stages[0].Steps[0].Repository, gitUser, token)
-				if err != nil {
-					logrus.Errorf("get repo credential got error: %v", err)
-					return
-				}
-				latestCommit, err := git.BranchHeadCommit(repoUrl, ppl.Stages[0].Steps[0].Branch)
-				if err != nil {
-					logrus.Errorf("cron job fail,Error:%v", err)
-					return
-				}
-				if latestCommit == ppl.CommitInfo {
-					//update nextruntime and return
-					ppl.NextRunTime = service.GetNextRunTime(ppl)
-
-					if err := service.UpdatePipeline(ppl); err != nil {
-						logrus.Errorf("update pipeline error,%v", err)
-					}
-					a.broadcast <- WSMsg{
-						Id:           uuid.Rand().Hex(),
-						Name:         "resource.change",
-						ResourceType: "pipeline",
-						Time:         time.Now(),
-						Data:         ppl,
-					}
-					return
-				}
-			}
-			_, err = service.RunPipeline(a.Server.Provider, pId, model.TriggerTypeCron)
-			if err != nil {
-				logrus.Errorf("cron job fail,pid:%v", pId)
-				return
-			}
+//registerCronRunners add or update cron runners of a pipeline
+func (a *Agent) registerCronRunners(runners []*scheduler.CronRunner) {
+	pId := runners[0].PipelineId
+	existing := a.cronRunners[pId]
+	logrus.Debugf("registering conrunners,pid:%v,size:%v", pId, len(runners))
+	if sameCronRunners(existing, runners) {
+		return
+	}
+	a.unregisterCronRunner(pId)
+	started := []*scheduler.CronRunner{}
+	for _, cr := range runners {
+		scheduleName := cr.ScheduleName
+		err := cr.AddFunc(cr.Spec, func() {
+			a.runSchedule(pId, scheduleName)
 		})
 		if err != nil {
-			logrus.Error("cron addfunc error for pipeline %v:%v", pId, err)
-			return
+			logrus.Errorf("cron addfunc error for pipeline %v schedule %v:%v", pId, scheduleName, err)
+			continue
 		}
 		cr.Start()
-		a.cronRunners[pId] = cr
+		started = append(started, cr)
+	}
+	a.cronRunners[pId] = started
+}
+
+func sameCronRunners(existing []*scheduler.CronRunner, runners []*scheduler.CronRunner) bool {
+	if len(existing) != len(runners) {
+		return false
+	}
+	for i, cr := range runners {
+		if existing[i].ScheduleName != cr.ScheduleName || existing[i].Spec != cr.Spec || existing[i].Timezone != cr.Timezone {
+			return false
+		}
 	}
+	return true
+}
 
+//runSchedule runs the pipeline with the input of a schedule
+func (a *Agent) runSchedule(pId string, scheduleName string) {
+	logrus.Debugf("invoke pipeline %v cron job of schedule %v", pId, scheduleName)
+	ppl, err := service.GetPipelineById(pId)
+	if err != nil {
+		logrus.Errorf("fail to get pipeline:%v", err)
+		return
+	}
+	var schedule *model.CronSchedule
+	for _, s := range ppl.Schedules() {
+		if s.Name == scheduleName {
+			schedule = s
+		}
+	}
+	if schedule == nil || !schedule.IsEnabled() {
+		logrus.Debugf("schedule %v of pipeline %v is removed or disabled", scheduleName, pId)
+		return
+	}
+
+	if schedule.TriggerOnUpdate {
+		//run only when new changes exist
+		scmStep := ppl.Stages[0].Steps[0]
+		branch := scmStep.Branch
+		if schedule.Branch != "" {
+			branch = schedule.Branch
+		}
+		latestCommit, err := service.RemoteBranchHead(scmStep.GitUser, scmStep.Repository, branch)
+		if err != nil {
+			logrus.Errorf("cron job fail,Error:%v", err)
+			return
+		}
+		lastCommit, err := service.LastBuiltCommit(ppl, schedule.Branch)
+		if err != nil {
+			logrus.Errorf("cron job fail,Error:%v", err)
+			return
+		}
+		if latestCommit == lastCommit {
+			//update nextruntime and return
+			ppl.NextRunTime = service.GetNextRunTime(ppl)
+
+			if err := service.UpdatePipeline(ppl); err != nil {
+				logrus.Errorf("update pipeline error,%v", err)
+			}
+			a.broadcast <- WSMsg{
+				Id:           uuid.Rand().Hex(),
+				Name:         "resource.change",
+				ResourceType: "pipeline",
+				Time:         time.Now(),
+				Data:         ppl,
+			}
+			return
+		}
+	}
+	_, err = service.RunPipeline(a.Server.Provider, pId, model.TriggerTypeCron, schedule.RunInput())
+	if err != nil {
+		logrus.Errorf("cron job fail,pid:%v,schedule:%v,err:%v", pId, scheduleName, err)
+		return
+	}
 }
 
 //unregisterCronRunner remove cronrunner for pipeline
 func (a *Agent) unregisterCronRunner(pipelineId string) {
 	logrus.Debugf("unregistering conrunner,pid:%v", pipelineId)
-	existing := a.cronRunners[pipelineId]
-	if existing != nil {
+	for _, existing := range a.cronRunners[pipelineId] {
 		existing.Stop()
 	}
 	delete(a.cronRunners, pipelineId)
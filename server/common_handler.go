@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
@@ -15,6 +17,9 @@ import (
 	"github.com/rancher/pipeline/util"
 )
 
+//tagRunLock serializes webhook runs of tags so a tag is not built twice by its tag push and release
+var tagRunLock sync.Mutex
+
 func (s *Server) Webhook(rw http.ResponseWriter, req *http.Request) error {
 	logrus.Debugf("get header:%v", req.Header)
 	logrus.Debugf("get url:%v", req.RequestURI)
@@ -22,7 +27,17 @@ func (s *Server) Webhook(rw http.ResponseWriter, req *http.Request) error {
 	var manager model.SCManager
 	var err error
 	var eventType string
-	if eventType = req.Header.Get("X-GitHub-Event"); len(eventType) != 0 {
+	if service.IsGenericWebhook(req) {
+		return s.genericWebhook(rw, req)
+	}
+	//gitea sends github and gogs event headers as well
+	if eventType = giteaEventType(req); len(eventType) != 0 {
+		logrus.Debug("receive webhook from gitea")
+		manager, err = service.GetSCManager("gitea")
+		if err != nil {
+			return err
+		}
+	} else if eventType = req.Header.Get("X-GitHub-Event"); len(eventType) != 0 {
 		if eventType == "ping" {
 			return nil
 		}
@@ -37,9 +52,23 @@ func (s *Server) Webhook(rw http.ResponseWriter, req *http.Request) error {
 		if err != nil {
 			return err
 		}
+	} else if eventType = req.Header.Get("X-Event-Key"); len(eventType) != 0 {
+		if eventType == "diagnostics:ping" {
+			return nil
+		}
+		//bitbucket cloud identifies its webhooks by uuid
+		scmType := "bitbucketserver"
+		if req.Header.Get("X-Hook-UUID") != "" {
+			scmType = "bitbucketcloud"
+		}
+		logrus.Debugf("receive webhook from %s", scmType)
+		manager, err = service.GetSCManager(scmType)
+		if err != nil {
+			return err
+		}
 	} else {
-		//TODO generic webhook
-		return errors.New("Unknown webhook source")
+		//generic webhooks may authenticate by the token query parameter
+		return s.genericWebhook(rw, req)
 	}
 
 	id := req.FormValue("pipelineId")
@@ -50,13 +79,68 @@ func (s *Server) Webhook(rw http.ResponseWriter, req *http.Request) error {
 	if !pipeline.IsActivate {
 		return errors.New("pipeline is not activated")
 	}
-	if !manager.VerifyWebhookPayload(pipeline, req) {
+	event, ok := manager.VerifyWebhookPayload(pipeline, req)
+	if !ok {
 		return errors.New("verify webhook fail")
 	}
 
 	logrus.Debugf("token validate pass")
 
-	if _, err = service.RunPipeline(s.Provider, id, model.TriggerTypeWebhook); err != nil {
+	if branch := service.DeletedBranch(event); branch != "" {
+		if _, err := service.RemoveBranch(pipeline, branch); err != nil {
+			return err
+		}
+		rw.Write([]byte("branch is deleted, skip running pipeline"))
+		logrus.Infof("webhook trigger for '%s' skipped, branch '%s' is deleted", pipeline.Name, branch)
+		return nil
+	}
+
+	if pr := event.PullRequest; pr != nil && !service.TrustedPullRequest(pipeline, pr) {
+		rw.Write([]byte("pull request from a fork is not allowed, skip running pipeline"))
+		logrus.Infof("webhook trigger for '%s' skipped, pull request #%d of '%s' is from a fork", pipeline.Name, pr.Number, pr.Author)
+		return nil
+	}
+
+	if event.Type == model.WebhookEventTag || event.Type == model.WebhookEventRelease {
+		//the tag push and the release of a tag come in either order, the one coming later is skipped
+		tagRunLock.Lock()
+		defer tagRunLock.Unlock()
+		built, err := service.TagBuilt(pipeline, event.Tag)
+		if err != nil {
+			return err
+		}
+		if built {
+			rw.Write([]byte("tag is built, skip running pipeline"))
+			logrus.Infof("webhook trigger for '%s' skipped, tag '%s' is built", pipeline.Name, event.Tag)
+			return nil
+		}
+	}
+
+	if !service.ShouldTriggerOnChanges(manager, pipeline, event) {
+		rw.Write([]byte("no changes match path filters, skip running pipeline"))
+		logrus.Infof("webhook trigger for '%s' skipped by path filters", pipeline.Name)
+		return nil
+	}
+
+	input := &model.RunInput{
+		Event: event.Type,
+		Tag:   event.Tag,
+	}
+	if event.Type == model.WebhookEventPush {
+		//build the pushed commit, so the pipeline file is read from the same commit that is checked out
+		input.Commit = event.After
+		if branch := strings.TrimPrefix(event.Ref, "refs/heads/"); branch != pipeline.Stages[0].Steps[0].Branch {
+			//pushes of other branches of multi-branch pipelines
+			input.Branch = branch
+		}
+	}
+	if pr := event.PullRequest; pr != nil {
+		//build the head of the pull request, CICD_GIT_BRANCH is the target branch
+		input.Ref = pr.Ref
+		input.Branch = pr.TargetBranch
+		input.PullRequest = pr
+	}
+	if _, err = service.RunPipeline(s.Provider, id, model.TriggerTypeWebhook, input); err != nil {
 		rw.Write([]byte("run pipeline error!"))
 		return err
 	}
@@ -65,6 +149,48 @@ func (s *Server) Webhook(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+//genericWebhook runs the pipeline with parameters mapped from the request body if the filters are satisfied
+func (s *Server) genericWebhook(rw http.ResponseWriter, req *http.Request) error {
+	//the body is kept for verification
+	id := req.URL.Query().Get("pipelineId")
+	pipeline, err := service.GetPipelineById(id)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	if !pipeline.IsActivate {
+		return errors.New("pipeline is not activated")
+	}
+	body, err := service.VerifyGenericWebhook(pipeline, req)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("receive generic webhook for '%s'", pipeline.Name)
+	input, err := service.GenericWebhookInput(pipeline, body)
+	if err != nil {
+		return err
+	}
+	if input == nil {
+		rw.Write([]byte("filters are not satisfied, skip running pipeline"))
+		logrus.Infof("generic webhook trigger for '%s' skipped by filters", pipeline.Name)
+		return nil
+	}
+	if _, err = service.RunPipeline(s.Provider, id, model.TriggerTypeWebhook, input); err != nil {
+		rw.Write([]byte("run pipeline error!"))
+		return err
+	}
+	rw.Write([]byte("run pipeline success!"))
+	logrus.Infof("generic webhook trigger run for '%s' success", pipeline.Name)
+	return nil
+}
+
+//giteaEventType gets the event type of gitea and gogs webhooks
+func giteaEventType(req *http.Request) string {
+	if eventType := req.Header.Get("X-Gitea-Event"); eventType != "" {
+		return eventType
+	}
+	return req.Header.Get("X-Gogs-Event")
+}
+
 func (s *Server) ServeStatusWS(w http.ResponseWriter, r *http.Request) error {
 	apiContext := api.GetApiContext(r)
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -122,6 +248,7 @@ func (s *Server) StepStart(rw http.ResponseWriter, req *http.Request) error {
 		return errors.New("step index invalid")
 	}
 	service.StartStep(activity, stageOrdinal, stepOrdinal)
+	service.ReportCommitStatus(activity)
 	if err = service.UpdateActivity(activity); err != nil {
 		return err
 	}
@@ -155,19 +282,45 @@ func (s *Server) StepFinish(rw http.ResponseWriter, req *http.Request) error {
 	if stageOrdinal < 0 || stepOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) || stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
 		return errors.New("step index invalid")
 	}
+	wasComplete := service.IsComplete(activity)
+	stepStatus := ""
 	if status == "SUCCESS" {
-		service.SuccessStep(activity, stageOrdinal, stepOrdinal)
-		service.Triggernext(activity, stageOrdinal, stepOrdinal, s.Provider)
+		stepStatus = model.ActivityStepSuccess
 	} else if status == "FAILURE" {
-		service.FailStep(activity, stageOrdinal, stepOrdinal)
+		stepStatus = model.ActivityStepFail
 	}
-
-	//update commitinfo for SCM step
+	if err := req.ParseForm(); err != nil {
+		logrus.Errorf("parse stepfinish form got error:%v", err)
+	}
+	//update commitinfo for SCM step, before evaluating conditions of next steps
 	if stageOrdinal == 0 && stepOrdinal == 0 {
 		activity.CommitInfo = req.FormValue("GIT_COMMIT")
 		activity.EnvVars["CICD_GIT_COMMIT"] = activity.CommitInfo
+		if changedFiles, ok := req.PostForm["CHANGED_FILES"]; ok {
+			activity.ChangedFiles = []string{}
+			for _, content := range changedFiles {
+				for _, file := range strings.Split(content, "\n") {
+					if file = strings.TrimSpace(file); file != "" {
+						activity.ChangedFiles = append(activity.ChangedFiles, file)
+					}
+				}
+			}
+		}
+	}
+	stepStatus = service.ApplyTestReports(activity, stageOrdinal, stepOrdinal, req.PostForm["TEST_REPORTS"], stepStatus)
+	stepStatus = service.ApplyCoverageReports(activity, stageOrdinal, stepOrdinal, req.PostForm["COVERAGE_REPORT"], stepStatus)
+	service.ApplyImageInfo(activity, stageOrdinal, stepOrdinal, req.PostForm["IMAGE_INFO"])
+	if stepStatus == model.ActivityStepSuccess || stepStatus == model.ActivityStepUnstable {
+		//outputs of failed steps are not passed to later steps and downstream pipelines
+		service.ApplyStepOutputs(activity, stageOrdinal, stepOrdinal, req.PostForm["STEP_OUTPUTS"])
+		service.SuccessStep(activity, stageOrdinal, stepOrdinal)
+		activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Status = stepStatus
+		service.Triggernext(activity, stageOrdinal, stepOrdinal, s.Provider)
+	} else if stepStatus == model.ActivityStepFail {
+		service.FailStep(activity, stageOrdinal, stepOrdinal)
 	}
 
+	service.ReportCommitStatus(activity)
 	if err = service.UpdateActivity(activity); err != nil {
 		return err
 	}
@@ -177,6 +330,9 @@ func (s *Server) StepFinish(rw http.ResponseWriter, req *http.Request) error {
 
 	if service.IsComplete(activity) {
 		s.Provider.OnActivityCompelte(activity)
+		if !wasComplete {
+			go service.TriggerDownstreamPipelines(s.Provider, activity)
+		}
 	}
 
 	return nil
@@ -14,11 +14,11 @@ import (
 	"github.com/rancher/go-rancher/client"
 	v2client "github.com/rancher/go-rancher/v2"
 	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/pipelinefile"
 	"github.com/rancher/pipeline/server/service"
 	"github.com/rancher/pipeline/server/webhook"
 	"github.com/rancher/pipeline/util"
 	"github.com/sluu99/uuid"
-	yaml "gopkg.in/yaml.v2"
 )
 
 //ListPipelines query List of pipelines
@@ -29,6 +29,10 @@ func (s *Server) ListPipelines(rw http.ResponseWriter, req *http.Request) error
 		logrus.Debugf("getAccessibleAccounts unrecognized user")
 	}
 	pipelines := service.ListPipelines()
+	for _, p := range pipelines {
+		//per-branch status of multi-branch pipelines
+		p.BranchStates = service.BranchStatuses(p)
+	}
 
 	apiContext.Write(&client.GenericCollection{
 		Data: model.ToPipelineCollections(apiContext, pipelines),
@@ -43,6 +47,7 @@ func (s *Server) ListPipeline(rw http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return fmt.Errorf("fail to get pipeline: %v", err)
 	}
+	r.BranchStates = service.BranchStatuses(r)
 	apiContext.Write(model.ToPipelineResource(apiContext, r))
 	return nil
 }
@@ -66,7 +71,7 @@ func (s *Server) CreatePipeline(rw http.ResponseWriter, req *http.Request) error
 		if templateContent == "" {
 			return fmt.Errorf("got empty pipeline file")
 		}
-		if err := yaml.Unmarshal([]byte(templateContent), &ppl.PipelineContent); err != nil {
+		if err := pipelinefile.Decode([]byte(templateContent), &ppl.PipelineContent); err != nil {
 			return err
 		}
 		logrus.Debugf("got imported pipeline:\n%v", ppl)
@@ -83,6 +88,7 @@ func (s *Server) CreatePipeline(rw http.ResponseWriter, req *http.Request) error
 
 	ppl.Id = uuid.Rand().Hex()
 	ppl.WebHookToken = uuid.Rand().Hex()
+	ppl.GenericWebhookToken = uuid.Rand().Hex()
 	gitUser := ppl.Stages[0].Steps[0].GitUser
 	token, err := service.GetUserToken(gitUser)
 	if err != nil {
@@ -152,7 +158,9 @@ func (s *Server) UpdatePipeline(rw http.ResponseWriter, req *http.Request) error
 		}
 	} else if prevPipeline.Stages[0].Steps[0].Webhook &&
 		ppl.Stages[0].Steps[0].Webhook &&
-		(prevPipeline.Stages[0].Steps[0].Repository != ppl.Stages[0].Steps[0].Repository) {
+		(prevPipeline.Stages[0].Steps[0].Repository != ppl.Stages[0].Steps[0].Repository ||
+			!hasEventTriggers(prevPipeline.Stages[0].Steps[0]) && hasEventTriggers(ppl.Stages[0].Steps[0])) {
+		//webhooks created before event triggers are enabled may lack tag, release and pull request events
 		if err = scManager.DeleteWebhook(prevPipeline, token); err != nil {
 			logrus.Error(err)
 		}
@@ -258,7 +266,7 @@ func (s *Server) ExportPipeline(rw http.ResponseWriter, req *http.Request) error
 	}
 	service.CleanPipeline(r)
 	model.FilterPipeline(r)
-	content, err := yaml.Marshal(r.PipelineContent)
+	content, err := pipelinefile.Encode(&r.PipelineContent)
 	if err != nil {
 		return err
 	}
@@ -269,6 +277,34 @@ func (s *Server) ExportPipeline(rw http.ResponseWriter, req *http.Request) error
 	return nil
 }
 
+//GetGenericWebhook gets the url and the token of the generic webhook of the pipeline
+func (s *Server) GetGenericWebhook(rw http.ResponseWriter, req *http.Request) error {
+	id := mux.Vars(req)["id"]
+	r, err := service.GetPipelineById(id)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
+	}
+	if r.GenericWebhook == nil || !r.GenericWebhook.Enabled {
+		return fmt.Errorf("generic webhook of '%s' is not enabled", r.Name)
+	}
+	if webhook.CIWebhookEndpoint == "" {
+		return fmt.Errorf("webhook endpoint is not available")
+	}
+	b, err := json.Marshal(map[string]string{
+		"url":   fmt.Sprintf("%s&pipelineId=%s", webhook.CIWebhookEndpoint, r.Id),
+		"token": r.GenericWebhookToken,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = rw.Write(b)
+	return err
+}
+
 func (s *Server) RunPipeline(rw http.ResponseWriter, req *http.Request) error {
 	apiContext := api.GetApiContext(req)
 	id := mux.Vars(req)["id"]
@@ -280,7 +316,17 @@ func (s *Server) RunPipeline(rw http.ResponseWriter, req *http.Request) error {
 	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
 		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
 	}
-	activity, err := service.RunPipeline(s.Provider, id, model.TriggerTypeManual)
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	input := &model.RunInput{}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, input); err != nil {
+			return err
+		}
+	}
+	activity, err := service.RunPipeline(s.Provider, id, model.TriggerTypeManual, input)
 	if err != nil {
 		return err
 	}
@@ -288,6 +334,50 @@ func (s *Server) RunPipeline(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+//PlanPipeline renders jobs and evaluates conditions of a saved or unsaved pipeline without running it
+func (s *Server) PlanPipeline(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	input := &model.PlanInput{}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, input); err != nil {
+			return err
+		}
+	}
+	ppl := input.Pipeline
+	if ppl == nil {
+		if id == "" {
+			return fmt.Errorf("pipeline to plan is not provided")
+		}
+		if ppl, err = service.GetPipelineById(id); err != nil {
+			return fmt.Errorf("fail to get pipeline: %v", err)
+		}
+	} else {
+		ppl.Id = id
+		if err := service.Validate(ppl); err != nil {
+			return err
+		}
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, ppl.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", ppl.Stages[0].Steps[0].GitUser)
+	}
+	plan, err := service.PlanPipeline(s.Provider, ppl, input)
+	if err != nil {
+		return err
+	}
+	plan.Resource = client.Resource{
+		Id:   ppl.Id,
+		Type: "pipelinePlan",
+	}
+	apiContext.Write(plan)
+	return nil
+}
+
 func (s *Server) ListActivitiesOfPipeline(rw http.ResponseWriter, req *http.Request) error {
 	apiContext := api.GetApiContext(req)
 	apiClient, err := util.GetRancherClient()
@@ -332,3 +422,34 @@ func (s *Server) ListActivitiesOfPipeline(rw http.ResponseWriter, req *http.Requ
 
 	return nil
 }
+
+//ListTestResultsOfPipeline gets test result trend of the pipeline's activities
+func (s *Server) ListTestResultsOfPipeline(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	pId := mux.Vars(req)["id"]
+	r, err := service.GetPipelineById(pId)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
+	}
+	trends, err := service.GetTestTrend(pId)
+	if err != nil {
+		return err
+	}
+	var data []interface{}
+	for _, trend := range trends {
+		data = append(data, trend)
+	}
+	apiContext.Write(&client.GenericCollection{
+		Data: data,
+	})
+	return nil
+}
+
+//hasEventTriggers checks if the SCM step triggers on tags, releases or pull requests
+func hasEventTriggers(step *model.Step) bool {
+	return len(step.TagPatterns) > 0 || step.ReleaseEvents || step.PullRequests
+}
@@ -44,11 +44,14 @@ func NewRouter(s *Server) *mux.Router {
 	//pipelines
 	router.Methods(http.MethodGet).Path("/v1/pipelines").Handler(f(schemas, s.ListPipelines))
 	router.Methods(http.MethodPost).Path("/v1/pipeline").Handler(f(schemas, s.CreatePipeline))
+	router.Methods(http.MethodPost).Path("/v1/pipelines").Queries("action", "plan").Handler(f(schemas, s.PlanPipeline))
 	router.Methods(http.MethodPost).Path("/v1/pipelines").Handler(f(schemas, s.CreatePipeline))
 	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}").Handler(f(schemas, s.ListPipeline))
 	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/activities").Handler(f(schemas, s.ListActivitiesOfPipeline))
+	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/testresults").Handler(f(schemas, s.ListTestResultsOfPipeline))
 	router.Methods(http.MethodDelete).Path("/v1/pipelines/{id}").Handler(f(schemas, s.DeletePipeline))
 	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/exportconfig").Handler(f(schemas, s.ExportPipeline))
+	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/genericwebhook").Handler(f(schemas, s.GetGenericWebhook))
 	//router.Methods(http.MethodDelete).Path("/v1/pipeline").Handler(f(schemas, s.CleanPipelines))
 
 	//activities
@@ -59,6 +62,7 @@ func NewRouter(s *Server) *mux.Router {
 
 	//scm accounts
 	router.Methods(http.MethodGet).Path("/v1/gitaccounts").Handler(f(schemas, s.ListAccounts))
+	router.Methods(http.MethodPost).Path("/v1/gitaccounts").Handler(f(schemas, s.CreateGitAccount))
 	router.Methods(http.MethodGet).Path("/v1/gitaccounts/{id}").Handler(f(schemas, s.GetAccount))
 	router.Methods(http.MethodGet).Path("/v1/gitaccounts/{id}/repos").Handler(f(schemas, s.GetCacheRepos))
 	//settings
@@ -67,6 +71,13 @@ func NewRouter(s *Server) *mux.Router {
 	router.Methods(http.MethodGet).Path("/v1/scmsettings/{id}").Handler(f(schemas, s.GetSCMSetting))
 	router.Methods(http.MethodGet).Path("/v1/scmsettings").Handler(f(schemas, s.ListSCMSetting))
 
+	//step templates
+	router.Methods(http.MethodGet).Path("/v1/steptemplates").Handler(f(schemas, s.ListStepTemplates))
+	router.Methods(http.MethodPost).Path("/v1/steptemplates").Handler(f(schemas, s.CreateStepTemplate))
+	router.Methods(http.MethodGet).Path("/v1/steptemplates/{id}").Handler(f(schemas, s.GetStepTemplate))
+	router.Methods(http.MethodDelete).Path("/v1/steptemplates/{id}").Handler(f(schemas, s.RemoveStepTemplate))
+	router.Methods(http.MethodGet).Path("/v1/steptemplates/{id}/exportconfig").Handler(f(schemas, s.ExportStepTemplate))
+
 	router.Methods(http.MethodGet).Path("/v1/envvars").Handler(f(schemas, s.ListEnvVars))
 
 	//websockets
@@ -86,6 +97,7 @@ func NewRouter(s *Server) *mux.Router {
 		"deactivate": f(schemas, s.DeActivatePipeline),
 		"remove":     f(schemas, s.DeletePipeline),
 		"export":     f(schemas, s.ExportPipeline),
+		"plan":       f(schemas, s.PlanPipeline),
 	}
 	for name, actions := range pipelineActions {
 		router.Methods(http.MethodPost).Path("/v1/pipelines/{id}").Queries("action", name).Handler(actions)
@@ -129,5 +141,14 @@ func NewRouter(s *Server) *mux.Router {
 	for name, actions := range accountActions {
 		router.Methods(http.MethodPost).Path("/v1/gitaccounts/{id}").Queries("action", name).Handler(actions)
 	}
+
+	stepTemplateActions := map[string]http.Handler{
+		"update": f(schemas, s.UpdateStepTemplate),
+		"remove": f(schemas, s.RemoveStepTemplate),
+		"export": f(schemas, s.ExportStepTemplate),
+	}
+	for name, actions := range stepTemplateActions {
+		router.Methods(http.MethodPost).Path("/v1/steptemplates/{id}").Queries("action", name).Handler(actions)
+	}
 	return router
 }
@@ -62,9 +62,14 @@ func Preset(provider model.PipelineProvider) {
 			logrus.Errorf("Sync activity Error:%v", err)
 			continue
 		}
+		service.ReportCommitStatus(a)
 		if err := service.UpdateActivity(a); err != nil {
 			logrus.Errorf("Update activity Error:%v", err)
 		}
+		//activities completed while the server was down
+		if service.IsComplete(a) {
+			service.TriggerDownstreamPipelines(provider, a)
+		}
 	}
 }
 
@@ -4,16 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"regexp"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/pipeline/git"
 	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/scm"
 	"github.com/rancher/pipeline/util"
 )
 
 const GIT_ACCOUNT_TYPE = "gitaccount"
 const REPO_CACHE_TYPE = "repocache"
 
+var regGitAccountName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
 func RefreshRepos(accountId string) ([]*model.GitRepository, error) {
 
 	account, err := GetAccount(accountId)
@@ -229,6 +235,39 @@ func CreateAccount(account *model.GitAccount) error {
 	return err
 }
 
+//CreateGitAccount creates a plain git account using the ssh key, the username and password, or no credential.
+//The credential is checked against the repository if it is not empty.
+func CreateGitAccount(account *model.GitAccount, repository string) error {
+	if !regGitAccountName.MatchString(account.Name) {
+		return fmt.Errorf("invalid account name '%s'", account.Name)
+	}
+	if account.SSHKey != "" {
+		if account.AccessToken != "" {
+			return fmt.Errorf("either ssh key or password should be provided")
+		}
+		if account.KnownHosts == "" {
+			return fmt.Errorf("known hosts should be provided to verify servers for ssh")
+		}
+	} else if (account.Login == "") != (account.AccessToken == "") {
+		return fmt.Errorf("both username and password should be provided")
+	}
+	account.Id = model.GitAccountType + ":" + account.Name
+	account.AccountType = model.GitAccountType
+	account.Private = false
+	account.RefreshToken = ""
+	account.TokenExpiry = 0
+	if existing, err := GetAccount(account.Id); err == nil && existing != nil {
+		return fmt.Errorf("git account '%s' exists", account.Name)
+	}
+	if repository != "" {
+		manager := scm.GitManager{Account: account}
+		if _, err := manager.BranchHeadCommit(repository, "HEAD"); err != nil {
+			return fmt.Errorf("fail to access '%s' using the account: %v", repository, err)
+		}
+	}
+	return CreateAccount(account)
+}
+
 func GetCacheRepoList(accountId string) ([]*model.GitRepository, error) {
 	apiClient, err := util.GetRancherClient()
 	if err != nil {
@@ -432,6 +471,48 @@ func ValidAccountAccessById(uid string, accountId string) bool {
 	return true
 }
 
+//tokenRefresher is a source code manager whose access tokens expire
+type tokenRefresher interface {
+	RefreshToken(account *model.GitAccount) error
+}
+
+//ListExpiringAccounts lists accounts with refresh tokens whose access tokens expire within the duration
+func ListExpiringAccounts(within time.Duration) ([]*model.GitAccount, error) {
+	geObjList, err := PaginateGenericObjects(GIT_ACCOUNT_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(within).Unix()
+	accounts := []*model.GitAccount{}
+	for _, gobj := range geObjList {
+		account := &model.GitAccount{}
+		if err := json.Unmarshal([]byte(gobj.ResourceData["data"].(string)), account); err != nil {
+			logrus.Errorf("parse data got error:%v", err)
+			continue
+		}
+		if account.RefreshToken != "" && account.TokenExpiry > 0 && account.TokenExpiry < deadline {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+//RefreshAccountToken gets a new access token of the account by its refresh token and saves it
+func RefreshAccountToken(account *model.GitAccount) error {
+	manager, err := GetSCManager(account.AccountType)
+	if err != nil {
+		return err
+	}
+	refresher, ok := manager.(tokenRefresher)
+	if !ok {
+		return fmt.Errorf("tokens of '%s' accounts can not be refreshed", account.AccountType)
+	}
+	if err := refresher.RefreshToken(account); err != nil {
+		return err
+	}
+	return UpdateAccount(account)
+}
+
 func GetUserToken(gitUser string) (string, error) {
 	account, err := GetAccount(gitUser)
 	if err != nil {
@@ -439,3 +520,20 @@ func GetUserToken(gitUser string) (string, error) {
 	}
 	return account.AccessToken, nil
 }
+
+//RemoteBranchHead gets the head commit of the branch in the repository using credentials of the git account
+func RemoteBranchHead(gitUser string, repository string, branch string) (string, error) {
+	account, err := GetAccount(gitUser)
+	if err != nil {
+		return "", err
+	}
+	if account.AccountType == model.GitAccountType {
+		manager := scm.GitManager{Account: account}
+		return manager.BranchHeadCommit(repository, branch)
+	}
+	repoUrl, err := git.GetAuthRepoUrl(repository, gitUser, account.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	return git.BranchHeadCommit(repoUrl, branch)
+}
@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/stepscript"
 	"github.com/rancher/pipeline/util"
+	"github.com/sluu99/uuid"
 )
 
 func ListActivities() ([]*model.Activity, error) {
@@ -79,6 +82,25 @@ func CreateActivity(activity *model.Activity) error {
 	return nil
 }
 
+//CreateFailedActivity records a run of the pipeline which fails before any stage starts
+func CreateFailedActivity(p *model.Pipeline, triggerType string, message string) (*model.Activity, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	activity := &model.Activity{
+		Id:          uuid.Rand().Hex(),
+		Pipeline:    *p,
+		RunSequence: p.RunCount + 1,
+		Status:      model.ActivityFail,
+		FailMessage: message,
+		StartTS:     now,
+		StopTS:      now,
+		TriggerType: triggerType,
+	}
+	if err := CreateActivity(activity); err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
 func UpdateActivity(activity *model.Activity) error {
 	logrus.Debugf("updating activity %v.", activity.Id)
 	logrus.Debugf("activity stages:%v", activity.ActivityStages)
@@ -154,6 +176,9 @@ func RerunActivity(provider model.PipelineProvider, activity *model.Activity) er
 	if activity.Status == model.ActivityBuilding || activity.Status == model.ActivityWaiting {
 		return errors.New("not allow to rerun a running activity")
 	}
+	if len(activity.ActivityStages) == 0 {
+		return errors.New("the activity has no stage to rerun, run the pipeline instead")
+	}
 	ResetActivityStatus(activity)
 
 	if err := provider.RerunActivity(activity); err != nil {
@@ -169,6 +194,9 @@ func ResetActivityStatus(activity *model.Activity) {
 	activity.PendingStage = 0
 	activity.StartTS = 0
 	activity.StopTS = 0
+	activity.Coverage = nil
+	activity.Images = nil
+	activity.ReportedStatuses = nil
 	for _, stage := range activity.ActivityStages {
 		stage.Duration = 0
 		stage.StartTS = 0
@@ -177,6 +205,10 @@ func ResetActivityStatus(activity *model.Activity) {
 			step.Duration = 0
 			step.StartTS = 0
 			step.Status = model.ActivityStepWaiting
+			step.TestResult = nil
+			step.Coverage = nil
+			step.Image = nil
+			step.Outputs = nil
 		}
 	}
 }
@@ -286,7 +318,7 @@ func IsStageSuccess(stage *model.ActivityStage) bool {
 	}
 	successSteps := 0
 	for _, step := range stage.ActivitySteps {
-		if step.Status == model.ActivityStepSuccess || step.Status == model.ActivityStepSkip {
+		if step.Status == model.ActivityStepSuccess || step.Status == model.ActivityStepSkip || step.Status == model.ActivityStepUnstable {
 			successSteps++
 		}
 	}
@@ -375,3 +407,68 @@ func Triggernext(activity *model.Activity, stageOrdinal int, stepOrdinal int, pr
 		}
 	}
 }
+
+//ApplyImageInfo records the image built by a build step in the activity,
+//infos are `key=val` lines of the image env vars
+func ApplyImageInfo(activity *model.Activity, stageOrdinal int, stepOrdinal int, infos []string) {
+	step := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal]
+	if step.Type != model.StepTypeBuild || len(infos) == 0 {
+		return
+	}
+	prefix := model.BuildImageVarPrefix(step, stageOrdinal, stepOrdinal)
+	image := &model.BuildImage{
+		StepName: step.Name,
+		Name:     step.TargetImage,
+		Tags:     step.Tags,
+	}
+	if activity.EnvVars == nil {
+		activity.EnvVars = map[string]string{}
+	}
+	for _, info := range infos {
+		for _, line := range strings.Split(info, "\n") {
+			splits := strings.SplitN(strings.TrimSpace(line), "=", 2)
+			if len(splits) != 2 || !strings.HasPrefix(splits[0], prefix+"_") {
+				continue
+			}
+			activity.EnvVars[splits[0]] = splits[1]
+			switch splits[0] {
+			case prefix + "_IMAGE_ID":
+				image.ImageId = splits[1]
+			case prefix + "_DIGEST":
+				image.Digest = splits[1]
+			case prefix + "_IMAGE":
+				image.Reference = splits[1]
+			}
+		}
+	}
+	activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Image = image
+	for i, existing := range activity.Images {
+		if existing.StepName == image.StepName && existing.Name == image.Name {
+			activity.Images[i] = image
+			return
+		}
+	}
+	activity.Images = append(activity.Images, image)
+}
+
+//ApplyStepOutputs merges outputs written by a step into the env vars of the activity,
+//variables prefixed with CICD_ are reserved
+func ApplyStepOutputs(activity *model.Activity, stageOrdinal int, stepOrdinal int, contents []string) {
+	actiStep := activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+	if activity.EnvVars == nil {
+		activity.EnvVars = map[string]string{}
+	}
+	for _, content := range contents {
+		for k, v := range stepscript.ParseOutputs(content) {
+			if strings.HasPrefix(k, "CICD_") {
+				logrus.Warningf("step '%s' cannot output reserved variable '%s'", actiStep.Name, k)
+				continue
+			}
+			if actiStep.Outputs == nil {
+				actiStep.Outputs = map[string]string{}
+			}
+			actiStep.Outputs[k] = v
+			activity.EnvVars[k] = v
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+)
+
+//activityBranch gets the branch of a run tracked in a branch state of the multi-branch pipeline,
+//empty for runs of the branch of the SCM step, tags, commits, pull requests and branches not built by the pipeline
+func activityBranch(p *model.Pipeline, activity *model.Activity) string {
+	if !p.IsMultiBranch() || activity.PullRequest != nil {
+		return ""
+	}
+	if len(activity.Pipeline.Stages) == 0 || len(activity.Pipeline.Stages[0].Steps) == 0 {
+		return ""
+	}
+	scmStep := p.Stages[0].Steps[0]
+	branch := activity.Pipeline.Stages[0].Steps[0].Branch
+	if branch == "" || branch == scmStep.Branch || !scmStep.MatchBranch(branch) {
+		return ""
+	}
+	return branch
+}
+
+//updateLastBranchRun records the run in the state of its branch
+func updateLastBranchRun(p *model.Pipeline, branch string, activity *model.Activity) {
+	state := p.GetBranchState(branch)
+	if state == nil {
+		state = &model.BranchState{Branch: branch}
+		p.BranchStates = append(p.BranchStates, state)
+	}
+	state.LastRunId = activity.Id
+	state.LastRunStatus = activity.Status
+	state.LastRunTime = activity.StartTS
+	state.NextRunTime = branchNextRunTime(p, branch)
+}
+
+//UpdateLastBranchActivity updates the state of the branch on changes of its last run,
+//it returns false if the activity is not the last run of a branch
+func UpdateLastBranchActivity(p *model.Pipeline, activity *model.Activity) (bool, error) {
+	branch := activityBranch(p, activity)
+	if branch == "" {
+		return false, nil
+	}
+	return setBranchStates(p, func(current *model.Pipeline) (bool, error) {
+		state := current.GetBranchState(branch)
+		if state == nil || state.LastRunId != activity.Id {
+			return false, nil
+		}
+		state.LastRunStatus = activity.Status
+		state.CommitInfo = activity.CommitInfo
+		state.NextRunTime = branchNextRunTime(current, branch)
+		return true, nil
+	})
+}
+
+//branchNextRunTime gets the earliest next run time of enabled schedules building the branch
+func branchNextRunTime(p *model.Pipeline, branch string) int64 {
+	nextRunTime := int64(0)
+	if !p.IsActivate {
+		return nextRunTime
+	}
+	for _, schedule := range p.Schedules() {
+		if !schedule.IsEnabled() || schedule.Branch != branch {
+			continue
+		}
+		next := scheduleNextRunTime(schedule)
+		if next > 0 && (nextRunTime == 0 || next < nextRunTime) {
+			nextRunTime = next
+		}
+	}
+	return nextRunTime
+}
+
+//BranchStatuses gets states of branches of the multi-branch pipeline with next run times of now
+func BranchStatuses(p *model.Pipeline) []*model.BranchState {
+	for _, state := range p.BranchStates {
+		state.NextRunTime = branchNextRunTime(p, state.Branch)
+	}
+	return p.BranchStates
+}
+
+//SyncPipelineBranches discovers branches of the multi-branch pipeline in the repository,
+//matching branches are tracked and activities of branches removed from the repository are cleaned up.
+//Branches no longer matching the patterns are untracked and keep their activities.
+//It returns whether the branch states of the pipeline are changed.
+func SyncPipelineBranches(p *model.Pipeline) (bool, error) {
+	if !p.IsMultiBranch() {
+		if len(p.BranchStates) == 0 {
+			return false, nil
+		}
+		return setBranchStates(p, func(current *model.Pipeline) (bool, error) {
+			changed := len(current.BranchStates) > 0
+			current.BranchStates = nil
+			return changed, nil
+		})
+	}
+	scmStep := p.Stages[0].Steps[0]
+	manager, err := GetSCManagerFromUserID(scmStep.GitUser)
+	if err != nil {
+		return false, err
+	}
+	token, err := GetUserToken(scmStep.GitUser)
+	if err != nil {
+		return false, err
+	}
+	branches, err := manager.GetBranches(p, token)
+	if err != nil {
+		return false, err
+	}
+	if len(branches) == 0 {
+		//an empty list more likely means a failed discovery than a repository without branches
+		return false, errors.New("no branch found in the repository")
+	}
+	exists := map[string]bool{}
+	for _, branch := range branches {
+		exists[branch] = true
+	}
+	return setBranchStates(p, func(current *model.Pipeline) (bool, error) {
+		changed := false
+		states := []*model.BranchState{}
+		for _, state := range current.BranchStates {
+			if exists[state.Branch] && scmStep.MatchBranch(state.Branch) && state.Branch != scmStep.Branch {
+				states = append(states, state)
+				continue
+			}
+			changed = true
+			if !exists[state.Branch] {
+				logrus.Infof("branch '%s' of pipeline '%s' is removed", state.Branch, current.Name)
+				if err := deleteBranchActivities(current, state.Branch); err != nil {
+					return false, err
+				}
+			}
+		}
+		current.BranchStates = states
+		for _, branch := range branches {
+			if branch == scmStep.Branch || !scmStep.MatchBranch(branch) || current.GetBranchState(branch) != nil {
+				continue
+			}
+			current.BranchStates = append(current.BranchStates, &model.BranchState{
+				Branch:      branch,
+				NextRunTime: branchNextRunTime(current, branch),
+			})
+			changed = true
+		}
+		return changed, nil
+	})
+}
+
+//setBranchStates updates branch states of the stored pipeline and copies them to the pipeline,
+//it returns whether they are changed
+func setBranchStates(p *model.Pipeline, update func(current *model.Pipeline) (bool, error)) (bool, error) {
+	changed := false
+	updated, err := updateBranchStates(p.Id, func(current *model.Pipeline) (bool, error) {
+		var err error
+		changed, err = update(current)
+		return changed, err
+	})
+	if err != nil {
+		return false, err
+	}
+	p.BranchStates = updated.BranchStates
+	return changed, nil
+}
+
+//DeletedBranch gets the branch deleted by a push event, empty if the push does not delete a branch
+func DeletedBranch(event *model.WebhookEvent) string {
+	if event.Type != model.WebhookEventPush || !strings.HasPrefix(event.Ref, "refs/heads/") {
+		return ""
+	}
+	if event.After != "" && strings.Trim(event.After, "0") != "" {
+		return ""
+	}
+	return strings.TrimPrefix(event.Ref, "refs/heads/")
+}
+
+//RemoveBranch stops tracking a branch deleted from the repository and deletes its activities,
+//it returns false if the branch is not tracked by the pipeline
+func RemoveBranch(p *model.Pipeline, branch string) (bool, error) {
+	if p.GetBranchState(branch) == nil {
+		return false, nil
+	}
+	return setBranchStates(p, func(current *model.Pipeline) (bool, error) {
+		if current.GetBranchState(branch) == nil {
+			return false, nil
+		}
+		if err := deleteBranchActivities(current, branch); err != nil {
+			return false, err
+		}
+		states := []*model.BranchState{}
+		for _, state := range current.BranchStates {
+			if state.Branch != branch {
+				states = append(states, state)
+			}
+		}
+		current.BranchStates = states
+		return true, nil
+	})
+}
+
+//deleteBranchActivities deletes completed activities of the pipeline on the branch, pull request builds are kept
+func deleteBranchActivities(p *model.Pipeline, branch string) error {
+	activities, err := ListActivities()
+	if err != nil {
+		return err
+	}
+	for _, a := range activities {
+		if a.Pipeline.Id != p.Id || a.PullRequest != nil || !IsComplete(a) {
+			continue
+		}
+		if len(a.Pipeline.Stages) == 0 || len(a.Pipeline.Stages[0].Steps) == 0 || a.Pipeline.Stages[0].Steps[0].Branch != branch {
+			continue
+		}
+		if err := DeleteActivity(a.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
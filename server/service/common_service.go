@@ -64,6 +64,10 @@ func getGenericObjects(kind string, limit string, marker string) ([]client.Gener
 }
 
 func GetSCManager(scmType string) (model.SCManager, error) {
+	if scmType == model.GitAccountType {
+		//plain git servers have no setting
+		return &scm.GitManager{}, nil
+	}
 	s, err := GetSCMSetting(scmType)
 	if err != nil {
 		return nil, err
@@ -74,6 +78,14 @@ func GetSCManager(scmType string) (model.SCManager, error) {
 		manager = &scm.GithubManager{}
 	case "gitlab":
 		manager = &scm.GitlabManager{}
+	case "bitbucketcloud":
+		manager = &scm.BitbucketCloudManager{}
+	case "bitbucketserver":
+		manager = &scm.BitbucketServerManager{}
+	case "gitea":
+		manager = &scm.GiteaManager{}
+	default:
+		return nil, fmt.Errorf("unsupported scmType '%s'", s.ScmType)
 	}
 	manager = manager.Config(s)
 	return manager, nil
@@ -90,6 +102,14 @@ func GetSCManagerFromSetting(s *model.SCMSetting) (model.SCManager, error) {
 		manager = &scm.GithubManager{}
 	case "gitlab":
 		manager = &scm.GitlabManager{}
+	case "bitbucketcloud":
+		manager = &scm.BitbucketCloudManager{}
+	case "bitbucketserver":
+		manager = &scm.BitbucketServerManager{}
+	case "gitea":
+		manager = &scm.GiteaManager{}
+	default:
+		return nil, fmt.Errorf("unsupported scmType '%s'", s.ScmType)
 	}
 	manager = manager.Config(s)
 	return manager, nil
@@ -101,6 +121,13 @@ func GetSCManagerFromUserID(userId string) (model.SCManager, error) {
 		return nil, fmt.Errorf("invalid userId '%s'", userId)
 	}
 	scmType := splits[0]
+	if scmType == model.GitAccountType {
+		account, err := GetAccount(userId)
+		if err != nil {
+			return nil, err
+		}
+		return &scm.GitManager{Account: account}, nil
+	}
 	return GetSCManager(scmType)
 }
 
@@ -126,6 +153,9 @@ func Reset() error {
 	if err := cleanGO("pipelineCred"); err != nil {
 		return err
 	}
+	if err := cleanGO(STEP_TEMPLATE_TYPE); err != nil {
+		return err
+	}
 	return nil
 }
 
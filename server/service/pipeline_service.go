@@ -4,13 +4,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/pipeline/condition"
 	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/pipelinefile"
 	"github.com/rancher/pipeline/util"
 	"github.com/robfig/cron"
+	"github.com/sluu99/uuid"
 )
 
 func GetPipelineById(id string) (*model.Pipeline, error) {
@@ -60,7 +65,13 @@ func CreatePipeline(pipeline *model.Pipeline) error {
 	return err
 }
 
+//UpdatePipeline updates the pipeline, branch states are kept as they are stored,
+//they are changed by updateBranchStates only
 func UpdatePipeline(pipeline *model.Pipeline) error {
+	return updatePipeline(pipeline, false)
+}
+
+func updatePipeline(pipeline *model.Pipeline, setBranchStates bool) error {
 	apiClient, err := util.GetRancherClient()
 	if err != nil {
 		return err
@@ -86,6 +97,14 @@ func UpdatePipeline(pipeline *model.Pipeline) error {
 		return err
 	}
 	pipeline.WebHookToken = prevPipeline.WebHookToken
+	pipeline.GenericWebhookToken = prevPipeline.GenericWebhookToken
+	if pipeline.GenericWebhookToken == "" {
+		//pipelines created before generic webhooks get the token on update
+		pipeline.GenericWebhookToken = uuid.Rand().Hex()
+	}
+	if !setBranchStates {
+		pipeline.BranchStates = prevPipeline.BranchStates
+	}
 
 	b, err := json.Marshal(*pipeline)
 	if err != nil {
@@ -108,6 +127,26 @@ func UpdatePipeline(pipeline *model.Pipeline) error {
 	return nil
 }
 
+//branchStatesLock serializes changes of branch states so concurrent changes are not lost
+var branchStatesLock sync.Mutex
+
+//updateBranchStates changes branch states of the pipeline as it is stored now, other fields are kept.
+//update changes BranchStates of the pipeline and returns whether they are changed,
+//the stored pipeline is returned
+func updateBranchStates(pipelineId string, update func(p *model.Pipeline) (bool, error)) (*model.Pipeline, error) {
+	branchStatesLock.Lock()
+	defer branchStatesLock.Unlock()
+	p, err := GetPipelineById(pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := update(p)
+	if err != nil || !changed {
+		return p, err
+	}
+	return p, updatePipeline(p, true)
+}
+
 func DeletePipeline(id string) (*model.Pipeline, error) {
 	apiClient, err := util.GetRancherClient()
 	if err != nil {
@@ -155,24 +194,267 @@ func ListPipelines() []*model.Pipeline {
 	return pipelines
 }
 
-func RunPipeline(provider model.PipelineProvider, id string, triggerType string) (*model.Activity, error) {
+//RunPipeline runs the pipeline, the input of manual runs can be nil
+func RunPipeline(provider model.PipelineProvider, id string, triggerType string, input *model.RunInput) (*model.Activity, error) {
 	pp, err := GetPipelineById(id)
 	if err != nil {
 		return nil, fmt.Errorf("fail to get pipeline: %v", err)
 	}
 
-	activity, err := provider.RunPipeline(pp, triggerType)
+	toRun, err := ApplyRunInput(pp, input)
 	if err != nil {
 		return nil, err
 	}
+	if pp.File != "" {
+		fileRef := input.GitRef()
+		if input != nil && input.PullRequest != nil {
+			//pull requests from forks can not change the pipeline, it is read from the target branch
+			if input.PullRequest.Fork {
+				fileRef = ""
+			} else if input.PullRequest.HeadCommit != "" {
+				fileRef = input.PullRequest.HeadCommit
+			}
+		}
+		loaded, err := LoadPipelineFile(toRun, pp.Stages[0].Steps[0], fileRef)
+		if err != nil {
+			logrus.Errorf("load pipeline file for '%s' got error: %v", pp.Name, err)
+			activity, err := CreateFailedActivity(toRun, triggerType, err.Error())
+			if err != nil {
+				return nil, err
+			}
+			updateLastRun(pp, activity)
+			return activity, nil
+		}
+		toRun = loaded
+	}
+	//template steps are expanded in the activity, the pipeline keeps the references
+	expanded, err := ExpandStepTemplates(toRun)
+	if err != nil {
+		return nil, err
+	}
+	activity, err := provider.RunPipeline(expanded, triggerType, input)
+	if err != nil {
+		return nil, err
+	}
+	updateLastRun(pp, activity)
+	return activity, nil
+}
 
+//ApplyRunInput gets a copy of the pipeline to run with defaults of parameter definitions and overrides of the input.
+//Override values are checked against the parameter definitions.
+//Branch and tag refs of the input are normalized to its branch and tag.
+func ApplyRunInput(p *model.Pipeline, input *model.RunInput) (*model.Pipeline, error) {
+	if input == nil {
+		input = &model.RunInput{}
+	}
+	if err := normalizeRunRef(input); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	values := map[string]string{}
+	for _, envvar := range p.Parameters {
+		splits := strings.SplitN(envvar, "=", 2)
+		if len(splits) != 2 {
+			continue
+		}
+		if _, ok := values[splits[0]]; !ok {
+			keys = append(keys, splits[0])
+		}
+		values[splits[0]] = splits[1]
+	}
+	definitions := map[string]*model.ParameterDefinition{}
+	for _, def := range p.ParameterDefinitions {
+		definitions[def.Name] = def
+		if _, ok := values[def.Name]; !ok {
+			keys = append(keys, def.Name)
+			values[def.Name] = parameterDefault(def)
+		}
+	}
+	for k, v := range input.Parameters {
+		if _, ok := values[k]; !ok {
+			return nil, fmt.Errorf("pipeline '%s' has no parameter '%s'", p.Name, k)
+		}
+		if def := definitions[k]; def != nil {
+			if err := checkParameterValue(def, v); err != nil {
+				return nil, err
+			}
+		}
+		values[k] = v
+	}
+	toRun := *p
+	toRun.Parameters = []string{}
+	for _, k := range keys {
+		toRun.Parameters = append(toRun.Parameters, k+"="+values[k])
+	}
+	//tags and other refs are not on the branch of the pipeline unless the branch is given
+	detached := input.Tag != "" || input.Ref != ""
+	if (input.Branch != "" || detached) && len(p.Stages) > 0 && len(p.Stages[0].Steps) > 0 {
+		scmStage := *p.Stages[0]
+		scmStep := *scmStage.Steps[0]
+		scmStep.Branch = input.Branch
+		scmStage.Steps = append([]*model.Step{&scmStep}, scmStage.Steps[1:]...)
+		toRun.Stages = append([]*model.Stage{&scmStage}, p.Stages[1:]...)
+	}
+	return &toRun, nil
+}
+
+//normalizeRunRef checks the commit, tag and ref to build, refs of branches and tags are moved to the branch and the tag
+func normalizeRunRef(input *model.RunInput) error {
+	set := 0
+	for _, v := range []string{input.Commit, input.Tag, input.Ref} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("only one of commit, tag and ref can be set")
+	}
+	if input.Commit != "" && !regCommitSHA.MatchString(input.Commit) {
+		return fmt.Errorf("invalid commit '%s', a commit SHA is expected", input.Commit)
+	}
+	if input.Ref == "" {
+		return nil
+	}
+	if !strings.HasPrefix(input.Ref, "refs/") {
+		return fmt.Errorf("invalid ref '%s', a full ref like refs/tags/v1.0 is expected", input.Ref)
+	}
+	if strings.HasPrefix(input.Ref, "refs/heads/") {
+		branch := strings.TrimPrefix(input.Ref, "refs/heads/")
+		if input.Branch != "" && input.Branch != branch {
+			return fmt.Errorf("ref '%s' conflicts with branch '%s'", input.Ref, input.Branch)
+		}
+		input.Branch = branch
+		input.Ref = ""
+	} else if strings.HasPrefix(input.Ref, "refs/tags/") {
+		input.Tag = strings.TrimPrefix(input.Ref, "refs/tags/")
+		input.Ref = ""
+	}
+	return nil
+}
+
+//parameterDefault gets the default value of a parameter,
+//boolean parameters are false and choice parameters are the first choice if not set
+func parameterDefault(def *model.ParameterDefinition) string {
+	if def.Default != "" {
+		return def.Default
+	}
+	switch def.Type {
+	case model.ParameterTypeBoolean:
+		return "false"
+	case model.ParameterTypeChoice:
+		if len(def.Choices) > 0 {
+			return def.Choices[0]
+		}
+	}
+	return ""
+}
+
+//PlanPipeline gets what the pipeline runs for the input without running it
+func PlanPipeline(provider model.PipelineProvider, p *model.Pipeline, input *model.PlanInput) (*model.PipelinePlan, error) {
+	runInput := &model.RunInput{}
+	if input != nil {
+		runInput.Parameters = input.Parameters
+	}
+	toPlan, err := ApplyRunInput(p, runInput)
+	if err != nil {
+		return nil, err
+	}
+	if p.File != "" {
+		loaded, err := LoadPipelineFile(toPlan, p.Stages[0].Steps[0], "")
+		if err != nil {
+			return nil, err
+		}
+		toPlan = loaded
+	}
+	expanded, err := ExpandStepTemplates(toPlan)
+	if err != nil {
+		return nil, err
+	}
+	return provider.PlanPipeline(expanded, input)
+}
+
+//updateLastRun records the run in the pipeline,
+//pull request and tag runs are isolated from the branch and only take a run number,
+//runs of other branches of multi-branch pipelines are recorded in their branch states
+func updateLastRun(pp *model.Pipeline, activity *model.Activity) {
 	pp.RunCount = activity.RunSequence
+	if activity.PullRequest != nil || activity.GitTag != "" {
+		UpdatePipeline(pp)
+		return
+	}
+	if branch := activityBranch(pp, activity); branch != "" {
+		UpdatePipeline(pp)
+		if _, err := setBranchStates(pp, func(current *model.Pipeline) (bool, error) {
+			updateLastBranchRun(current, branch, activity)
+			return true, nil
+		}); err != nil {
+			logrus.Errorf("fail to update the state of branch '%s' of pipeline '%s': %v", branch, pp.Name, err)
+		}
+		return
+	}
 	pp.LastRunId = activity.Id
 	pp.LastRunStatus = activity.Status
 	pp.LastRunTime = activity.StartTS
 	pp.NextRunTime = GetNextRunTime(pp)
 	UpdatePipeline(pp)
-	return activity, nil
+}
+
+//LoadPipelineFile gets the pipeline with stages loaded from the pipeline file in the repository,
+//the file is read at the git ref if it is not empty, or at the head of the branch.
+//The SCM step of the pipeline is used in place of the one in the file, the given pipeline is not changed.
+//The pipeline is validated with the stored SCM step, as the SCM step of tag and ref runs has no branch.
+func LoadPipelineFile(p *model.Pipeline, storedSCMStep *model.Step, ref string) (*model.Pipeline, error) {
+	scmStep := p.Stages[0].Steps[0]
+	manager, err := GetSCManagerFromUserID(scmStep.GitUser)
+	if err != nil {
+		return nil, err
+	}
+	token, err := GetUserToken(scmStep.GitUser)
+	if err != nil {
+		return nil, err
+	}
+	if ref == "" {
+		ref = scmStep.Branch
+	}
+	content, err := manager.GetFileContent(p, token, p.File, ref)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read pipeline file '%s' at '%s': %v", p.File, ref, err)
+	}
+	return applyPipelineFile(p, storedSCMStep, content)
+}
+
+//applyPipelineFile gets the pipeline with stages of the pipeline file content
+func applyPipelineFile(p *model.Pipeline, storedSCMStep *model.Step, content []byte) (*model.Pipeline, error) {
+	file := &model.PipelineContent{}
+	if err := pipelinefile.Decode(content, file); err != nil {
+		return nil, fmt.Errorf("invalid pipeline file '%s': %v", p.File, err)
+	}
+	if len(file.Stages) == 0 {
+		return nil, fmt.Errorf("invalid pipeline file '%s': no stage defined", p.File)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	loaded := &model.Pipeline{}
+	if err := json.Unmarshal(b, loaded); err != nil {
+		return nil, err
+	}
+	loaded.Stages = file.Stages
+	first := loaded.Stages[0]
+	if len(first.Steps) == 0 || first.Steps[0].Type != model.StepTypeSCM {
+		first = &model.Stage{
+			Name:  p.Stages[0].Name,
+			Steps: []*model.Step{nil},
+		}
+		loaded.Stages = append([]*model.Stage{first}, loaded.Stages...)
+	}
+	first.Steps[0] = storedSCMStep
+	if err := Validate(loaded); err != nil {
+		return nil, fmt.Errorf("invalid pipeline file '%s': %v", p.File, err)
+	}
+	first.Steps[0] = p.Stages[0].Steps[0]
+	return loaded, nil
 }
 
 func UpdatePipelineEnvKey(p *model.Pipeline) error {
@@ -205,28 +487,138 @@ func HasStageCondition(s *model.Stage) bool {
 	return s.Conditions != nil && (len(s.Conditions.All) > 0 || len(s.Conditions.Any) > 0)
 }
 
+//GetNextRunTime gets the earliest next run time of enabled schedules in milliseconds, 0 if there is none
 func GetNextRunTime(pipeline *model.Pipeline) int64 {
 	nextRunTime := int64(0)
 	if !pipeline.IsActivate {
 		return nextRunTime
 	}
-	trigger := pipeline.CronTrigger
-	spec := trigger.Spec
-	timezone := trigger.Timezone
-	if spec == "" {
-		return nextRunTime
+	for _, schedule := range pipeline.Schedules() {
+		if !schedule.IsEnabled() {
+			continue
+		}
+		next := scheduleNextRunTime(schedule)
+		if next > 0 && (nextRunTime == 0 || next < nextRunTime) {
+			nextRunTime = next
+		}
 	}
+	return nextRunTime
+}
+
+func scheduleNextRunTime(schedule *model.CronSchedule) int64 {
+	spec := schedule.Spec
+	timezone := schedule.Timezone
 	loc, err := time.LoadLocation(timezone)
 	if err != nil {
 		logrus.Errorf("fail get timezone '%s',err:%v", timezone, err)
-		return nextRunTime
+		return 0
 	}
-	schedule, err := cron.ParseStandard(spec)
+	cronSchedule, err := cron.ParseStandard(spec)
 	if err != nil {
 		logrus.Errorf("error parse cron exp,%v,%v", spec, err)
-		return nextRunTime
+		return 0
 	}
-	nextRunTime = schedule.Next(time.Now().In(loc)).UnixNano() / int64(time.Millisecond)
+	return cronSchedule.Next(time.Now().In(loc)).UnixNano() / int64(time.Millisecond)
+}
 
-	return nextRunTime
+//LastBuiltCommit gets the commit built by the last run of the pipeline on the branch
+func LastBuiltCommit(p *model.Pipeline, branch string) (string, error) {
+	if branch == "" || branch == p.Stages[0].Steps[0].Branch {
+		return p.CommitInfo, nil
+	}
+	if state := p.GetBranchState(branch); state != nil && state.CommitInfo != "" {
+		return state.CommitInfo, nil
+	}
+	activities, err := ListActivities()
+	if err != nil {
+		return "", err
+	}
+	var last *model.Activity
+	for _, a := range activities {
+		if a.Pipeline.Id != p.Id || len(a.Pipeline.Stages) == 0 || len(a.Pipeline.Stages[0].Steps) == 0 {
+			continue
+		}
+		if a.Pipeline.Stages[0].Steps[0].Branch != branch || a.CommitInfo == "" {
+			continue
+		}
+		if last == nil || a.RunSequence > last.RunSequence {
+			last = a
+		}
+	}
+	if last == nil {
+		return "", nil
+	}
+	return last.CommitInfo, nil
+}
+
+//TrustedPullRequest checks whether the pull request of a webhook event can be built,
+//pull requests from forks run code of others, only those of authors in pullRequestAuthors are built
+func TrustedPullRequest(p *model.Pipeline, pr *model.PullRequest) bool {
+	if !pr.Fork {
+		return true
+	}
+	for _, author := range p.Stages[0].Steps[0].PullRequestAuthors {
+		if strings.EqualFold(author, pr.Author) {
+			return true
+		}
+	}
+	return false
+}
+
+//TagBuilt checks whether a run of the pipeline triggered by a tag push or a release builds the tag,
+//publishing a release of a new tag sends both events and the tag is built once
+func TagBuilt(p *model.Pipeline, tag string) (bool, error) {
+	activities, err := ListActivities()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range activities {
+		if a.Pipeline.Id != p.Id || a.TriggerType != model.TriggerTypeWebhook || a.GitTag != tag {
+			continue
+		}
+		if a.EventType == model.WebhookEventTag || a.EventType == model.WebhookEventRelease {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//ShouldTriggerOnChanges checks the changed files of a push event against path filters of the pipeline.
+//It falls back to the compare API when the payload does not list all commits,
+//and triggers when changed files cannot be determined.
+func ShouldTriggerOnChanges(manager model.SCManager, p *model.Pipeline, event *model.WebhookEvent) bool {
+	scmStep := p.Stages[0].Steps[0]
+	if len(scmStep.Paths) == 0 && len(scmStep.PathsIgnore) == 0 {
+		return true
+	}
+	if event == nil {
+		return true
+	}
+	files := event.ChangedFiles
+	if event.Truncated || len(files) == 0 {
+		if event.Before == "" || strings.Trim(event.Before, "0") == "" {
+			//new branch, nothing to compare with
+			return true
+		}
+		token, err := GetUserToken(scmStep.GitUser)
+		if err != nil {
+			logrus.Errorf("fail to get user credential for %s: %v", scmStep.GitUser, err)
+			return true
+		}
+		files, err = manager.GetChangedFiles(p, token, event.Before, event.After)
+		if err != nil {
+			logrus.Errorf("fail to get changed files of '%s': %v", p.Name, err)
+			return true
+		}
+	}
+	for _, file := range files {
+		if len(scmStep.Paths) > 0 && !condition.MatchAny(scmStep.Paths, []string{file}) {
+			continue
+		}
+		if condition.MatchAny(scmStep.PathsIgnore, []string{file}) {
+			continue
+		}
+		return true
+	}
+	return false
 }
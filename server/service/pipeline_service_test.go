@@ -0,0 +1,71 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/rancher/pipeline/model"
+)
+
+const testPipelineFile = `version: v2
+stages:
+- name: test
+  steps:
+  - type: task
+    image: golang:1.9
+    shellScript: go test ./...
+`
+
+func newFilePipeline() *model.Pipeline {
+	p := &model.Pipeline{}
+	p.Id = "pipeline1"
+	p.Name = "file-pipeline"
+	p.File = ".rancher-pipeline.yml"
+	p.Stages = []*model.Stage{{
+		Name: "SCM",
+		Steps: []*model.Step{{
+			Type:       model.StepTypeSCM,
+			Repository: "https://github.com/alice/repo.git",
+			Branch:     "master",
+		}},
+	}}
+	return p
+}
+
+func TestApplyPipelineFileOfTagRun(t *testing.T) {
+	p := newFilePipeline()
+	toRun, err := ApplyRunInput(p, &model.RunInput{Tag: "v1"})
+	if err != nil {
+		t.Fatalf("ApplyRunInput: %v", err)
+	}
+	if toRun.Stages[0].Steps[0].Branch != "" {
+		t.Fatalf("tag runs should not build the branch, got '%s'", toRun.Stages[0].Steps[0].Branch)
+	}
+	loaded, err := applyPipelineFile(toRun, p.Stages[0].Steps[0], []byte(testPipelineFile))
+	if err != nil {
+		t.Fatalf("pipeline file of a tag run should be valid: %v", err)
+	}
+	if len(loaded.Stages) != 2 || loaded.Stages[1].Name != "test" || loaded.Stages[1].Steps[0].Image != "golang:1.9" {
+		t.Errorf("stages should be loaded from the file after the SCM stage, got %+v", loaded.Stages)
+	}
+	if scmStep := loaded.Stages[0].Steps[0]; scmStep != toRun.Stages[0].Steps[0] || scmStep.Branch != "" {
+		t.Errorf("the SCM step of the run should be kept, got %+v", scmStep)
+	}
+	if p.Stages[0].Steps[0].Branch != "master" {
+		t.Error("the stored pipeline should not be changed")
+	}
+}
+
+func TestApplyPipelineFileInvalid(t *testing.T) {
+	p := newFilePipeline()
+	invalid := `stages:
+- name: test
+  steps:
+  - type: task
+`
+	if _, err := applyPipelineFile(p, p.Stages[0].Steps[0], []byte(invalid)); err == nil {
+		t.Error("task steps without images should be rejected")
+	}
+	if _, err := applyPipelineFile(p, p.Stages[0].Steps[0], []byte("version: v2\n")); err == nil {
+		t.Error("pipeline files without stages should be rejected")
+	}
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/report"
+)
+
+//ApplyTestReports parses test reports of a finished step and stores the result in the activity step.
+//It returns the step status decided by the test thresholds of the step.
+func ApplyTestReports(activity *model.Activity, stageOrdinal int, stepOrdinal int, reports []string, status string) string {
+	step := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal]
+	actiStep := activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+	if len(step.TestReports) == 0 {
+		return status
+	}
+	results := []*model.TestResult{}
+	for _, content := range reports {
+		r, err := report.ParseTestReport([]byte(content))
+		if err != nil {
+			logrus.Errorf("parse test report for step '%s' got error: %v", step.Name, err)
+			continue
+		}
+		results = append(results, r)
+	}
+	if len(results) == 0 {
+		logrus.Warningf("no test report found for step '%s'", step.Name)
+		return status
+	}
+	result := report.MergeTestResults(results...)
+	actiStep.TestResult = result
+	actiStep.Message = fmt.Sprintf("%d tests, %d failed, %d skipped", result.Total, result.Failed, result.Skipped)
+	if status != model.ActivityStepSuccess {
+		return status
+	}
+	if step.TestFailThreshold > 0 && result.Failed >= step.TestFailThreshold {
+		return model.ActivityStepFail
+	}
+	if step.TestUnstableThreshold > 0 && result.Failed >= step.TestUnstableThreshold {
+		return model.ActivityStepUnstable
+	}
+	return status
+}
+
+//ApplyCoverageReports parses coverage reports of a finished step and records the coverage in the activity.
+//It returns the step status decided by the coverage gates of the step.
+func ApplyCoverageReports(activity *model.Activity, stageOrdinal int, stepOrdinal int, reports []string, status string) string {
+	step := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal]
+	actiStep := activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+	if step.CoverageReport == "" {
+		return status
+	}
+	coverages := []*model.Coverage{}
+	for _, content := range reports {
+		c, err := report.ParseCoverageReport([]byte(content))
+		if err != nil {
+			logrus.Errorf("parse coverage report for step '%s' got error: %v", step.Name, err)
+			continue
+		}
+		coverages = append(coverages, c)
+	}
+	if len(coverages) == 0 {
+		logrus.Warningf("no coverage report found for step '%s'", step.Name)
+		return status
+	}
+	coverage := report.MergeCoverages(coverages...)
+	previous := previousCoverage(activity, stageOrdinal, stepOrdinal)
+	actiStep.Coverage = coverage
+	activity.Coverage = activityCoverage(activity)
+	if status != model.ActivityStepSuccess && status != model.ActivityStepUnstable {
+		return status
+	}
+	if step.MinCoverage > 0 && coverage.Percent < step.MinCoverage {
+		actiStep.Message = fmt.Sprintf("coverage %.2f%% is below the minimum %.2f%%", coverage.Percent, step.MinCoverage)
+		return model.ActivityStepFail
+	}
+	if step.MaxCoverageDrop > 0 && previous != nil && *previous-coverage.Percent > step.MaxCoverageDrop {
+		actiStep.Message = fmt.Sprintf("coverage %.2f%% drops more than %.2f%% from %.2f%%", coverage.Percent, step.MaxCoverageDrop, *previous)
+		return model.ActivityStepFail
+	}
+	return status
+}
+
+//activityCoverage gets the coverage of all steps reporting coverage in the activity
+func activityCoverage(activity *model.Activity) *float64 {
+	coverages := []*model.Coverage{}
+	for _, stage := range activity.ActivityStages {
+		for _, step := range stage.ActivitySteps {
+			if step.Coverage != nil {
+				coverages = append(coverages, step.Coverage)
+			}
+		}
+	}
+	merged := report.MergeCoverages(coverages...)
+	if merged == nil {
+		return nil
+	}
+	return &merged.Percent
+}
+
+//previousCoverage gets coverage of the step in the latest former run of the same branch,
+//pull request builds are not taken as the baseline
+func previousCoverage(activity *model.Activity, stageOrdinal int, stepOrdinal int) *float64 {
+	activities, err := ListActivities()
+	if err != nil {
+		logrus.Errorf("list activities got error: %v", err)
+		return nil
+	}
+	branch := activityBranchName(activity)
+	stepName := activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Name
+	var previous *model.Coverage
+	previousSequence := 0
+	for _, a := range activities {
+		if a.Pipeline.Id != activity.Pipeline.Id || a.RunSequence >= activity.RunSequence || a.RunSequence <= previousSequence {
+			continue
+		}
+		if a.PullRequest != nil || activityBranchName(a) != branch {
+			continue
+		}
+		if stageOrdinal >= len(a.ActivityStages) || stepOrdinal >= len(a.ActivityStages[stageOrdinal].ActivitySteps) {
+			continue
+		}
+		step := a.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+		if step.Coverage == nil || step.Name != stepName {
+			continue
+		}
+		previous = step.Coverage
+		previousSequence = a.RunSequence
+	}
+	if previous == nil {
+		return nil
+	}
+	return &previous.Percent
+}
+
+//activityBranchName gets the branch built by the activity, empty for tags and commits
+func activityBranchName(activity *model.Activity) string {
+	if len(activity.Pipeline.Stages) == 0 || len(activity.Pipeline.Stages[0].Steps) == 0 {
+		return ""
+	}
+	return activity.Pipeline.Stages[0].Steps[0].Branch
+}
+
+//GetTestTrend gets test result and coverage summaries of a pipeline's activities
+func GetTestTrend(pipelineId string) ([]*model.TestTrend, error) {
+	activities, err := ListActivities()
+	if err != nil {
+		return nil, err
+	}
+	trends := []*model.TestTrend{}
+	for _, a := range activities {
+		if a.Pipeline.Id != pipelineId {
+			continue
+		}
+		var results []*model.TestResult
+		for _, stage := range a.ActivityStages {
+			for _, step := range stage.ActivitySteps {
+				if step.TestResult != nil {
+					results = append(results, step.TestResult)
+				}
+			}
+		}
+		if len(results) == 0 && a.Coverage == nil {
+			continue
+		}
+		summary := report.MergeTestResults(results...)
+		trend := &model.TestTrend{
+			ActivityId:  a.Id,
+			RunSequence: a.RunSequence,
+			StartTS:     a.StartTS,
+			Status:      a.Status,
+			CommitInfo:  a.CommitInfo,
+			Total:       summary.Total,
+			Passed:      summary.Passed,
+			Failed:      summary.Failed,
+			Skipped:     summary.Skipped,
+			Coverage:    a.Coverage,
+		}
+		trend.Id = a.Id
+		trend.Type = "testTrend"
+		trends = append(trends, trend)
+	}
+	sort.Slice(trends, func(i, j int) bool {
+		return trends[i].RunSequence < trends[j].RunSequence
+	})
+	return trends, nil
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/config"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/util"
+)
+
+const commitStatusContextPrefix = "rancher-pipeline/"
+
+//statusQueueSize is the number of commit status reports waiting to be posted
+const statusQueueSize = 1000
+
+//statusReport is changed statuses of an activity to post to the commit it builds
+type statusReport struct {
+	activityId string
+	pipeline   model.Pipeline
+	commit     string
+	statuses   []*model.CommitStatus
+}
+
+var statusReports = make(chan *statusReport, statusQueueSize)
+var startStatusReporter sync.Once
+
+//ReportCommitStatus queues changed statuses of the activity and its stages to post to the commit it builds,
+//they are posted in order by a background worker so callers holding the activity lock are not blocked.
+//Queued states are recorded in the activity so the activity should be updated afterwards
+func ReportCommitStatus(activity *model.Activity) {
+	if activity == nil || len(activity.Pipeline.Stages) == 0 || len(activity.Pipeline.Stages[0].Steps) == 0 {
+		return
+	}
+	scmStep := activity.Pipeline.Stages[0].Steps[0]
+	commit := statusCommit(activity)
+	if !scmStep.CommitStatus || commit == "" {
+		return
+	}
+	statuses := commitStatuses(activity)
+	changed := []*model.CommitStatus{}
+	for _, status := range statuses {
+		if activity.ReportedStatuses[status.Context] != status.State {
+			changed = append(changed, status)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	startStatusReporter.Do(func() {
+		go postCommitStatuses()
+	})
+	select {
+	case statusReports <- &statusReport{activityId: activity.Id, pipeline: activity.Pipeline, commit: commit, statuses: changed}:
+	default:
+		logrus.Errorf("fail to report commit status of activity '%s': too many statuses to post", activity.Id)
+		return
+	}
+	if activity.ReportedStatuses == nil {
+		activity.ReportedStatuses = map[string]string{}
+	}
+	for _, status := range changed {
+		activity.ReportedStatuses[status.Context] = status.State
+	}
+}
+
+//postCommitStatuses posts queued status reports, requests to source code management servers have a timeout
+func postCommitStatuses() {
+	for report := range statusReports {
+		scmStep := report.pipeline.Stages[0].Steps[0]
+		manager, err := GetSCManagerFromUserID(scmStep.GitUser)
+		if err != nil {
+			logrus.Errorf("fail to report commit status of activity '%s': %v", report.activityId, err)
+			continue
+		}
+		token, err := GetUserToken(scmStep.GitUser)
+		if err != nil {
+			logrus.Errorf("fail to report commit status of activity '%s': %v", report.activityId, err)
+			continue
+		}
+		for _, status := range report.statuses {
+			if err := manager.CreateCommitStatus(&report.pipeline, token, report.commit, status); err != nil {
+				logrus.Errorf("fail to report commit status '%s' of activity '%s': %v", status.Context, report.activityId, err)
+			}
+		}
+	}
+}
+
+//statusCommit gets the commit to report statuses to, which is the head commit of the pull request
+//or the commit checked out by the SCM step, or the commit to build before it is checked out
+func statusCommit(activity *model.Activity) string {
+	if activity.PullRequest != nil && activity.PullRequest.HeadCommit != "" {
+		return activity.PullRequest.HeadCommit
+	}
+	if activity.CommitInfo == "" && activity.GitRef != "" && !strings.HasPrefix(activity.GitRef, "refs/") {
+		return activity.GitRef
+	}
+	return activity.CommitInfo
+}
+
+//commitStatuses gets statuses of the activity and of its started stages if stage statuses are enabled
+func commitStatuses(activity *model.Activity) []*model.CommitStatus {
+	targetURL := activityURL(activity.Id)
+	context := commitStatusContextPrefix + activity.Pipeline.Name
+	statuses := []*model.CommitStatus{
+		{
+			State:       commitState(activity.Status),
+			Context:     context,
+			Description: fmt.Sprintf("Activity #%d: %s", activity.RunSequence, activity.Status),
+			TargetURL:   targetURL,
+		},
+	}
+	if !activity.Pipeline.Stages[0].Steps[0].StageStatus {
+		return statuses
+	}
+	for i, stage := range activity.ActivityStages {
+		//the SCM stage is reported by the activity status
+		if i == 0 || stage.Status == model.ActivityStageWaiting || stage.Status == model.ActivityStageSkip {
+			continue
+		}
+		statuses = append(statuses, &model.CommitStatus{
+			State:       commitState(stage.Status),
+			Context:     context + "/" + stage.Name,
+			Description: fmt.Sprintf("Stage %s: %s", stage.Name, stage.Status),
+			TargetURL:   targetURL,
+		})
+	}
+	return statuses
+}
+
+//commitState maps status of an activity or a stage to a commit state
+func commitState(status string) string {
+	switch status {
+	case model.ActivitySuccess:
+		return model.CommitStateSuccess
+	case model.ActivityFail, model.ActivityDenied:
+		return model.CommitStateFailure
+	case model.ActivityAbort:
+		return model.CommitStateCanceled
+	default:
+		return model.CommitStatePending
+	}
+}
+
+//activityURL gets the link of the activity page by the activity_url setting,
+//or the pipeline page of the rancher UI by default
+func activityURL(id string) string {
+	if config.Config.ActivityURL != "" {
+		if strings.Contains(config.Config.ActivityURL, "%s") {
+			return fmt.Sprintf(config.Config.ActivityURL, id)
+		}
+		return config.Config.ActivityURL
+	}
+	u, err := url.Parse(config.Config.CattleUrl)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	projectId, err := util.GetProjectId()
+	if err != nil {
+		logrus.Errorf("fail to get project id: %v", err)
+		return ""
+	}
+	return fmt.Sprintf("%s://%s/env/%s/pipelines/activities/%s", u.Scheme, u.Host, projectId, id)
+}
@@ -0,0 +1,345 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/pipeline/condition"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/util"
+)
+
+const STEP_TEMPLATE_TYPE = "steptemplate"
+
+//input reference in template steps, like ${inputs.image}
+var regInputRef = regexp.MustCompile(`\$\{inputs\.([A-Za-z_][A-Za-z0-9_-]*)\}`)
+
+func GetStepTemplate(id string) (*model.StepTemplate, error) {
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		return nil, err
+	}
+	filters := make(map[string]interface{})
+	filters["kind"] = STEP_TEMPLATE_TYPE
+	filters["key"] = id
+	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error %v filtering genericObjects by key", err)
+	}
+	if len(goCollection.Data) == 0 {
+		return nil, fmt.Errorf("cannot find step template with id '%s'", id)
+	}
+	template := &model.StepTemplate{}
+	if err = json.Unmarshal([]byte(goCollection.Data[0].ResourceData["data"].(string)), template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+func ListStepTemplates() ([]*model.StepTemplate, error) {
+	geObjList, err := PaginateGenericObjects(STEP_TEMPLATE_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	templates := []*model.StepTemplate{}
+	for _, gobj := range geObjList {
+		t := &model.StepTemplate{}
+		if err := json.Unmarshal([]byte(gobj.ResourceData["data"].(string)), t); err != nil {
+			logrus.Errorf("parse step template got error:%v", err)
+			continue
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+//GetStepTemplateByRef gets the step template referred by `name@version`
+func GetStepTemplateByRef(ref string) (*model.StepTemplate, error) {
+	name, version, err := parseTemplateRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := ListStepTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range templates {
+		if t.Name == name && t.Version == version {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find step template '%s'", ref)
+}
+
+func CreateStepTemplate(template *model.StepTemplate) error {
+	b, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	resourceData := map[string]interface{}{
+		"data": string(b),
+	}
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		return err
+	}
+	_, err = apiClient.GenericObject.Create(&client.GenericObject{
+		Name:         templateRef(template),
+		Key:          template.Id,
+		ResourceData: resourceData,
+		Kind:         STEP_TEMPLATE_TYPE,
+	})
+	return err
+}
+
+func UpdateStepTemplate(template *model.StepTemplate) error {
+	b, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	resourceData := map[string]interface{}{
+		"data": string(b),
+	}
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		return err
+	}
+	filters := make(map[string]interface{})
+	filters["key"] = template.Id
+	filters["kind"] = STEP_TEMPLATE_TYPE
+	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
+		Filters: filters,
+	})
+	if err != nil {
+		logrus.Errorf("Error querying step template:%v", err)
+		return err
+	}
+	if len(goCollection.Data) == 0 {
+		return fmt.Errorf("step template '%s' not found", template.Id)
+	}
+	existing := goCollection.Data[0]
+	_, err = apiClient.GenericObject.Update(&existing, &client.GenericObject{
+		Name:         templateRef(template),
+		Key:          template.Id,
+		ResourceData: resourceData,
+		Kind:         STEP_TEMPLATE_TYPE,
+	})
+	return err
+}
+
+//RemoveStepTemplate removes a step template which is not used by any pipeline
+func RemoveStepTemplate(id string) (*model.StepTemplate, error) {
+	template, err := GetStepTemplate(id)
+	if err != nil {
+		return nil, err
+	}
+	ref := templateRef(template)
+	for _, p := range ListPipelines() {
+		for _, stage := range p.Stages {
+			for _, step := range stage.Steps {
+				if step.Type == model.StepTypeTemplate && step.Template == ref {
+					return nil, fmt.Errorf("step template '%s' is used by pipeline '%s'", ref, p.Name)
+				}
+			}
+		}
+	}
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		return nil, err
+	}
+	filters := make(map[string]interface{})
+	filters["key"] = id
+	filters["kind"] = STEP_TEMPLATE_TYPE
+	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
+		Filters: filters,
+	})
+	if err != nil {
+		logrus.Errorf("Error querying step template:%v", err)
+		return nil, err
+	}
+	if len(goCollection.Data) == 0 {
+		return nil, fmt.Errorf("step template '%s' not found", id)
+	}
+	if err = apiClient.GenericObject.Delete(&goCollection.Data[0]); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+//ExpandStepTemplates gets the pipeline in which template steps are replaced by steps of the templates,
+//the given pipeline is not changed
+func ExpandStepTemplates(p *model.Pipeline) (*model.Pipeline, error) {
+	hasTemplate := false
+	for _, stage := range p.Stages {
+		for _, step := range stage.Steps {
+			if step.Type == model.StepTypeTemplate {
+				hasTemplate = true
+			}
+		}
+	}
+	if !hasTemplate {
+		return p, nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	expanded := &model.Pipeline{}
+	if err := json.Unmarshal(b, expanded); err != nil {
+		return nil, err
+	}
+	for _, stage := range expanded.Stages {
+		steps := []*model.Step{}
+		for _, step := range stage.Steps {
+			if step.Type != model.StepTypeTemplate {
+				steps = append(steps, step)
+				continue
+			}
+			template, err := GetStepTemplateByRef(step.Template)
+			if err != nil {
+				return nil, err
+			}
+			templateSteps, err := RenderStepTemplate(template, step)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, templateSteps...)
+		}
+		stage.Steps = steps
+	}
+	return expanded, nil
+}
+
+//RenderStepTemplate gets steps of the template with inputs of the template step substituted.
+//Name, timeout and conditions of the template step are applied to the generated steps.
+func RenderStepTemplate(template *model.StepTemplate, step *model.Step) ([]*model.Step, error) {
+	inputs, err := resolveTemplateInputs(template, step.With)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	b, err := json.Marshal(template.Steps)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	raw = substituteInputs(raw, inputs)
+	if b, err = json.Marshal(raw); err != nil {
+		return nil, err
+	}
+	steps := []*model.Step{}
+	if err := json.Unmarshal(b, &steps); err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		if step.Name != "" {
+			if len(steps) == 1 || s.Name == "" {
+				s.Name = step.Name
+			} else {
+				s.Name = step.Name + "-" + s.Name
+			}
+		}
+		if s.Timeout == 0 {
+			s.Timeout = step.Timeout
+		}
+		if step.Conditions == nil {
+			continue
+		}
+		if s.Conditions == nil {
+			s.Conditions = &model.PipelineConditions{All: step.Conditions.All, Any: step.Conditions.Any}
+			continue
+		}
+		//both have conditions, all of them should pass
+		all, err := conditionsAsAll(s.Conditions)
+		if err != nil {
+			return nil, err
+		}
+		stepAll, err := conditionsAsAll(step.Conditions)
+		if err != nil {
+			return nil, err
+		}
+		s.Conditions = &model.PipelineConditions{All: append(all, stepAll...)}
+	}
+	return steps, nil
+}
+
+//resolveTemplateInputs checks given input values and fills defaults
+func resolveTemplateInputs(template *model.StepTemplate, with map[string]string) (map[string]string, error) {
+	inputs := map[string]string{}
+	declared := map[string]bool{}
+	for _, input := range template.Inputs {
+		declared[input.Name] = true
+		if v, ok := with[input.Name]; ok {
+			inputs[input.Name] = v
+		} else if input.Required {
+			return nil, fmt.Errorf("required input '%s' of step template '%s' is not provided", input.Name, templateRef(template))
+		} else {
+			inputs[input.Name] = input.Default
+		}
+	}
+	for k := range with {
+		if !declared[k] {
+			return nil, fmt.Errorf("step template '%s' has no input '%s'", templateRef(template), k)
+		}
+	}
+	return inputs, nil
+}
+
+func substituteInputs(v interface{}, inputs map[string]string) interface{} {
+	switch t := v.(type) {
+	case string:
+		return regInputRef.ReplaceAllStringFunc(t, func(ref string) string {
+			return inputs[regInputRef.FindStringSubmatch(ref)[1]]
+		})
+	case []interface{}:
+		for i, item := range t {
+			t[i] = substituteInputs(item, inputs)
+		}
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = substituteInputs(item, inputs)
+		}
+	}
+	return v
+}
+
+//conditionsAsAll converts conditions to a list which should all pass,
+//any conditions are ignored when all conditions exist.
+//Legacy any conditions are converted to expressions to be joined by ||.
+func conditionsAsAll(c *model.PipelineConditions) ([]string, error) {
+	if len(c.All) > 0 || len(c.Any) == 0 {
+		return c.All, nil
+	}
+	if len(c.Any) == 1 {
+		return c.Any, nil
+	}
+	exprs := []string{}
+	for _, expr := range c.Any {
+		converted, err := condition.ToExpression(expr)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, converted)
+	}
+	return []string{"(" + strings.Join(exprs, ") || (") + ")"}, nil
+}
+
+func parseTemplateRef(ref string) (string, string, error) {
+	splits := strings.Split(ref, "@")
+	if len(splits) != 2 || splits[0] == "" || splits[1] == "" {
+		return "", "", fmt.Errorf("invalid step template reference '%s', expected format 'name@version'", ref)
+	}
+	return splits[0], splits[1], nil
+}
+
+func templateRef(template *model.StepTemplate) string {
+	return template.Name + "@" + template.Version
+}
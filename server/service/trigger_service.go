@@ -0,0 +1,120 @@
+package service
+
+import (
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/condition"
+	"github.com/rancher/pipeline/model"
+)
+
+//TriggerDownstreamPipelines runs active pipelines whose pipeline triggers match the completed activity,
+//each downstream pipeline runs once for an activity. Pull request builds trigger no downstream pipeline.
+func TriggerDownstreamPipelines(provider model.PipelineProvider, activity *model.Activity) {
+	if activity == nil || activity.PullRequest != nil {
+		return
+	}
+	status := upstreamStatus(activity)
+	if status == "" {
+		return
+	}
+	upstream := &model.UpstreamRun{
+		PipelineId:   activity.Pipeline.Id,
+		PipelineName: activity.Pipeline.Name,
+		ActivityId:   activity.Id,
+		Status:       status,
+		Commit:       activity.CommitInfo,
+		Branch:       activity.EnvVars["CICD_GIT_BRANCH"],
+	}
+	for _, p := range ListPipelines() {
+		if !p.IsActivate {
+			continue
+		}
+		for _, trigger := range p.PipelineTriggers {
+			if !matchPipelineTrigger(trigger, upstream) {
+				continue
+			}
+			input := &model.RunInput{
+				Parameters: map[string]string{},
+				Upstream:   upstream,
+			}
+			for name, value := range trigger.Parameters {
+				input.Parameters[name] = os.Expand(value, func(key string) string {
+					return activity.EnvVars[key]
+				})
+			}
+			if _, err := RunPipeline(provider, p.Id, model.TriggerTypePipeline, input); err != nil {
+				logrus.Errorf("fail to run downstream pipeline '%s' of '%s': %v", p.Name, upstream.PipelineName, err)
+			} else {
+				logrus.Infof("pipeline trigger run for '%s' by '%s' success", p.Name, upstream.PipelineName)
+			}
+			break
+		}
+	}
+}
+
+//upstreamStatus gets the pipeline trigger status of the completed activity,
+//empty for aborted and denied activities which trigger nothing
+func upstreamStatus(activity *model.Activity) string {
+	switch activity.Status {
+	case model.ActivitySuccess:
+		return model.PipelineTriggerSuccess
+	case model.ActivityFail:
+		return model.PipelineTriggerFailure
+	}
+	return ""
+}
+
+func matchPipelineTrigger(trigger *model.PipelineTrigger, upstream *model.UpstreamRun) bool {
+	if trigger.Pipeline != upstream.PipelineName {
+		return false
+	}
+	switch trigger.Status {
+	case "", model.PipelineTriggerSuccess:
+		if upstream.Status != model.PipelineTriggerSuccess {
+			return false
+		}
+	case model.PipelineTriggerFailure:
+		if upstream.Status != model.PipelineTriggerFailure {
+			return false
+		}
+	}
+	return len(trigger.Branches) == 0 || condition.MatchAny(trigger.Branches, []string{upstream.Branch})
+}
+
+//findTriggerLoop finds a loop of pipeline triggers through the pipeline when it is saved with the existing pipelines,
+//it gets the names of pipelines in the loop or nil if there is none
+func findTriggerLoop(p *model.Pipeline, existing []*model.Pipeline) []string {
+	upstreams := map[string][]string{}
+	for _, e := range existing {
+		if e.Id == p.Id || e.Name == p.Name {
+			continue
+		}
+		for _, trigger := range e.PipelineTriggers {
+			upstreams[e.Name] = append(upstreams[e.Name], trigger.Pipeline)
+		}
+	}
+	for _, trigger := range p.PipelineTriggers {
+		upstreams[p.Name] = append(upstreams[p.Name], trigger.Pipeline)
+	}
+	//walk upstream from the pipeline, a loop leads back to it
+	visited := map[string]bool{}
+	var walk func(name string, path []string) []string
+	walk = func(name string, path []string) []string {
+		path = append(path, name)
+		for _, upstream := range upstreams[name] {
+			if upstream == p.Name {
+				return append(path, upstream)
+			}
+			if visited[upstream] {
+				continue
+			}
+			visited[upstream] = true
+			if loop := walk(upstream, path); loop != nil {
+				return loop
+			}
+		}
+		return nil
+	}
+	return walk(p.Name, nil)
+}
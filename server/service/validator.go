@@ -1,17 +1,24 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/condition"
+	"github.com/rancher/pipeline/jsonpath"
 	"github.com/rancher/pipeline/model"
 	"github.com/robfig/cron"
 )
 
 var ErrInvalidPipeline = errors.New("Invalid Pipeline definition")
 var regName = regexp.MustCompile(`^[\w]+[\w-_]*`)
+var regInputName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+var regEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var regCommitSHA = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
 
 func CleanPipeline(p *model.Pipeline) {
 	p.VersionSequence = ""
@@ -19,15 +26,18 @@ func CleanPipeline(p *model.Pipeline) {
 	p.LastRunId = ""
 	p.LastRunStatus = ""
 	p.LastRunTime = 0
+	p.LastCoverage = nil
 	p.NextRunTime = 0
 	p.CommitInfo = ""
+	p.BranchStates = nil
 	p.Repository = ""
 	p.Branch = ""
 	p.TargetImage = ""
-	p.File = ""
 	p.Templates = nil
 	p.WebHookId = 0
 	p.WebHookToken = ""
+	p.WebHookUUID = ""
+	p.GenericWebhookToken = ""
 
 	//set condition to nil if empty, for cleaner serialization
 	for _, stage := range p.Stages {
@@ -64,6 +74,22 @@ func Validate(p *model.Pipeline) error {
 		return err
 	}
 
+	if err := checkParameterDefinitions(p); err != nil {
+		return err
+	}
+
+	if err := checkCronSchedules(p); err != nil {
+		return err
+	}
+
+	if err := checkGenericWebhook(p); err != nil {
+		return err
+	}
+
+	if err := checkPipelineTriggers(p); err != nil {
+		return err
+	}
+
 	for _, stage := range p.Stages {
 		if err := checkCondition(stage.Conditions); err != nil {
 			return err
@@ -90,6 +116,27 @@ func validateStep(step *model.Step) error {
 		if !strings.HasSuffix(step.Repository, ".git") {
 			return errors.Wrap(ErrInvalidPipeline, "Invalid repo url for SCM step")
 		}
+		if err := checkPathPatterns("paths", step.Paths); err != nil {
+			return err
+		}
+		if err := checkPathPatterns("pathsIgnore", step.PathsIgnore); err != nil {
+			return err
+		}
+		if err := checkPathPatterns("tagPatterns", step.TagPatterns); err != nil {
+			return err
+		}
+		if err := checkPathPatterns("branches", step.Branches); err != nil {
+			return err
+		}
+		if err := checkPathPatterns("branchesIgnore", step.BranchesIgnore); err != nil {
+			return err
+		}
+		if !step.MultiBranch && (len(step.Branches) > 0 || len(step.BranchesIgnore) > 0) {
+			return errors.Wrap(ErrInvalidPipeline, "branches and branchesIgnore are only used in multi-branch mode")
+		}
+		if err := checkGitSource(step); err != nil {
+			return err
+		}
 	case model.StepTypeTask:
 		if step.Image == "" {
 			return errors.Wrap(ErrInvalidPipeline, "Image field should not be null for task step")
@@ -98,6 +145,28 @@ func validateStep(step *model.Step) error {
 		if step.TargetImage == "" {
 			return errors.Wrap(ErrInvalidPipeline, "Target Image field should not be null for build step")
 		}
+		if err := checkKeyValues("build arg", step.BuildArgs); err != nil {
+			return err
+		}
+		if err := checkKeyValues("label", step.Labels); err != nil {
+			return err
+		}
+		for _, tag := range step.Tags {
+			if tag == "" || strings.ContainsAny(tag, " \t\n") {
+				return errors.Wrapf(ErrInvalidPipeline, "tag '%s' is not a valid image name", tag)
+			}
+		}
+		for _, image := range step.CacheFrom {
+			if image == "" || strings.ContainsAny(image, " \t\n") {
+				return errors.Wrapf(ErrInvalidPipeline, "cache from '%s' is not a valid image name", image)
+			}
+		}
+		if strings.ContainsAny(step.Target, " \t\n") {
+			return errors.Wrapf(ErrInvalidPipeline, "target '%s' is not a valid build stage name", step.Target)
+		}
+		if strings.ContainsAny(step.Network, " \t\n") {
+			return errors.Wrapf(ErrInvalidPipeline, "network '%s' is not a valid network name", step.Network)
+		}
 	case model.StepTypeUpgradeService:
 		if step.ImageTag == "" {
 			return errors.Wrap(ErrInvalidPipeline, "Image field should not be null for upgradeService step")
@@ -113,6 +182,16 @@ func validateStep(step *model.Step) error {
 		if step.ExternalId == "" {
 			return errors.Wrap(ErrInvalidPipeline, "ExternalId should not be null for upgradeCatalog step")
 		}
+	case model.StepTypeTemplate:
+		if err := checkTemplateStep(step); err != nil {
+			return err
+		}
+	}
+	if step.TestUnstableThreshold < 0 || step.TestFailThreshold < 0 {
+		return errors.Wrap(ErrInvalidPipeline, "Test thresholds should not be negative")
+	}
+	if step.MinCoverage < 0 || step.MinCoverage > 100 || step.MaxCoverageDrop < 0 || step.MaxCoverageDrop > 100 {
+		return errors.Wrap(ErrInvalidPipeline, "Coverage gates should be percentages between 0 and 100")
 	}
 	if err := checkCondition(step.Conditions); err != nil {
 		return err
@@ -120,6 +199,33 @@ func validateStep(step *model.Step) error {
 	return nil
 }
 
+//checkGitSource checks that only polling branch changes is used for plain git sources, which have no webhook or api
+func checkGitSource(step *model.Step) error {
+	if step.PollInterval < 0 {
+		return errors.Wrap(ErrInvalidPipeline, "pollInterval should not be negative")
+	}
+	if !model.IsGitAccount(step.GitUser) {
+		return nil
+	}
+	unsupported := ""
+	switch {
+	case len(step.Paths) > 0 || len(step.PathsIgnore) > 0:
+		unsupported = "path filters"
+	case len(step.TagPatterns) > 0:
+		unsupported = "tag triggers"
+	case step.ReleaseEvents:
+		unsupported = "release triggers"
+	case step.PullRequests:
+		unsupported = "pull request builds"
+	case step.CommitStatus || step.StageStatus:
+		unsupported = "commit statuses"
+	}
+	if unsupported != "" {
+		return errors.Wrapf(ErrInvalidPipeline, "%s are not supported for plain git sources", unsupported)
+	}
+	return nil
+}
+
 func checkPipelineName(p *model.Pipeline) error {
 	if p.Name == "" {
 		return errors.New("Pipeline name should not be null!")
@@ -158,19 +264,254 @@ func checkCronSpec(spec string) error {
 	return nil
 }
 
+//checkCronSchedules checks specs, timezones and overrides of schedules, names of schedules should be unique
+func checkCronSchedules(p *model.Pipeline) error {
+	names := map[string]bool{}
+	for _, schedule := range p.Schedules() {
+		if schedule.Name == "" {
+			return errors.Wrap(ErrInvalidPipeline, "cron schedule name should not be empty")
+		}
+		if names[schedule.Name] {
+			return errors.Wrapf(ErrInvalidPipeline, "cron schedule name '%s' is duplicated", schedule.Name)
+		}
+		names[schedule.Name] = true
+		if schedule.Spec == "" {
+			return errors.Wrapf(ErrInvalidPipeline, "cron expression of schedule '%s' should not be empty", schedule.Name)
+		}
+		if err := checkCronSpec(schedule.Spec); err != nil {
+			return err
+		}
+		if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+			return errors.Wrapf(ErrInvalidPipeline, "timezone of schedule '%s' is not valid: %v", schedule.Name, err)
+		}
+		if _, err := ApplyRunInput(p, schedule.RunInput()); err != nil {
+			return errors.Wrapf(ErrInvalidPipeline, "schedule '%s': %v", schedule.Name, err)
+		}
+	}
+	return nil
+}
+
+//ValidateStepTemplate validates a step template, the name and version should be unique
+func ValidateStepTemplate(t *model.StepTemplate) error {
+	if t.Name == "" || strings.Contains(t.Name, "@") {
+		return errors.Wrap(ErrInvalidPipeline, "step template name should not be empty or contain '@'")
+	}
+	if t.Version == "" || strings.Contains(t.Version, "@") {
+		return errors.Wrap(ErrInvalidPipeline, "step template version should not be empty or contain '@'")
+	}
+	if len(t.Steps) == 0 {
+		return errors.Wrap(ErrInvalidPipeline, "step template should contain at least one step")
+	}
+	declared := map[string]bool{}
+	for _, input := range t.Inputs {
+		if !regInputName.MatchString(input.Name) {
+			return errors.Wrapf(ErrInvalidPipeline, "input name '%s' is not valid", input.Name)
+		}
+		if declared[input.Name] {
+			return errors.Wrapf(ErrInvalidPipeline, "input '%s' duplicates", input.Name)
+		}
+		declared[input.Name] = true
+	}
+	for _, step := range t.Steps {
+		if step.Type == model.StepTypeSCM || step.Type == model.StepTypeTemplate {
+			return errors.Wrapf(ErrInvalidPipeline, "step type '%s' is not supported in step templates", step.Type)
+		}
+		if err := checkCondition(step.Conditions); err != nil {
+			return err
+		}
+		if err := validateStep(step); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(t.Steps)
+	if err != nil {
+		return err
+	}
+	for _, m := range regInputRef.FindAllStringSubmatch(string(b), -1) {
+		if !declared[m[1]] {
+			return errors.Wrapf(ErrInvalidPipeline, "input '%s' is referred but not declared", m[1])
+		}
+	}
+	templates, err := ListStepTemplates()
+	if err != nil {
+		return err
+	}
+	for _, existing := range templates {
+		if existing.Id != t.Id && existing.Name == t.Name && existing.Version == t.Version {
+			return errors.Wrapf(ErrInvalidPipeline, "step template '%s' already exists", templateRef(t))
+		}
+	}
+	return nil
+}
+
+//checkTemplateStep checks the referred template exists and required inputs are provided
+func checkTemplateStep(step *model.Step) error {
+	template, err := GetStepTemplateByRef(step.Template)
+	if err != nil {
+		return errors.Wrap(ErrInvalidPipeline, err.Error())
+	}
+	if _, err := resolveTemplateInputs(template, step.With); err != nil {
+		return errors.Wrap(ErrInvalidPipeline, err.Error())
+	}
+	return nil
+}
+
 func checkCondition(conditions *model.PipelineConditions) error {
 	if conditions == nil {
 		return nil
 	}
-	for _, condition := range conditions.All {
-		if !strings.Contains(condition, "=") {
-			return errors.Wrapf(ErrInvalidPipeline, "condition '%s' is not valid, expected format 'xx=xx' or 'xx!=xx'", condition)
+	for _, expr := range append(conditions.All, conditions.Any...) {
+		if _, err := condition.Parse(expr); err != nil {
+			return errors.Wrapf(ErrInvalidPipeline, "condition '%s' is not valid: %v", expr, err)
+		}
+	}
+	return nil
+}
+
+//checkKeyValues checks items are in `key=val` format
+func checkKeyValues(field string, items []string) error {
+	for _, item := range items {
+		splits := strings.SplitN(item, "=", 2)
+		if len(splits) != 2 || strings.TrimSpace(splits[0]) == "" || strings.ContainsAny(splits[0], " \t\n") {
+			return errors.Wrapf(ErrInvalidPipeline, "%s '%s' is not valid, expected format 'key=val'", field, item)
+		}
+	}
+	return nil
+}
+
+//checkPathPatterns checks glob patterns of changed-path filters
+func checkPathPatterns(field string, patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			return errors.Wrapf(ErrInvalidPipeline, "%s should not contain empty pattern", field)
+		}
+	}
+	return nil
+}
+
+//checkParameterDefinitions checks names, types and defaults of parameter definitions
+func checkParameterDefinitions(p *model.Pipeline) error {
+	names := map[string]bool{}
+	for _, envvar := range p.Parameters {
+		names[strings.SplitN(envvar, "=", 2)[0]] = true
+	}
+	for _, def := range p.ParameterDefinitions {
+		if !regEnvName.MatchString(def.Name) || strings.HasPrefix(def.Name, "CICD_") {
+			return errors.Wrapf(ErrInvalidPipeline, "parameter name '%s' should be a variable name not starting with 'CICD_'", def.Name)
+		}
+		if names[def.Name] {
+			return errors.Wrapf(ErrInvalidPipeline, "parameter '%s' is declared more than once", def.Name)
+		}
+		names[def.Name] = true
+		switch def.Type {
+		case "", model.ParameterTypeString, model.ParameterTypeBoolean:
+		case model.ParameterTypeChoice:
+			if len(def.Choices) == 0 {
+				return errors.Wrapf(ErrInvalidPipeline, "choice parameter '%s' should have choices", def.Name)
+			}
+		default:
+			return errors.Wrapf(ErrInvalidPipeline, "parameter '%s' has unknown type '%s'", def.Name, def.Type)
+		}
+		if err := checkParameterValue(def, parameterDefault(def)); err != nil {
+			return errors.Wrapf(ErrInvalidPipeline, "default value: %v", err)
+		}
+	}
+	return nil
+}
+
+//checkGenericWebhook checks the auth, the paths of declared parameters and the filters of the generic webhook
+func checkGenericWebhook(p *model.Pipeline) error {
+	hook := p.GenericWebhook
+	if hook == nil {
+		return nil
+	}
+	switch hook.Auth {
+	case "", model.GenericWebhookAuthToken, model.GenericWebhookAuthHMAC:
+	default:
+		return errors.Wrapf(ErrInvalidPipeline, "generic webhook auth '%s' should be token or hmac", hook.Auth)
+	}
+	names := declaredParameters(p)
+	for name, path := range hook.Parameters {
+		if !names[name] {
+			return errors.Wrapf(ErrInvalidPipeline, "generic webhook sets undeclared parameter '%s'", name)
+		}
+		if _, err := jsonpath.Parse(path); err != nil {
+			return errors.Wrapf(ErrInvalidPipeline, "invalid path '%s' of parameter '%s': %v", path, name, err)
 		}
 	}
-	for _, condition := range conditions.Any {
-		if !strings.Contains(condition, "=") {
-			return errors.Wrapf(ErrInvalidPipeline, "condition '%s' is not valid, expected format 'xx=xx' or 'xx!=xx'", condition)
+	for _, filter := range hook.Filters {
+		if _, err := condition.Parse(filter); err != nil {
+			return errors.Wrapf(ErrInvalidPipeline, "invalid generic webhook filter '%s': %v", filter, err)
+		}
+	}
+	return nil
+}
+
+//checkPipelineTriggers checks upstream pipelines, statuses and parameters of pipeline triggers,
+//and that they do not form a loop with triggers of existing pipelines
+func checkPipelineTriggers(p *model.Pipeline) error {
+	if len(p.PipelineTriggers) == 0 {
+		return nil
+	}
+	existing := ListPipelines()
+	names := map[string]bool{}
+	for _, e := range existing {
+		names[e.Name] = true
+	}
+	params := declaredParameters(p)
+	for _, trigger := range p.PipelineTriggers {
+		if trigger.Pipeline == p.Name {
+			return errors.Wrap(ErrInvalidPipeline, "pipeline trigger should not refer to the pipeline itself")
+		}
+		if !names[trigger.Pipeline] {
+			return errors.Wrapf(ErrInvalidPipeline, "upstream pipeline '%s' of pipeline trigger is not found", trigger.Pipeline)
+		}
+		switch trigger.Status {
+		case "", model.PipelineTriggerSuccess, model.PipelineTriggerFailure, model.PipelineTriggerAny:
+		default:
+			return errors.Wrapf(ErrInvalidPipeline, "pipeline trigger status '%s' should be success, failure or any", trigger.Status)
+		}
+		if err := checkPathPatterns("branches", trigger.Branches); err != nil {
+			return err
+		}
+		for name := range trigger.Parameters {
+			if !params[name] {
+				return errors.Wrapf(ErrInvalidPipeline, "pipeline trigger sets undeclared parameter '%s'", name)
+			}
+		}
+	}
+	if loop := findTriggerLoop(p, existing); loop != nil {
+		return errors.Wrapf(ErrInvalidPipeline, "pipeline triggers form a loop: %s", strings.Join(loop, " <- "))
+	}
+	return nil
+}
+
+//declaredParameters gets names of parameters and parameter definitions of the pipeline
+func declaredParameters(p *model.Pipeline) map[string]bool {
+	names := map[string]bool{}
+	for _, envvar := range p.Parameters {
+		names[strings.SplitN(envvar, "=", 2)[0]] = true
+	}
+	for _, def := range p.ParameterDefinitions {
+		names[def.Name] = true
+	}
+	return names
+}
+
+//checkParameterValue checks the value matches the type of the parameter
+func checkParameterValue(def *model.ParameterDefinition, value string) error {
+	switch def.Type {
+	case model.ParameterTypeBoolean:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("value '%s' of boolean parameter '%s' should be 'true' or 'false'", value, def.Name)
+		}
+	case model.ParameterTypeChoice:
+		for _, choice := range def.Choices {
+			if value == choice {
+				return nil
+			}
 		}
+		return fmt.Errorf("value '%s' of parameter '%s' should be one of %s", value, def.Name, strings.Join(def.Choices, ", "))
 	}
 	return nil
 }
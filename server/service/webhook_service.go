@@ -0,0 +1,104 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/rancher/pipeline/condition"
+	"github.com/rancher/pipeline/jsonpath"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/util"
+)
+
+const genericWebhookTokenHeader = "X-Pipeline-Token"
+const genericWebhookSignatureHeader = "X-Pipeline-Signature"
+
+//IsGenericWebhook checks whether the request is authenticated as a generic webhook by headers
+func IsGenericWebhook(req *http.Request) bool {
+	return req.Header.Get(genericWebhookTokenHeader) != "" || req.Header.Get(genericWebhookSignatureHeader) != ""
+}
+
+//VerifyGenericWebhook checks the token or the hmac signature of a generic webhook request to the pipeline and gets the body.
+//The token can also be given by the token query parameter.
+func VerifyGenericWebhook(p *model.Pipeline, req *http.Request) ([]byte, error) {
+	if p.GenericWebhook == nil || !p.GenericWebhook.Enabled {
+		return nil, errors.New("generic webhook is not enabled")
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if p.GenericWebhookToken == "" {
+		return nil, errors.New("verify webhook fail")
+	}
+	switch p.GenericWebhook.Auth {
+	case model.GenericWebhookAuthHMAC:
+		//signature in sha256=<hex digest> format
+		signature := req.Header.Get(genericWebhookSignatureHeader)
+		if !strings.HasPrefix(signature, "sha256=") || !util.VerifyHMACSHA256([]byte(p.GenericWebhookToken), strings.TrimPrefix(signature, "sha256="), body) {
+			return nil, errors.New("verify webhook fail")
+		}
+	default:
+		token := req.Header.Get(genericWebhookTokenHeader)
+		if token == "" {
+			token = req.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.GenericWebhookToken)) != 1 {
+			return nil, errors.New("verify webhook fail")
+		}
+	}
+	return body, nil
+}
+
+//GenericWebhookInput gets the input of the run with parameters mapped from the json body of a generic webhook,
+//parameters whose paths are not found keep their values. It returns nil if the filters are not satisfied.
+func GenericWebhookInput(p *model.Pipeline, body []byte) (*model.RunInput, error) {
+	input := &model.RunInput{
+		Event:      model.WebhookEventGeneric,
+		Parameters: map[string]string{},
+	}
+	hook := p.GenericWebhook
+	if len(hook.Parameters) > 0 {
+		doc, err := jsonpath.Decode(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json body: %v", err)
+		}
+		for name, expr := range hook.Parameters {
+			path, err := jsonpath.Parse(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path of parameter '%s': %v", name, err)
+			}
+			if v, ok := path.Get(doc); ok {
+				input.Parameters[name] = jsonpath.Text(v)
+			}
+		}
+	}
+	if len(hook.Filters) == 0 {
+		return input, nil
+	}
+	toRun, err := ApplyRunInput(p, input)
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]string{"CICD_EVENT_TYPE": model.WebhookEventGeneric}
+	for _, envvar := range toRun.Parameters {
+		splits := strings.SplitN(envvar, "=", 2)
+		if len(splits) == 2 {
+			env[splits[0]] = splits[1]
+		}
+	}
+	for _, filter := range hook.Filters {
+		ok, err := condition.Evaluate(filter, &condition.Context{Env: env})
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter '%s': %v", filter, err)
+		}
+		if !ok {
+			return nil, nil
+		}
+	}
+	return input, nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/rancher/go-rancher/api"
+	"github.com/rancher/go-rancher/client"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+	"github.com/sluu99/uuid"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func (s *Server) ListStepTemplates(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	templates, err := service.ListStepTemplates()
+	if err != nil {
+		return err
+	}
+	result := []interface{}{}
+	for _, t := range templates {
+		result = append(result, model.ToStepTemplateResource(apiContext, t))
+	}
+	apiContext.Write(&client.GenericCollection{
+		Data: result,
+	})
+	return nil
+}
+
+func (s *Server) GetStepTemplate(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	t, err := service.GetStepTemplate(id)
+	if err != nil {
+		return err
+	}
+	return apiContext.WriteResource(model.ToStepTemplateResource(apiContext, t))
+}
+
+func (s *Server) CreateStepTemplate(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	t, err := readStepTemplate(req)
+	if err != nil {
+		return err
+	}
+	t.Id = uuid.Rand().Hex()
+	if err := service.ValidateStepTemplate(t); err != nil {
+		return err
+	}
+	if err := service.CreateStepTemplate(t); err != nil {
+		return err
+	}
+	broadcastResourceChange(*t)
+	return apiContext.WriteResource(model.ToStepTemplateResource(apiContext, t))
+}
+
+func (s *Server) UpdateStepTemplate(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	if _, err := service.GetStepTemplate(id); err != nil {
+		return err
+	}
+	t, err := readStepTemplate(req)
+	if err != nil {
+		return err
+	}
+	t.Id = id
+	if err := service.ValidateStepTemplate(t); err != nil {
+		return err
+	}
+	if err := service.UpdateStepTemplate(t); err != nil {
+		return err
+	}
+	broadcastResourceChange(*t)
+	return apiContext.WriteResource(model.ToStepTemplateResource(apiContext, t))
+}
+
+func (s *Server) RemoveStepTemplate(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	t, err := service.RemoveStepTemplate(id)
+	if err != nil {
+		return err
+	}
+	model.ToStepTemplateResource(apiContext, t)
+	t.Status = "removed"
+	broadcastResourceChange(*t)
+	return apiContext.WriteResource(t)
+}
+
+func (s *Server) ExportStepTemplate(rw http.ResponseWriter, req *http.Request) error {
+	id := mux.Vars(req)["id"]
+	t, err := service.GetStepTemplate(id)
+	if err != nil {
+		return err
+	}
+	content, err := yaml.Marshal(t.StepTemplateContent)
+	if err != nil {
+		return err
+	}
+	fileName := fmt.Sprintf("steptemplate-%s-%s.yaml", t.Name, t.Version)
+	rw.Header().Add("Content-Disposition", "attachment; filename="+fileName)
+	http.ServeContent(rw, req, fileName, time.Now(), bytes.NewReader(content))
+	return nil
+}
+
+//readStepTemplate reads a step template from request body, the content is imported from a yaml file if provided
+func readStepTemplate(req *http.Request) (*model.StepTemplate, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	t := &model.StepTemplate{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	for _, content := range t.Templates {
+		if content == "" {
+			return nil, fmt.Errorf("got empty step template file")
+		}
+		if err := yaml.UnmarshalStrict([]byte(content), &t.StepTemplateContent); err != nil {
+			return nil, err
+		}
+		logrus.Debugf("got imported step template:\n%v", t)
+		break
+	}
+	t.Templates = nil
+	return t, nil
+}
@@ -0,0 +1,271 @@
+//Package stepscript builds shell scripts of task and build steps,
+//they are shared by jenkins jobs and local runs so steps run the same way in both.
+//
+//Scripts run in the workspace, env vars of the activity are read from EnvFile in it.
+package stepscript
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/util"
+)
+
+//EnvFile provides env vars of the activity to steps, it is written by the SCM step and appended by later steps
+const EnvFile = ".r_cicd.env"
+
+//dockerEnvFile lists names of env vars passed to task containers, values are taken from the sourced env file
+const dockerEnvFile = ".r_cicd_docker.env"
+
+//envFileHeader defines R_CICD_NL, values use it for newlines so each env var of the env file is on one line
+const envFileHeader = "R_CICD_NL='\n'\n"
+
+//source the env file and list names of its env vars for docker, a docker env file takes values literally
+const sourceEnvScript = `set -a
+. ${PWD}/.r_cicd.env
+set +a
+sed -n 's/^\([A-Za-z_][A-Za-z0-9_]*\)=.*/\1/p' ${PWD}/.r_cicd.env|grep -v '^R_CICD_' >${PWD}/.r_cicd_docker.env
+`
+
+//DockerfileName is the file of the Dockerfile content of build steps
+const DockerfileName = ".r_cicd_Dockerfile"
+
+//wrap the step command with a $CICD_OUTPUT file, KEY=VALUE lines written to it are appended to the env file for later steps.
+//values are parsed like ParseOutputs does and single-quoted so they are taken literally when the env file is sourced
+const outputScript = `export CICD_OUTPUT=${PWD}/%s
+rm -f ${CICD_OUTPUT}
+%s
+if [ -f ${CICD_OUTPUT} ];then grep -E '^[A-Za-z_][A-Za-z0-9_]*=' ${CICD_OUTPUT}|grep -v '^CICD_'|tr -d '\r'|sed -E -e "s/^([^=]*)=\"(.*)\"\$/\1=\2/" -e "s/^([^=]*)='(.*)'\$/\1=\2/" -e "s/'/'\\\\''/g" -e "s/=/='/" -e "s/\$/'/" >>${PWD}/.r_cicd.env || true;fi
+`
+
+var regOutputLine = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+//TaskOptions are options of the container of a task step
+type TaskOptions struct {
+	ActivityId string
+	//name of the container, service containers are named by the activity and the alias
+	ContainerName string
+	//docker run options sharing the workspace with the container
+	Workspace string
+	//running service containers to link
+	Services []*model.CIService
+}
+
+//TaskScript gets the script running the container of a task step,
+//shell scripts are written to an entrypoint file and run by /bin/sh
+func TaskScript(step *model.Step, opts *TaskOptions) string {
+	b := new(bytes.Buffer)
+	envVars := "-e CICD_OUTPUT "
+	for _, para := range step.Env {
+		envVars += fmt.Sprintf("-e %s ", QuoteShell(para))
+	}
+
+	entrypointPara := ""
+	argsPara := ""
+	svcPara := ""
+	svcCheck := ""
+	labelPara := fmt.Sprintf("-l activityid=%s", opts.ActivityId)
+	if step.ShellScript != "" {
+		entrypointPara = "--entrypoint /bin/sh"
+		entryFileName := fmt.Sprintf(".r_cicd_entrypoint_%s.sh", util.RandStringRunes(4))
+		argsPara = entryFileName
+
+		//write to a sh file,then docker run it
+		b.WriteString(fmt.Sprintf("cat>%s<<R_CICD_EOF\n", entryFileName))
+		b.WriteString("set -xe\n")
+		cmd := strings.Replace(step.ShellScript, "\\", "\\\\", -1)
+		cmd = strings.Replace(cmd, "$", "\\$", -1)
+		b.WriteString(cmd)
+		b.WriteString("\nR_CICD_EOF\n")
+	} else {
+		if step.Entrypoint != "" {
+			entrypointPara = "--entrypoint " + step.Entrypoint
+		}
+		argsPara = step.Args
+	}
+	b.WriteString(sourceEnvScript)
+	if step.IsService {
+		containerName := opts.ActivityId + step.Alias
+		svcPara = "-itd --name " + containerName
+		svcCheck = fmt.Sprintf("\necho 'run a service container with alias %s.'", step.Alias)
+		svcCheck = svcCheck + fmt.Sprintf("\nsleep 3;if [ \"$(docker inspect -f {{.State.Running}} %s)\" = \"false\" ];then docker logs \"%s\";echo \"Error: service container \\\"%s\\\" is stopped.\ncheck above logs or the task step config.\nA running container is expected when using \\\"as a service\\\" option.\";exit 1;fi", containerName, containerName, step.Alias)
+	} else if opts.ContainerName != "" {
+		svcPara = "--name " + opts.ContainerName
+	}
+
+	linkInfo := ""
+	for _, svc := range opts.Services {
+		linkInfo += fmt.Sprintf("--link %s:%s ", svc.ContainerName, svc.Name)
+	}
+
+	b.WriteString("docker run --rm")
+	for _, para := range []string{"--env-file ${PWD}/" + dockerEnvFile, envVars, labelPara, svcPara, opts.Workspace, entrypointPara, linkInfo, step.Image, argsPara} {
+		b.WriteString(" ")
+		b.WriteString(para)
+	}
+	b.WriteString(svcCheck)
+	return b.String()
+}
+
+//BuildScript gets the script building the image of a build step,
+//all its tags are pushed by pushCommand, they are not pushed if it is empty
+func BuildScript(step *model.Step, pushCommand string) string {
+	b := new(bytes.Buffer)
+	b.WriteString(". ${PWD}/.r_cicd.env\n")
+	buildPath := "."
+	if step.BuildPath != "" {
+		buildPath = step.BuildPath
+	}
+	dockerfilePath := "Dockerfile"
+	if step.Dockerfile != "" {
+		b.WriteString("echo " + QuoteShell(step.Dockerfile) + ">" + DockerfileName + ";\n")
+		dockerfilePath = DockerfileName
+	} else if step.DockerfilePath != "" {
+		dockerfilePath = step.DockerfilePath
+	}
+	b.WriteString("set -xe\n")
+	//images for cache should exist locally
+	for _, image := range step.CacheFrom {
+		b.WriteString(fmt.Sprintf("docker pull %s || true;\n", QuoteShell(image)))
+	}
+	b.WriteString("docker build")
+	for _, tag := range ImageTags(step) {
+		b.WriteString(" --tag " + QuoteShell(tag))
+	}
+	for _, arg := range step.BuildArgs {
+		b.WriteString(" --build-arg " + QuoteShell(arg))
+	}
+	for _, label := range step.Labels {
+		b.WriteString(" --label " + QuoteShell(label))
+	}
+	for _, image := range step.CacheFrom {
+		b.WriteString(" --cache-from " + QuoteShell(image))
+	}
+	if step.Target != "" {
+		b.WriteString(" --target " + QuoteShell(step.Target))
+	}
+	if step.Network != "" {
+		b.WriteString(" --network " + QuoteShell(step.Network))
+	}
+	if step.NoCache {
+		b.WriteString(" --no-cache")
+	}
+	if step.Pull {
+		b.WriteString(" --pull")
+	}
+	b.WriteString(" -f " + QuoteShell(dockerfilePath))
+	b.WriteString(" ")
+	b.WriteString(QuoteShell(buildPath))
+	b.WriteString(";")
+	if pushCommand != "" {
+		for _, tag := range ImageTags(step) {
+			b.WriteString("\n" + pushCommand + " ")
+			b.WriteString(QuoteShell(tag))
+			b.WriteString(";")
+		}
+	}
+	return b.String()
+}
+
+//CaptureImageScript records image id and the digest of the pushed image of a build step in ImageInfoFile,
+//they are appended to the env file for later steps
+func CaptureImageScript(step *model.Step, stageOrdinal int, stepOrdinal int, pushed bool) string {
+	prefix := model.BuildImageVarPrefix(step, stageOrdinal, stepOrdinal)
+	infoFile := ImageInfoFile(stageOrdinal, stepOrdinal)
+	image := QuoteShell(step.TargetImage)
+	b := new(bytes.Buffer)
+	b.WriteString("\nset +x\n")
+	b.WriteString(fmt.Sprintf("echo \"%s_IMAGE_ID=$(docker inspect -f '{{.Id}}' %s)\">%s\n", prefix, image, infoFile))
+	if pushed {
+		//pick the digest of the target repository, the image may have been pushed to several ones
+		b.WriteString(fmt.Sprintf("R_CICD_DIGESTS=$(docker inspect -f '{{range .RepoDigests}}{{println .}}{{end}}' %s)\n", image))
+		b.WriteString(fmt.Sprintf("R_CICD_REFERENCE=$(echo \"$R_CICD_DIGESTS\"|grep -F %s|head -n 1)\n", QuoteShell(ImageRepository(step.TargetImage)+"@")))
+		b.WriteString("if [ -z \"$R_CICD_REFERENCE\" ];then R_CICD_REFERENCE=$(echo \"$R_CICD_DIGESTS\"|head -n 1);fi\n")
+		b.WriteString(fmt.Sprintf("echo \"%s_DIGEST=${R_CICD_REFERENCE#*@}\">>%s\n", prefix, infoFile))
+		b.WriteString(fmt.Sprintf("echo \"%s_IMAGE=$R_CICD_REFERENCE\">>%s\n", prefix, infoFile))
+	}
+	b.WriteString(fmt.Sprintf("cat %s|tee -a ${PWD}/.r_cicd.env\n", infoFile))
+	return b.String()
+}
+
+//OutputScript wraps the command of a step to collect its outputs in OutputFile
+func OutputScript(stageOrdinal int, stepOrdinal int, command string) string {
+	return fmt.Sprintf(outputScript, OutputFile(stageOrdinal, stepOrdinal), command)
+}
+
+//EnvFileContent gets the content of the env file with the env vars, they are written in the order of keys
+func EnvFileContent(keys []string, vars map[string]string) string {
+	b := new(bytes.Buffer)
+	b.WriteString(envFileHeader)
+	for _, k := range keys {
+		b.WriteString(EnvLine(k, vars[k]))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+//EnvLine gets the line of an env var in the env file, the value is taken literally when it is sourced
+func EnvLine(key string, value string) string {
+	return key + "=" + Quote(value)
+}
+
+//Quote single-quotes a value in the env file, newlines are written as $R_CICD_NL
+func Quote(value string) string {
+	escaped := strings.Replace(value, "'", `'\''`, -1)
+	escaped = strings.Replace(escaped, "\n", `'"$R_CICD_NL"'`, -1)
+	return "'" + escaped + "'"
+}
+
+//ParseOutputs parses `KEY=VALUE` lines written to $CICD_OUTPUT by a step,
+//a value is taken to the end of the line and quotes around it are stripped
+func ParseOutputs(content string) map[string]string {
+	outputs := map[string]string{}
+	for _, line := range strings.Split(strings.Replace(content, "\r", "", -1), "\n") {
+		m := regOutputLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		value := m[2]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		outputs[m[1]] = value
+	}
+	return outputs
+}
+
+//ImageTags gets the target image and extra tags of a build step
+func ImageTags(step *model.Step) []string {
+	return append([]string{step.TargetImage}, step.Tags...)
+}
+
+//OutputFile is the $CICD_OUTPUT file of a step
+func OutputFile(stageOrdinal int, stepOrdinal int) string {
+	return fmt.Sprintf(".r_cicd_output_%d_%d.env", stageOrdinal, stepOrdinal)
+}
+
+//ImageInfoFile is the file of image variables of a build step
+func ImageInfoFile(stageOrdinal int, stepOrdinal int) string {
+	return fmt.Sprintf(".r_cicd_image_%d_%d.env", stageOrdinal, stepOrdinal)
+}
+
+//ImageRepository strips the tag of an image name
+func ImageRepository(image string) string {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+//QuoteShell quotes a value in a script, variable substitution works in it
+func QuoteShell(script string) string {
+	//Use double quotes so variable substitution works
+
+	escaped := strings.Replace(script, "\\", "\\\\", -1)
+	escaped = strings.Replace(script, "\"", "\\\"", -1)
+	escaped = "\"" + escaped + "\""
+	return escaped
+}
@@ -1,6 +1,9 @@
 package util
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"math/rand"
 	"net/http"
@@ -125,3 +128,15 @@ func GetCurrentUser(cookies []*http.Cookie) (string, error) {
 	}
 	return userid, nil
 }
+
+//VerifyHMACSHA256 checks the hex encoded HMAC-SHA256 signature of the body,
+//webhook signatures of bitbucket server, gitea and generic webhooks are checked by it
+func VerifyHMACSHA256(secret []byte, signature string, body []byte) bool {
+	actual, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	computed := hmac.New(sha256.New, secret)
+	computed.Write(body)
+	return hmac.Equal(computed.Sum(nil), actual)
+}